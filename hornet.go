@@ -26,6 +26,7 @@ import (
 	//"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -46,6 +47,13 @@ func main() {
 	// configuration file
 	var configFile string
 
+	// commands for modifying the watch directories of a running hornet instance
+	var addWatchDir, removeWatchDir string
+	var listWatchDirs bool
+
+	// priority for the files submitted on the command line
+	var priority int
+
 	// set up flag to point at conf, parse arguments and then verify
 	flag.BoolVar(&needHelp,
 		"help",
@@ -55,6 +63,22 @@ func main() {
 		"config",
 		"",
 		"JSON configuration file")
+	flag.IntVar(&priority,
+		"priority",
+		0,
+		"priority for the files submitted on the command line (overrides the file-type and job priorities)")
+	flag.StringVar(&addWatchDir,
+		"add-watch-dir",
+		"",
+		"add a watch directory to a running hornet instance (via AMQP) and exit")
+	flag.StringVar(&removeWatchDir,
+		"remove-watch-dir",
+		"",
+		"remove a watch directory from a running hornet instance (via AMQP) and exit")
+	flag.BoolVar(&listWatchDirs,
+		"list-watch-dirs",
+		false,
+		"list the watch directories of a running hornet instance (via AMQP) and exit")
 	flag.Parse()
 
 	if needHelp {
@@ -92,7 +116,16 @@ func main() {
 	}
 	hornet.Log.Debugf("Full configuration:\n%v", string(indentedConfig))
 
-	if viper.GetBool("amqp.active") || viper.GetBool("slack.active") {
+	// the shipping destinations are checked by the scheduler; here they're needed for the credentials and the thread count
+	shippingDestinations, _ := hornet.GetShippingDestinations()
+	shippingToS3 := false
+	for _, destination := range shippingDestinations {
+		if destination.Settings["transport"] == "s3" {
+			shippingToS3 = true
+		}
+	}
+
+	if viper.GetBool("amqp.active") || viper.GetBool("slack.active") || shippingToS3 {
 		// get the authenticator credentials
 		if authErr := hornet.LoadAuthenticators(); authErr != nil {
 			hornet.Log.Criticalf("Error getting authentication credentials:\n\t%s", authErr.Error())
@@ -100,12 +133,27 @@ func main() {
 		}
 	}
 
+	// commands for a running hornet instance are sent via AMQP, after which this instance exits
+	switch {
+	case addWatchDir != "":
+		os.Exit(sendWatcherCommand("add-dir", addWatchDir))
+	case removeWatchDir != "":
+		os.Exit(sendWatcherCommand("remove-dir", removeWatchDir))
+	case listWatchDirs:
+		os.Exit(sendWatcherCommand("list", ""))
+	}
+
 	// Check the number of threads to be used
 	// Threads used:
-	//   1 each for the scheduler, classifier, watcher, mover, amqp sender, amqp receiver, slack client = 7
+	//   1 each for the scheduler, classifier, watcher, run tracker, janitor, amqp sender, amqp receiver, slack client = 8
 	//   N nearline workers (specified in scheduler.n-nearline-workers)
-	//   M shippers (specified in scheduler.n-shippers)
-	nThreads := 7 + viper.GetInt("workers.n-workers") + viper.GetInt("shipper.n-shippers")
+	//   L movers (specified in mover.n-movers)
+	//   M shippers (specified in scheduler.n-shippers) for each shipping destination
+	//   R registrars (specified in registration.n-registrars), if files are registered with the run database
+	nThreads := 8 + viper.GetInt("workers.n-workers") + hornet.GetStageCount("mover.n-movers") + hornet.GetStageCount("shipper.n-shippers")*len(shippingDestinations)
+	if hornet.RegistrationIsActive() {
+		nThreads += hornet.GetStageCount("registration.n-registrars")
+	}
 	if nThreads > hornet.MaxThreads {
 		hornet.Log.Critical("Maximum number of threads exceeded")
 		return
@@ -134,8 +182,15 @@ func main() {
 	hornet.StartAmqp(controlQueue, requestQueue, threadCountQueue, &pool)
 
 	// check to see if any files are being scheduled via the command line
+	priorityIsSet := false
+	flag.Visit(func(f *flag.Flag) { priorityIsSet = priorityIsSet || f.Name == "priority" })
 	for iFile := 0; iFile < flag.NArg(); iFile++ {
 		fmt.Println("Scheduling", flag.Arg(iFile))
+		if priorityIsSet {
+			if absPath, absErr := filepath.Abs(flag.Arg(iFile)); absErr == nil {
+				hornet.SetSubmissionPriority(absPath, priority)
+			}
+		}
 		schedulingQueue <- flag.Arg(iFile)
 	}
 
@@ -193,3 +248,41 @@ stopLoop:
 		hornet.Log.Info("Timed out waiting for goroutines to finish.")
 	}
 }
+
+// sendWatcherCommand sends a watcher command to a running hornet instance and prints the resulting list
+// of watch directories.  It returns the exit status for the program.
+func sendWatcherCommand(command, dir string) int {
+	if viper.GetBool("amqp.active") == false {
+		hornet.Log.Critical("AMQP must be active to send commands to a running hornet instance")
+		return 1
+	}
+
+	var payload map[string]interface{}
+	if dir != "" {
+		// relative paths are interpreted with respect to the current directory, not hornet's
+		dirAbs, absErr := filepath.Abs(dir)
+		if absErr != nil {
+			hornet.Log.Criticalf("Unable to determine an absolute path for <%s>", dir)
+			return 1
+		}
+		payload = map[string]interface{}{"values": []string{dirAbs}}
+	}
+
+	target := []string{viper.GetString("amqp.queue"), "watcher", command}
+	reply, reqErr := hornet.SendRemoteRequest(target, hornet.MOCommand, payload, 10*time.Second)
+	if reqErr != nil {
+		hornet.Log.Criticalf("Unable to send the watcher command:\n\t%v", reqErr)
+		return 1
+	}
+
+	dirsIfc, _ := hornet.GetPayloadValue(reply.Payload, "dirs")
+	fmt.Println("Watch directories:")
+	for _, watchDir := range hornet.ConvertToStringSlice(dirsIfc) {
+		fmt.Println("\t" + watchDir)
+	}
+	if reply.RetCode != hornet.RCSuccess {
+		hornet.Log.Errorf("Watcher command failed (%d): %s", reply.RetCode, reply.RetMsg)
+		return 1
+	}
+	return 0
+}
@@ -3,7 +3,7 @@
 *
 * the amqp functions takes care of communication via the AMQP protocol
 *
-* Two threads can be used for receiving and sending AMQP messages, respectively: AmqpReceiver and AmqpSender
+* Two threads are used for receiving and sending AMQP messages, respectively: the receiver and sender of the AMQP message bus (see bus.go)
  */
 
 package hornet
@@ -13,8 +13,10 @@ import (
 	"fmt"
 	"os"
 	"os/user"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -46,8 +48,15 @@ type P8Message struct {
 	RetMsg    string
 	TimeStamp string
 	SenderInfo
-	Payload   interface{}
-	ReplyChan chan P8Message
+	Specifier  string
+	LockoutKey string
+	Payload    interface{}
+	ReplyTo    string
+	ReplyChan  chan P8Message
+	// if not nil, the outcome of sending the message is reported on this channel (see amqp_confirms.go)
+	DeliveryChan chan P8Message
+	// if true, the message is sent without the mandatory flag, so the broker doesn't return it if there are no listeners
+	AllowUnroutable bool
 }
 
 // Globally-accessible message-sending queue
@@ -57,13 +66,10 @@ var SendMessageQueue = make(chan P8Message, 100)
 var TargetSeparator string = "."
 
 // Value to confirm that the AMQP sender routine has started
-var AmqpSenderIsActive bool = false
+var AmqpSenderIsActive atomic.Bool
 
 // Value to confirm that the AMQP receiver routine has started
-var AmqpReceiverIsActive bool = false
-
-// Map of correlation ID to channel to handle the reply message
-var replyMap map[string]chan P8Message
+var AmqpReceiverIsActive atomic.Bool
 
 var MasterSenderInfo SenderInfo
 
@@ -91,7 +97,7 @@ func fillMasterSenderInfo() (e error) {
 
 // ValidateAmqpConfig checks the sanity of the amqp section of a configuration.
 // It makes the following guarantees
-//   1) The broker setting is present
+//   1) The broker (or URL) setting is present, unless the in-memory bus is used
 //   2) If the receiver is present and active, then the queue and exchange are set.
 func ValidateAmqpConfig() (e error) {
 	if viper.IsSet("amqp.active") == false {
@@ -107,11 +113,22 @@ func ValidateAmqpConfig() (e error) {
 		Log.Error(e.Error())
 	}
 
-	if viper.IsSet("amqp.broker") == false || viper.IsSet("amqp.exchange") == false {
-		e = errors.New("AMQP sender/receiver cannot be used without the broker and exchange being set")
+	// the in-memory bus (see memory_bus.go) doesn't need a broker
+	usesBroker := viper.GetString("amqp.bus") != "memory"
+	if usesBroker && ((viper.IsSet("amqp.broker") == false && viper.IsSet("amqp.url") == false) || viper.IsSet("amqp.exchange") == false) {
+		e = errors.New("AMQP sender/receiver cannot be used without the broker (or URL) and exchange being set")
 		Log.Error(e.Error())
 	}
 
+	if _, subErr := getAmqpSubscriptions(); subErr != nil {
+		e = subErr
+		Log.Error(e.Error())
+	}
+
+	if eventsErr := ValidateEventsConfig(); eventsErr != nil {
+		e = eventsErr
+	}
+
 	return
 }
 
@@ -135,108 +152,152 @@ func StartAmqp(ctrlQueue, reqQueue chan ControlMessage, threadCountQueue chan ui
 		return
 	}
 
-	Log.Info("Starting AMQP receiver")
-	poolCount.Add(1)
-	threadCountQueue <- 1
-	go AmqpReceiver(ctrlQueue, reqQueue, poolCount)
-
-	Log.Info("Starting AMQP sender")
-	poolCount.Add(1)
-	threadCountQueue <- 1
-	go AmqpSender(ctrlQueue, reqQueue, poolCount)
-
+	bus, busErr := NewMessageBus()
+	if busErr != nil {
+		e = busErr
+		Log.Criticalf("Cannot start AMQP: %v", e)
+		reqQueue <- ThreadCannotContinue
+		return
+	}
+	if e = StartMessageBus(bus, ctrlQueue, reqQueue, threadCountQueue, poolCount); e != nil {
+		Log.Criticalf("Cannot start AMQP: %v", e)
+		reqQueue <- ThreadCannotContinue
+	}
 	return
 }
 
-// AmqpReceiver is a goroutine for receiving and handling AMQP messages
-func AmqpReceiver(ctrlQueue chan ControlMessage, reqQueue chan ControlMessage, poolCount *sync.WaitGroup) {
-	// decrement the wg counter at the end
-	defer poolCount.Done()
-	defer Log.Info("[AMQP receiver is finished.")
-
-	// Connect to the AMQP broker
-	// Deferred command: close the connection
-	brokerAddress := viper.GetString("amqp.broker")
-	if viper.GetBool("amqp.use-auth") {
-		if Authenticators.Amqp.Available == false {
-			Log.Critical("AMQP authentication is not available")
-			reqQueue <- StopExecution
+// decodeP8Message decodes the body of a received message and translates it into a P8Message object
+func decodeP8Message(message BusMessage) (p8Message P8Message, e error) {
+	// the message properties are kept even if the body can't be decoded, so that an error reply can be sent
+	p8Message.Encoding, p8Message.CorrId, p8Message.ReplyTo = message.ContentEncoding, message.CorrelationId, message.ReplyTo
+
+	// Decode the body of the message
+	//log.Printf("[amqp receiver] Received message with encoding %s", message.ContentEncoding)
+	var body map[string]interface{}
+	switch message.ContentEncoding {
+	case "application/json":
+		//log.Printf("this is a json message")
+		handle := new(codec.JsonHandle)
+		decoder := codec.NewDecoderBytes(message.Body, handle)
+		jsonErr := decoder.Decode(&body)
+		if jsonErr != nil {
+			e = MessageError{RCErrDecodingFail, fmt.Sprintf("Unable to decode JSON-encoded message:\n\t%v", jsonErr)}
 			return
 		}
-		brokerAddress = Authenticators.Amqp.Username + ":" + Authenticators.Amqp.Password + "@" + brokerAddress
-	}
-	brokerAddress = "amqp://" + brokerAddress
-	if viper.IsSet("amqp.port") {
-		brokerAddress = brokerAddress + ":" + viper.GetString("amqp.port")
-	}
-	connection, receiveErr := amqp.Dial(brokerAddress)
-	if receiveErr != nil {
-		Log.Criticalf("Unable to connect to the AMQP broker at (%s) for receiving:\n\t%v", brokerAddress, receiveErr.Error())
-		reqQueue <- StopExecution
+	case "application/msgpack":
+		//log.Printf("this is a msgpack message")
+		handle := new(codec.MsgpackHandle)
+		decoder := codec.NewDecoderBytes(message.Body, handle)
+		msgpackErr := decoder.Decode(&body)
+		if msgpackErr != nil {
+			e = MessageError{RCErrDecodingFail, fmt.Sprintf("Unable to decode msgpack-encoded message:\n\t%v", msgpackErr)}
+			return
+		}
+	default:
+		e = MessageError{RCErrNoEncoding, fmt.Sprintf("Message content encoding is not understood: %s", message.ContentEncoding)}
 		return
 	}
-	defer connection.Close()
+	//log.Printf("[amqp receiver] Message body:\n\t%v", body)
 
-	// Create the channel object that represents the connection to the broker
-	// Deferred command: close the channel
-	channel, chanErr := connection.Channel()
-	if chanErr != nil {
-		Log.Criticalf("Unable to get the AMQP channel:\n\t%v", chanErr.Error())
-		reqQueue <- StopExecution
+	// Message contents validation (see message.go)
+	p8Message, e = parseP8Message(body)
+	p8Message.Encoding, p8Message.CorrId, p8Message.ReplyTo = message.ContentEncoding, message.CorrelationId, message.ReplyTo
+	if e != nil {
 		return
 	}
-	defer channel.Close()
 
-	// Create the exchange if it doesn't already exist
-	exchangeName := viper.GetString("amqp.exchange")
-	exchDeclErr := channel.ExchangeDeclare(exchangeName, "topic", false, false, false, false, nil)
-	if exchDeclErr != nil {
-		Log.Criticalf("Unable to declare exchange <%s>:\n\t%v", exchangeName, exchDeclErr.Error())
-		reqQueue <- StopExecution
+	routingKeyParts := strings.Split(message.RoutingKey, TargetSeparator)
+	if len(routingKeyParts) > 1 {
+		p8Message.Target = routingKeyParts[1:len(routingKeyParts)]
+	}
+	return
+}
+
+// amqpBus is the message bus provided by an AMQP broker
+type amqpBus struct {
+	connector    *amqpConnector
+	exchangeName string
+}
+
+func newAmqpBus() (bus *amqpBus, e error) {
+	connector, connectorErr := newAmqpConnector()
+	if connectorErr != nil {
+		e = connectorErr
 		return
 	}
+	bus = &amqpBus{connector: connector, exchangeName: viper.GetString("amqp.exchange")}
+	return
+}
 
-	// Declare the "hornet" queue
-	// Deferred command: delete the "hornet" queue
-	queueName := viper.GetString("amqp.queue")
-	_, queueDeclErr := channel.QueueDeclare(queueName, false, true, true, false, nil)
-	if queueDeclErr != nil {
-		Log.Criticalf("Unable to declare queue <%s>:\n\t%v", queueName, queueDeclErr.Error())
-		reqQueue <- StopExecution
+func (b *amqpBus) Name() string {
+	return "AMQP"
+}
+
+// RunReceiver receives AMQP messages, and passes them to the handler
+func (b *amqpBus) RunReceiver(queueName string, bindings []string, handle func(BusMessage), ctrlQueue, reqQueue chan ControlMessage) {
+	connector, exchangeName := b.connector, b.exchangeName
+
+	// Connect to the AMQP broker, and set up the exchange and queue; this is repeated if the connection is lost
+	var connection *amqp.Connection
+	var channel *amqp.Channel
+	var messageQueue <-chan amqp.Delivery
+	var connectionClosed chan *amqp.Error
+	connect := func() (e error) {
+		if connection, e = connector.Dial("receiver"); e != nil {
+			return
+		}
+		connectionClosed = connection.NotifyClose(make(chan *amqp.Error, 1))
+		if channel, messageQueue, e = setUpReceiverQueue(connection, exchangeName, queueName, bindings); e != nil {
+			connection.Close()
+			connection = nil
+		}
 		return
 	}
-	defer func() {
-		if _, err := channel.QueueDelete(queueName, false, false, false); err != nil {
-			Log.Errorf("Error while deleting queue:\n\t%v", err)
+	disconnect := func() {
+		if connection != nil {
+			connection.Close()
 		}
-	}()
+		connection, channel, messageQueue, connectionClosed = nil, nil, nil, nil
+	}
 
-	// Bind the "hornet" queue to the exchange, and subscribe it to all routing keys that start with "hornet"
-	// Deferred command: unbind the "hornet" queue from the exchange
-	queueBindErr := channel.QueueBind(queueName, queueName+".#", exchangeName, false, nil)
-	if queueBindErr != nil {
-		Log.Criticalf("Unable to bind queue <%s> to exchange <%s>:\n\t%v", queueName, exchangeName, queueBindErr.Error())
+	if connErr := connect(); connErr != nil {
+		Log.Critical(connErr.Error())
 		reqQueue <- StopExecution
 		return
 	}
+	// Deferred commands: unbind and delete the queue, and close the channel and connection
 	defer func() {
-		if err := channel.QueueUnbind(queueName, queueName+".#", exchangeName, nil); err != nil {
-			Log.Errorf("Error while unbinding queue:\n\t%v", err)
+		if channel != nil {
+			for _, binding := range bindings {
+				if err := channel.QueueUnbind(queueName, binding, exchangeName, nil); err != nil {
+					Log.Errorf("Error while unbinding queue from <%s>:\n\t%v", binding, err)
+				}
+			}
+			if _, err := channel.QueueDelete(queueName, false, false, false); err != nil {
+				Log.Errorf("Error while deleting queue:\n\t%v", err)
+			}
+			channel.Close()
 		}
+		disconnect()
 	}()
 
-	// Start consuming messages on the queue
-	// Channel::Cancel is not executed as a deferred command, because consuming will be stopped by Channel.Close
-	messageQueue, consumeErr := channel.Consume(queueName, "", false, true, true, false, nil)
-	if consumeErr != nil {
-		Log.Criticalf("Unable start consuming from queue <%s>:\n\t%v", queueName, queueBindErr.Error())
-		reqQueue <- StopExecution
-		return
+	// if the connection is lost, the receiver reconnects until it succeeds or is stopped
+	backoff := newAmqpBackoff()
+	reconnect := func(reason interface{}) bool {
+		Log.Errorf("AMQP receiver lost its connection to the broker: %v", reason)
+		AmqpReceiverIsActive.Store(false)
+		disconnect()
+		if reconnectAmqp("receiver", connect, backoff, ctrlQueue) == false {
+			Log.Info("AMQP receiver stopping on interrupt.")
+			return false
+		}
+		AmqpReceiverIsActive.Store(true)
+		return true
 	}
 
 	Log.Info("AMQP Receiver started successfully")
-	AmqpReceiverIsActive = true
-	defer func() { AmqpReceiverIsActive = false }()
+	AmqpReceiverIsActive.Store(true)
+	defer func() { AmqpReceiverIsActive.Store(false) }()
 
 amqpLoop:
 	for {
@@ -251,12 +312,17 @@ amqpLoop:
 				Log.Info("AMQP receiver stopping on interrupt.")
 				break amqpLoop
 			}
+		case amqpErr := <-connectionClosed:
+			if reconnect(amqpErr) == false {
+				break amqpLoop
+			}
 		// process any AMQP messages that are received
 		case message, queueOk := <-messageQueue:
 			if !queueOk {
-				Log.Error("AMQP message queue has closed unexpectedly")
-				reqQueue <- StopExecution
-				break amqpLoop
+				if reconnect("the message queue has closed") == false {
+					break amqpLoop
+				}
+				continue amqpLoop
 			}
 
 			// Send an acknowledgement to the broker
@@ -264,215 +330,394 @@ amqpLoop:
 				Log.Error("Unable to acknowledge AMQP message")
 			}
 
-			// Decode the body of the message
-			//log.Printf("[amqp receiver] Received message with encoding %s", message.ContentEncoding)
-			var body map[string]interface{}
-			switch message.ContentEncoding {
-			case "application/json":
-				//log.Printf("this is a json message")
-				handle := new(codec.JsonHandle)
-				decoder := codec.NewDecoderBytes(message.Body, handle)
-				jsonErr := decoder.Decode(&body)
-				if jsonErr != nil {
-					Log.Error("Unable to decode JSON-encoded message:\n\t%v", jsonErr)
-					continue amqpLoop
-				}
-			case "application/msgpack":
-				//log.Printf("this is a msgpack message")
-				handle := new(codec.MsgpackHandle)
-				decoder := codec.NewDecoderBytes(message.Body, handle)
-				msgpackErr := decoder.Decode(&body)
-				if msgpackErr != nil {
-					Log.Error("Unable to decode msgpack-encoded message:\n\t%v", msgpackErr)
-					continue amqpLoop
-				}
-			default:
-				Log.Error("Message content encoding is not understood: %s", message.ContentEncoding)
-				continue amqpLoop
-			}
-			//log.Printf("[amqp receiver] Message body:\n\t%v", body)
-
-			// Message contents validation
-			// required elements: msgtype, timestamp, sender_info
-			msgTypeIfc, msgtypePresent := body["msgtype"]
-			timestampIfc, timestampPresent := body["timestamp"]
-			senderInfoIfc, senderInfoPresent := body["sender_info"]
-			if msgtypePresent && timestampPresent && senderInfoPresent == false {
-				Log.Error("Message is missing a required element:\n\tmsgtype: %v\n\ttimestamp: %v\n\tsender_info: %v", msgtypePresent, timestampPresent, senderInfoPresent)
-				continue amqpLoop
-			}
-			msgType := ConvertToMsgCode(msgTypeIfc)
-
-			// Translate the body of the message into a P8Message object
-			senderInfo := senderInfoIfc.(map[interface{}]interface{})
-			p8Message := P8Message{
-				Encoding:  message.ContentEncoding,
-				CorrId:    message.CorrelationId,
-				MsgType:   msgType,
-				TimeStamp: ConvertToString(timestampIfc),
-				SenderInfo: SenderInfo{
-					Package:  ConvertToString(senderInfo["package"]),
-					Exe:      ConvertToString(senderInfo["exe"]),
-					Version:  ConvertToString(senderInfo["version"]),
-					Commit:   ConvertToString(senderInfo["commit"]),
-					Hostname: ConvertToString(senderInfo["hostname"]),
-					Username: ConvertToString(senderInfo["username"]),
-				},
-			}
-
-			if payloadIfc, hasPayload := body["payload"]; hasPayload {
-				p8Message.Payload = payloadIfc
-			}
-
-			// validation for certain types of messages
-			switch msgType {
-			case MTReply:
-				if retcodeIfc, retcodePresent := body["retcode"]; !retcodePresent {
-					Log.Error("Message is missing a required element:\n\tretcode: %v", retcodePresent)
-					continue amqpLoop
-				} else {
-					p8Message.RetCode = ConvertToMsgCode(retcodeIfc)
-				}
-				if retmsgIfc, retmsgPresent := body["return_msg"]; !retmsgPresent {
-					Log.Warning("Message is missing a required element:\n\treturn_msg: %v", retmsgPresent)
-					//continue amqpLoop
-				} else {
-					p8Message.RetMsg = ConvertToString(retmsgIfc)
-				}
-			case MTRequest:
+			handle(busMessageFromDelivery(message))
+		} // end select block
+	} // end for loop
+}
 
-				if msgopIfc, msgopPresent := body["msgop"]; !msgopPresent {
-					Log.Error("Request message is missing a required element:\n\tmsgop: %v", msgopPresent)
-					continue amqpLoop
-				} else {
-					p8Message.MsgOp = ConvertToMsgCode(msgopIfc)
-				}
-			case MTAlert:
-				Log.Error("Cannot handle Alert messages")
-			case MTInfo:
-				Log.Error("Cannot handle Info messages")
-			default:
-				Log.Error("Unknown message type: %v", msgType)
-			}
+// busMessageFromDelivery gives the bus form of a received AMQP message
+func busMessageFromDelivery(delivery amqp.Delivery) BusMessage {
+	return BusMessage{
+		RoutingKey:      delivery.RoutingKey,
+		ContentEncoding: delivery.ContentEncoding,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		Body:            delivery.Body,
+	}
+}
 
-			routingKeyParts := strings.Split(message.RoutingKey, TargetSeparator)
-			if len(routingKeyParts) > 1 {
-				p8Message.Target = routingKeyParts[1:len(routingKeyParts)]
+// handleReceivedMessage decodes a message received by the bus, and handles it according to its type and routing key.
+// Requests are handled if they're addressed to hornet's queue; alerts and info messages can trigger the actions of subscriptions.
+func handleReceivedMessage(message BusMessage, queueName string, subscriptions []amqpSubscription, reqQueue chan ControlMessage) {
+	p8Message, decodeErr := decodeP8Message(message)
+	if decodeErr != nil {
+		Log.Error(decodeErr.Error())
+		// invalid requests get a reply with the error (there's no reply to invalid replies, alerts or info messages)
+		if messageErr, isMessageErr := decodeErr.(MessageError); isMessageErr && (p8Message.MsgType == MTRequest || p8Message.MsgType == 0) {
+			if p8Message.Encoding != "application/msgpack" {
+				p8Message.Encoding = "application/json"
 			}
+			SendReply(p8Message, messageErr.RetCode, messageErr.Msg, nil)
+		}
+		return
+	}
 
-			//log.Printf("[amqp receiver] Message:\n\t%v", p8Message)
+	//log.Printf("[amqp receiver] Message:\n\t%v", p8Message)
 
-			// Handle with the message according to the message type
-			switch msgType {
-			case MTReply:
-				Log.Info("Received reply message: (%d) %s", p8Message.RetCode, p8Message.RetMsg)
-				if replyHandlerChan, canReply := replyMap[message.CorrelationId]; canReply {
-					replyHandlerChan <- p8Message
+	// Handle with the message according to the message type
+	switch p8Message.MsgType {
+	case MTReply:
+		Log.Infof("Received reply message: (%d) %s", p8Message.RetCode, p8Message.RetMsg)
+		replies.Deliver(message.CorrelationId, p8Message)
+	case MTAlert, MTInfo:
+		Log.Debugf("Received alert or info message (type %d) with routing key <%s>", p8Message.MsgType, message.RoutingKey)
+		handleSubscribedMessage(subscriptions, message.RoutingKey, p8Message)
+	case MTRequest:
+		// Handle with the request message according to the target
+		if message.RoutingKey != queueName && !strings.HasPrefix(message.RoutingKey, queueName+TargetSeparator) {
+			// received through a subscription binding; the request is meant for another service
+			Log.Debugf("Ignoring request message for <%s>", message.RoutingKey)
+		} else if len(p8Message.Target) == 0 {
+			Log.Error("No Hornet target provided")
+			SendReply(p8Message, RCErrInvalidKey, "No hornet target provided", nil)
+		} else if checkControlRequestOp(p8Message) {
+			switch p8Message.Target[0] {
+			case "quit-hornet":
+				reqQueue <- StopExecution
+			case "watcher":
+				handleWatcherRequest(p8Message)
+			case "runs":
+				handleRunsRequest(p8Message)
+			case "shipper":
+				handleShipperRequest(p8Message)
+			case "status":
+				handleStatusRequest(p8Message)
+			case "files":
+				handleFilesRequest(p8Message)
+			case "schedule":
+				handleScheduleRequest(p8Message)
+			case "pause":
+				handleStageRequest(p8Message, true)
+			case "resume":
+				handleStageRequest(p8Message, false)
+			case "config":
+				handleConfigRequest(p8Message)
+			case "print-message":
+				Log.Notice("Message received for printing:")
+				Log.Notice("\tEncoding: %v", p8Message.Encoding)
+				Log.Notice("\tCorrelation ID: %v", p8Message.CorrId)
+				Log.Notice("\tMessage Type: %v", p8Message.MsgType)
+				Log.Notice("\tTimestamp: %v", p8Message.TimeStamp)
+				Log.Notice("\tSenderInfo:")
+				Log.Notice("\t\tPackage: %v", p8Message.SenderInfo.Package)
+				Log.Notice("\t\tExe: %v", p8Message.SenderInfo.Exe)
+				Log.Notice("\t\tVersion: %v", p8Message.SenderInfo.Version)
+				Log.Notice("\t\tCommit: %v", p8Message.SenderInfo.Commit)
+				Log.Notice("\t\tHostname: %v", p8Message.SenderInfo.Hostname)
+				Log.Notice("\t\tUsername: %v", p8Message.SenderInfo.Username)
+				if p8Message.Specifier != "" {
+					Log.Notice("\tSpecifier: %v", p8Message.Specifier)
 				}
-			case MTRequest:
-				// Handle with the request message according to the target
-				if len(p8Message.Target) == 0 {
-					Log.Error("No Hornet target provided")
-				} else {
-					switch p8Message.Target[0] {
-					case "quit-hornet":
-						reqQueue <- StopExecution
-					case "print-message":
-						Log.Notice("Message received for printing:")
-						Log.Notice("\tEncoding: %v", p8Message.Encoding)
-						Log.Notice("\tCorrelation ID: %v", p8Message.CorrId)
-						Log.Notice("\tMessage Type: %v", p8Message.MsgType)
-						Log.Notice("\tTimestamp: %v", p8Message.TimeStamp)
-						Log.Notice("\tSenderInfo:")
-						Log.Notice("\t\tPackage: %v", p8Message.SenderInfo.Package)
-						Log.Notice("\t\tExe: %v", p8Message.SenderInfo.Exe)
-						Log.Notice("\t\tVersion: %v", p8Message.SenderInfo.Version)
-						Log.Notice("\t\tCommit: %v", p8Message.SenderInfo.Commit)
-						Log.Notice("\t\tHostname: %v", p8Message.SenderInfo.Hostname)
-						Log.Notice("\t\tUsername: %v", p8Message.SenderInfo.Username)
-						Log.Notice("\tPayload:")
-						switch typedPayload := p8Message.Payload.(type) {
-						case string:
-							Log.Notice("\t\t%s", typedPayload)
-						case map[interface{}]interface{}:
-							for key, value := range p8Message.Payload.(map[interface{}]interface{}) {
-								switch typedValue := value.(type) {
-								case []byte:
-									Log.Notice("\t\t%s (byte sl): %v", key.(string), string(typedValue))
-								case [][]byte:
-									//log.Printf("\t\t%s (byte sl sl): %v", key.(string), [][]string(typedValue))
-									sliceString := "["
-									for _, byteSlice := range typedValue {
-										_ = fmt.Sprintf(sliceString, "%s, %s", sliceString, string(byteSlice))
-									}
-									_ = fmt.Sprintf(sliceString, "%s]", sliceString)
-									Log.Notice("\t\t%s (byte sl sl): %s", key.(string), sliceString)
-								case rune, bool, int, uint, float32, float64, complex64, complex128, string:
-									Log.Notice("\t\t%s (type): %v", key.(string), typedValue)
-								case []rune, []bool, []int, []uint, []float32, []float64, []complex64, []complex128, []string:
-									Log.Notice("\t\t%s (array): %v", key.(string), typedValue)
-								default:
-									Log.Notice("\t\t%s (default): %v", key.(string), value)
-								}
-							}
-						default:
-							Log.Warning("Unknown payload type")
-						}
-					default:
-						Log.Error("Unknown hornet target for request messages: %v", p8Message.Target)
+				Log.Notice("\tPayload:")
+				switch typedPayload := p8Message.Payload.(type) {
+				case nil:
+				case map[string]interface{}:
+					keys := make([]string, 0, len(typedPayload))
+					for key := range typedPayload {
+						keys = append(keys, key)
 					}
+					sort.Strings(keys)
+					for _, key := range keys {
+						Log.Notice("\t\t%s: %v", key, typedPayload[key])
+					}
+				default:
+					Log.Notice("\t\t%v", typedPayload)
 				}
+			default:
+				Log.Errorf("Unknown hornet target for request messages: %v", p8Message.Target)
+				SendReply(p8Message, RCErrInvalidKey, "Unknown hornet target: "+p8Message.Target[0], nil)
 			}
-		} // end select block
-	} // end for loop
+		}
+	}
 }
 
-// AmqpSender is a goroutine responsible for sending AMQP messages received on a channel
-func AmqpSender(ctrlQueue chan ControlMessage, reqQueue chan ControlMessage, poolCount *sync.WaitGroup) {
-	// decrement the wg counter at the end
-	defer poolCount.Done()
-	defer Log.Info("AMQP sender is finished.")
-
-	// Connect to the AMQP broker
-	// Deferred command: close the connection
-	brokerAddress := viper.GetString("amqp.broker")
-	if viper.GetBool("amqp.use-auth") {
-		if Authenticators.Amqp.Available == false {
-			Log.Critical("AMQP authentication is not available")
-			reqQueue <- StopExecution
+// setUpReceiverQueue creates the exchange (if it doesn't already exist) and the receiver's queue,
+// binds the queue to the given routing-key patterns (first of all, those that start with the queue name), and starts consuming messages
+func setUpReceiverQueue(connection *amqp.Connection, exchangeName, queueName string, bindings []string) (channel *amqp.Channel, messageQueue <-chan amqp.Delivery, e error) {
+	// Create the channel object that represents the connection to the broker
+	channel, chanErr := connection.Channel()
+	if chanErr != nil {
+		e = fmt.Errorf("Unable to get the AMQP channel:\n\t%v", chanErr.Error())
+		return
+	}
+
+	// Create the exchange if it doesn't already exist
+	if exchDeclErr := channel.ExchangeDeclare(exchangeName, "topic", false, false, false, false, nil); exchDeclErr != nil {
+		e = fmt.Errorf("Unable to declare exchange <%s>:\n\t%v", exchangeName, exchDeclErr.Error())
+		return
+	}
+
+	// Declare the "hornet" queue
+	if _, queueDeclErr := channel.QueueDeclare(queueName, false, true, true, false, nil); queueDeclErr != nil {
+		e = fmt.Errorf("Unable to declare queue <%s>:\n\t%v", queueName, queueDeclErr.Error())
+		return
+	}
+
+	// Bind the "hornet" queue to the exchange, and subscribe it to all routing keys that start with "hornet" (and those of any subscriptions)
+	for _, binding := range bindings {
+		if queueBindErr := channel.QueueBind(queueName, binding, exchangeName, false, nil); queueBindErr != nil {
+			e = fmt.Errorf("Unable to bind queue <%s> to exchange <%s> with <%s>:\n\t%v", queueName, exchangeName, binding, queueBindErr.Error())
 			return
 		}
-		brokerAddress = Authenticators.Amqp.Username + ":" + Authenticators.Amqp.Password + "@" + brokerAddress
 	}
-	brokerAddress = "amqp://" + brokerAddress
-	if viper.IsSet("amqp.port") {
-		brokerAddress = brokerAddress + ":" + viper.GetString("amqp.port")
+
+	// Start consuming messages on the queue
+	// Channel::Cancel is not needed, because consuming will be stopped by Channel.Close
+	var consumeErr error
+	if messageQueue, consumeErr = channel.Consume(queueName, "", false, true, true, false, nil); consumeErr != nil {
+		e = fmt.Errorf("Unable start consuming from queue <%s>:\n\t%v", queueName, consumeErr.Error())
+	}
+	return
+}
+
+// encodeP8Message translates a P8Message object into a map and encodes it for transmission
+func encodeP8Message(p8Message P8Message) (messageBody []byte, e error) {
+	var senderInfo = map[string]interface{}{
+		"package":  p8Message.SenderInfo.Package,
+		"exe":      p8Message.SenderInfo.Exe,
+		"version":  p8Message.SenderInfo.Version,
+		"commit":   p8Message.SenderInfo.Commit,
+		"hostname": p8Message.SenderInfo.Hostname,
+		"username": p8Message.SenderInfo.Username,
+	}
+	var body = map[string]interface{}{
+		"msgtype":     p8Message.MsgType,
+		"msgop":       p8Message.MsgOp,
+		"retcode":     p8Message.RetCode,
+		"return_msg":  p8Message.RetMsg,
+		"timestamp":   p8Message.TimeStamp,
+		"sender_info": senderInfo,
+		"payload":     p8Message.Payload,
+	}
+	if p8Message.Specifier != "" {
+		body["specifier"] = p8Message.Specifier
+	}
+	if p8Message.LockoutKey != "" {
+		body["lockout_key"] = p8Message.LockoutKey
+	}
+
+	//log.Printf("[amqp sender] Received message to send:\n\t%v", body)
+	messageBody = make([]byte, 0, unsafe.Sizeof(p8Message))
+
+	switch p8Message.Encoding {
+	case "application/json":
+		//log.Printf("this will be a json message")
+		handle := new(codec.JsonHandle)
+		encoder := codec.NewEncoderBytes(&messageBody, handle)
+		if jsonErr := encoder.Encode(&body); jsonErr != nil {
+			e = fmt.Errorf("Unable to encode JSON message:\n\t%v", jsonErr)
+		}
+	case "application/msgpack":
+		//log.Printf("this will be a msgpack message")
+		handle := new(codec.MsgpackHandle)
+		encoder := codec.NewEncoderBytes(&messageBody, handle)
+		if msgpackErr := encoder.Encode(&body); msgpackErr != nil {
+			e = fmt.Errorf("Unable to encode msgpack message:\n\t%v", msgpackErr)
+		}
+	default:
+		e = fmt.Errorf("Message content cannot be encoded with type <%s>", p8Message.Encoding)
+	}
+	return
+}
+
+// RunSender sends the outgoing messages to the AMQP broker.
+// If the connection to the broker is lost, messages are buffered (see amqp_reconnect.go) until the sender reconnects.
+// Unless disabled, the broker confirms each message (see amqp_confirms.go); unconfirmed messages are sent again after reconnecting.
+func (b *amqpBus) RunSender(outgoing <-chan P8Message, ctrlQueue, reqQueue chan ControlMessage) {
+	connector, exchangeName := b.connector, b.exchangeName
+
+	// outgoing messages are buffered while the sender is disconnected
+	bufferSize := 1000
+	if viper.IsSet("amqp.buffer-size") {
+		bufferSize = viper.GetInt("amqp.buffer-size")
 	}
-	connection, receiveErr := amqp.Dial(brokerAddress)
-	if receiveErr != nil {
-		Log.Critical("Unable to connect to the AMQP broker at (%s) for receiving:\n\t%v", brokerAddress, receiveErr.Error())
+	outbox, outboxErr := newAmqpOutbox(bufferSize, viper.GetString("amqp.spill-dir"))
+	if outboxErr != nil {
+		Log.Critical(outboxErr.Error())
 		reqQueue <- StopExecution
 		return
 	}
-	defer connection.Close()
 
-	// Create the channel object that represents the connection to the broker
-	// Deferred command: close the channel
-	channel, chanErr := connection.Channel()
-	if chanErr != nil {
-		Log.Critical("Unable to get the AMQP channel:\n\t%v", chanErr.Error())
+	// delivery guarantees: confirm mode and the mandatory flag are on by default
+	confirmMode := true
+	if viper.IsSet("amqp.confirm") {
+		confirmMode = viper.GetBool("amqp.confirm")
+	}
+	mandatory := true
+	if viper.IsSet("amqp.mandatory") {
+		mandatory = viper.GetBool("amqp.mandatory")
+	}
+	persistent := viper.GetBool("amqp.persistent")
+	tracker := newAmqpConfirmTracker()
+
+	// Connect to the AMQP broker; this is repeated if the connection is lost
+	// Deferred command: close the channel and connection
+	var connection *amqp.Connection
+	var channel *amqp.Channel
+	var connectionClosed chan *amqp.Error
+	var confirms chan amqp.Confirmation
+	var returns chan amqp.Return
+	connect := func() (e error) {
+		var chanErr error
+		if connection, e = connector.Dial("sender"); e != nil {
+			return
+		}
+		// Create the channel object that represents the connection to the broker
+		if channel, chanErr = connection.Channel(); chanErr != nil {
+			e = fmt.Errorf("Unable to get the AMQP channel:\n\t%v", chanErr.Error())
+			connection.Close()
+			connection = nil
+			return
+		}
+		if confirmMode {
+			if confirmErr := channel.Confirm(false); confirmErr != nil {
+				e = fmt.Errorf("Unable to put the AMQP channel in confirm mode:\n\t%v", confirmErr.Error())
+				channel.Close()
+				connection.Close()
+				connection, channel = nil, nil
+				return
+			}
+			confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 100))
+		}
+		returns = channel.NotifyReturn(make(chan amqp.Return, 100))
+		connectionClosed = connection.NotifyClose(make(chan *amqp.Error, 1))
+		return
+	}
+	disconnect := func() {
+		if channel != nil {
+			channel.Close()
+		}
+		if connection != nil {
+			connection.Close()
+		}
+		connection, channel, connectionClosed = nil, nil, nil
+		confirms, returns = nil, nil
+	}
+
+	if connErr := connect(); connErr != nil {
+		Log.Critical(connErr.Error())
 		reqQueue <- StopExecution
 		return
 	}
-	defer channel.Close()
+	defer disconnect()
 
-	exchangeName := viper.GetString("amqp.exchange")
+	// without confirm mode, returned messages can only be logged
+	handleReturn := func(returned amqp.Return) {
+		if confirmMode {
+			tracker.Returned(returned)
+			return
+		}
+		Log.Errorf("AMQP message to <%s> was returned by the broker: (%d) %s", returned.RoutingKey, returned.ReplyCode, returned.ReplyText)
+	}
+	drainReturns := func() {
+		for {
+			select {
+			case returned, queueOk := <-returns:
+				if !queueOk {
+					returns = nil
+					return
+				}
+				handleReturn(returned)
+			default:
+				return
+			}
+		}
+	}
+	// the broker returns a message before confirming it, so returns are handled first
+	confirmed := func(confirmation amqp.Confirmation) {
+		drainReturns()
+		tracker.Confirmed(confirmation)
+	}
+	drainConfirms := func() {
+		drainReturns()
+		for {
+			select {
+			case confirmation, queueOk := <-confirms:
+				if !queueOk {
+					confirms = nil
+					return
+				}
+				confirmed(confirmation)
+			default:
+				return
+			}
+		}
+	}
 
-	replyTo := viper.GetString("amqp.queue")
+	publish := func(message BusMessage) error {
+		Log.Debugf("Sending message to routing key <%s>", message.RoutingKey)
+		if pubErr := channel.Publish(exchangeName, message.RoutingKey, mandatory && !message.AllowUnroutable, false, message.amqpPublishing()); pubErr != nil {
+			return pubErr
+		}
+		if !confirmMode {
+			reportDelivery(message, RCSuccess, "The message was sent (without confirmation)")
+			return nil
+		}
+		tracker.Published(message)
+		drainConfirms()
+		return nil
+	}
+
+	// while disconnected, the sender tries to reconnect when the timer fires
+	backoff := newAmqpBackoff()
+	var reconnectTimer <-chan time.Time
+	connectionLost := func(reason interface{}) {
+		Log.Errorf("AMQP sender lost its connection to the broker: %v", reason)
+		// messages that weren't confirmed are sent again once reconnected
+		drainConfirms()
+		if unconfirmed := tracker.Reset(); len(unconfirmed) > 0 {
+			Log.Warningf("%d AMQP message(s) were not confirmed by the broker, and will be sent again", len(unconfirmed))
+			outbox.Requeue(unconfirmed)
+		}
+		disconnect()
+		delay := backoff.Next()
+		Log.Infof("AMQP sender will reconnect in %v; outgoing messages will be buffered", delay)
+		reconnectTimer = time.After(delay)
+	}
+	flushOutbox := func() {
+		if outbox.Len() == 0 {
+			return
+		}
+		Log.Infof("Sending %d buffered AMQP message(s)", outbox.Len())
+		if flushErr := outbox.Flush(publish); flushErr != nil {
+			connectionLost(flushErr)
+		}
+	}
+
+	// when stopping, outstanding confirmations are given a few seconds to arrive
+	waitForConfirms := func() {
+		timeout := time.After(5 * time.Second)
+		for tracker.Len() > 0 && confirms != nil {
+			select {
+			case confirmation, queueOk := <-confirms:
+				if !queueOk {
+					confirms = nil
+					continue
+				}
+				confirmed(confirmation)
+			case <-timeout:
+				Log.Warningf("%d AMQP message(s) were not confirmed by the broker", tracker.Len())
+				return
+			}
+		}
+	}
 
 	Log.Info("AMQP sender started successfully")
-	AmqpSenderIsActive = true
-	defer func() { AmqpSenderIsActive = false }()
+	AmqpSenderIsActive.Store(true)
+	defer func() { AmqpSenderIsActive.Store(false) }()
+
+	// messages buffered by an earlier run are sent first
+	flushOutbox()
 
 amqpLoop:
 	for {
@@ -485,96 +730,302 @@ amqpLoop:
 			}
 			if controlMsg == StopExecution {
 				Log.Info("AMQP sender stopping on interrupt.")
+				waitForConfirms()
+				if outbox.Len() > 0 {
+					Log.Warningf("%d buffered AMQP message(s) were not sent", outbox.Len())
+				}
 				break amqpLoop
 			}
+		case amqpErr := <-connectionClosed:
+			connectionLost(amqpErr)
+		case returned, queueOk := <-returns:
+			if !queueOk {
+				returns = nil
+				continue amqpLoop
+			}
+			handleReturn(returned)
+		case confirmation, queueOk := <-confirms:
+			if !queueOk {
+				confirms = nil
+				continue amqpLoop
+			}
+			confirmed(confirmation)
+		case <-reconnectTimer:
+			reconnectTimer = nil
+			if connErr := connect(); connErr != nil {
+				delay := backoff.Next()
+				Log.Warningf("%s\n\tRetrying in %v", connErr.Error(), delay)
+				reconnectTimer = time.After(delay)
+				continue amqpLoop
+			}
+			backoff.Reset()
+			Log.Notice("AMQP sender has reconnected to the broker")
+			flushOutbox()
 		// process any message reuqests received on the send-messsage queue
-		case p8Message, queueOk := <-SendMessageQueue:
+		case p8Message, queueOk := <-outgoing:
 			if !queueOk {
 				Log.Error("Send-message queue has closed")
 				reqQueue <- StopExecution
 				break amqpLoop
 			}
 
-			// Translate the request into a map that can be encoded for transmission
-			var senderInfo = map[string]interface{}{
-				"package":  p8Message.SenderInfo.Package,
-				"exe":      p8Message.SenderInfo.Exe,
-				"version":  p8Message.SenderInfo.Version,
-				"commit":   p8Message.SenderInfo.Commit,
-				"hostname": p8Message.SenderInfo.Hostname,
-				"username": p8Message.SenderInfo.Username,
-			}
-			var body = map[string]interface{}{
-				"msgtype":     p8Message.MsgType,
-				"msgop":       p8Message.MsgOp,
-				"retcode":     p8Message.RetCode,
-				"return_msg":  p8Message.RetMsg,
-				"timestamp":   p8Message.TimeStamp,
-				"sender_info": senderInfo,
-				"payload":     p8Message.Payload,
-			}
-
-			// Get the UUID for the correlation ID
-			correlationId := p8Message.CorrId
-			if p8Message.CorrId == "" {
-				correlationId = uuid.New()
-			}
-
-			// if a reply is requested (as indicated by a non-nil reply channel), add the channel to the reply map
-			if p8Message.ReplyChan != nil {
-				replyMap[correlationId] = p8Message.ReplyChan
+			message, prepErr := prepareBusMessage(p8Message)
+			if prepErr != nil {
+				Log.Error(prepErr.Error())
+				continue amqpLoop
 			}
+			message.Persistent = persistent
 
-			//log.Printf("[amqp sender] Received message to send:\n\t%v", body)
-			bodyNBytes := unsafe.Sizeof(p8Message)
-			//log.Printf("[amqp sender] Message size in bytes: %d", bodyNBytes)
-
-			var message = amqp.Publishing{
-				ContentEncoding: p8Message.Encoding,
-				Body:            make([]byte, 0, bodyNBytes),
-				ReplyTo:         replyTo,
-				CorrelationId:   correlationId,
-			}
-			// Encode the message body for transmission
-			switch p8Message.Encoding {
-			case "application/json":
-				//log.Printf("this will be a json message")
-				handle := new(codec.JsonHandle)
-				encoder := codec.NewEncoderBytes(&(message.Body), handle)
-				jsonErr := encoder.Encode(&body)
-				if jsonErr != nil {
-					Log.Error("Unable to decode JSON-encoded message:\n\t%v", jsonErr)
-					continue amqpLoop
-				}
-			case "application/msgpack":
-				//log.Printf("this will be a msgpack message")
-				handle := new(codec.MsgpackHandle)
-				encoder := codec.NewEncoderBytes(&(message.Body), handle)
-				msgpackErr := encoder.Encode(&body)
-				if msgpackErr != nil {
-					Log.Error("Unable to decode msgpack-encoded message:\n\t%v", msgpackErr)
-					continue amqpLoop
+			// messages are buffered while disconnected, or while there are older messages still to be sent
+			if channel == nil || outbox.Len() > 0 {
+				if bufErr := outbox.Add(message); bufErr != nil {
+					Log.Errorf("Unable to buffer the message to <%s>; it will not be sent:\n\t%v", message.RoutingKey, bufErr)
+					reportDelivery(message, RCErrAmqpConnection, "The message could not be sent or buffered: "+bufErr.Error())
 				}
-			default:
-				Log.Error("Message content cannot be encoded with type <%s>", p8Message.Encoding)
 				continue amqpLoop
 			}
 
-			routingKey := strings.Join(p8Message.Target, TargetSeparator)
-
-			//log.Printf("[amqp sender] Encoded message:\n\t%v", message)
-			Log.Debug("Sending message to routing key <%s>", routingKey)
-
 			// Publish!
-			pubErr := channel.Publish(exchangeName, routingKey, false, false, message)
-			if pubErr != nil {
+			if pubErr := publish(message); pubErr != nil {
 				Log.Error("Error while sending message:\n\t%v", pubErr)
+				if bufErr := outbox.Add(message); bufErr != nil {
+					Log.Errorf("Unable to buffer the message to <%s>; it will not be sent:\n\t%v", message.RoutingKey, bufErr)
+					reportDelivery(message, RCErrAmqpConnection, "The message could not be sent or buffered: "+bufErr.Error())
+				}
+				connectionLost(pubErr)
 			}
 
 		} // end select block
 	} // end for loop
 }
 
+// handleWatcherRequest handles request messages with the "watcher" target, which inspect or modify
+// the set of watched directories while hornet is running:
+//   watcher.add-dir: start watching the directories given in the payload "values"
+//   watcher.remove-dir: stop watching the directories given in the payload "values"
+//   watcher.list: no payload is needed
+// The directories are all added or removed, or, if any of them can't be, none are.
+// The reply payload includes the resulting list of watch directories.
+func handleWatcherRequest(request P8Message) {
+	if len(request.Target) < 2 {
+		Log.Error("No watcher command provided")
+		SendReply(request, RCErrInvalidKey, "No watcher command provided", nil)
+		return
+	}
+
+	var command WatcherCommandType
+	switch request.Target[1] {
+	case "add-dir":
+		command = WatcherAddDir
+	case "remove-dir":
+		command = WatcherRemoveDir
+	case "list":
+		command = WatcherListDirs
+	default:
+		Log.Errorf("Unknown watcher command: %s", request.Target[1])
+		SendReply(request, RCErrInvalidKey, "Unknown watcher command: "+request.Target[1], nil)
+		return
+	}
+
+	var dirs []string
+	if command != WatcherListDirs {
+		valuesIfc, _ := GetPayloadValue(request.Payload, "values")
+		if dirs = ConvertToStringSlice(valuesIfc); len(dirs) == 0 {
+			Log.Errorf("No directories provided for watcher command <%s>", request.Target[1])
+			SendReply(request, RCErrBadPayload, "No directories provided in the payload values", nil)
+			return
+		}
+	}
+
+	// the receiver doesn't wait for the watcher, which may take a while to add a large directory tree
+	go func() {
+		watchDirs, cmdErr := ModifyWatchDirs(command, dirs)
+		if cmdErr != nil {
+			Log.Errorf("Unable to execute watcher command <%s>: %v", request.Target[1], cmdErr)
+			SendReply(request, RCErrInvalidValue, cmdErr.Error(), map[string]interface{}{"dirs": watchDirs})
+			return
+		}
+		Log.Infof("Watch directories: %v", watchDirs)
+		SendReply(request, RCSuccess, "", map[string]interface{}{"dirs": watchDirs})
+	}()
+}
+
+// handleRunsRequest handles request messages with the "runs" target:
+//   runs.stop: the runs identified by the payload "values" (values of the grouping key) are ended
+func handleRunsRequest(request P8Message) {
+	if len(request.Target) < 2 || request.Target[1] != "stop" {
+		Log.Errorf("Unknown runs command: %v", request.Target)
+		SendReply(request, RCErrInvalidKey, "Unknown runs command", nil)
+		return
+	}
+	if !RunTrackerIsActive.Load() {
+		Log.Error("Run-stop request received, but the run tracker is not active")
+		SendReply(request, RCErrInvalidValue, "The run tracker is not active", nil)
+		return
+	}
+	valuesIfc, _ := GetPayloadValue(request.Payload, "values")
+	runIds := ConvertToStringSlice(valuesIfc)
+	if len(runIds) == 0 {
+		Log.Error("No runs provided for the run-stop request")
+		SendReply(request, RCErrBadPayload, "No runs provided in the payload values", nil)
+		return
+	}
+	// the receiver doesn't wait for the run tracker
+	go stopRuns(request, runIds)
+}
+
+// stopRuns submits the run-stop requests to the run tracker, and replies once it has handled them.
+// Runs that aren't being tracked are stopped once their files arrive, but the requester is told.
+func stopRuns(request P8Message, runIds []string) {
+	var notTracked []string
+	for _, runId := range runIds {
+		replyChan := make(chan error, 1)
+		select {
+		case RunStopQueue <- RunStopRequest{ID: runId, ReplyChan: replyChan}:
+		case <-time.After(requestTimeout()):
+			Log.Errorf("The run tracker did not accept the run-stop request for <%s>", runId)
+			SendReply(request, RCErrTimeout, "The run tracker did not accept the run-stop request for: "+runId, nil)
+			return
+		}
+		select {
+		case stopErr := <-replyChan:
+			if stopErr != nil {
+				notTracked = append(notTracked, runId)
+			}
+		case <-time.After(requestTimeout()):
+			notTracked = append(notTracked, runId)
+		}
+	}
+	if len(notTracked) > 0 {
+		SendReply(request, RCErrInvalidValue, "No run is being tracked for: "+strings.Join(notTracked, ", ")+" (the stop will apply if the run's files arrive)", map[string]interface{}{"not_tracked": notTracked})
+		return
+	}
+	SendReply(request, RCSuccess, "", nil)
+}
+
+// handleShipperRequest handles request messages with the "shipper" target:
+//   shipper.pause: files are held in the queue for the shippers until shipping is resumed
+//   shipper.resume: shipping continues (within the transfer windows, if there are any)
+//   shipper.status: no payload is needed
+// The reply payload includes whether shipping is paused.
+func handleShipperRequest(request P8Message) {
+	if len(request.Target) < 2 {
+		Log.Error("No shipper command provided")
+		SendReply(request, RCErrInvalidKey, "No shipper command provided", nil)
+		return
+	}
+
+	switch request.Target[1] {
+	case "pause":
+		SetShippingPaused(true)
+	case "resume":
+		SetShippingPaused(false)
+	case "status":
+	default:
+		Log.Errorf("Unknown shipper command: %s", request.Target[1])
+		SendReply(request, RCErrInvalidKey, "Unknown shipper command: "+request.Target[1], nil)
+		return
+	}
+	SendReply(request, RCSuccess, "", map[string]interface{}{"paused": ShippingIsPaused()})
+}
+
+// SendReply sends a reply to a request message, if the request asked for one (i.e. it has a reply-to routing key).
+func SendReply(request P8Message, retCode MsgCodeT, retMsg string, payload interface{}) {
+	if request.ReplyTo == "" || !AmqpSenderIsActive.Load() {
+		return
+	}
+	reply := PrepareReply([]string{request.ReplyTo}, request.Encoding, request.CorrId, retCode, retMsg, nil)
+	reply.Payload = payload
+	SendMessageQueue <- reply
+}
+
+// SendRemoteRequest sends a request to a running hornet instance (or any other service listening on the broker)
+// and waits for the reply.  It opens its own connection to the broker, so it can be used without starting
+// the AMQP sender and receiver routines, e.g. from the command line.
+func SendRemoteRequest(target []string, msgOp MsgCodeT, payload interface{}, timeout time.Duration) (reply P8Message, e error) {
+	if MasterSenderInfo.Package == "" {
+		fillMasterSenderInfo()
+	}
+
+	connector, connectorErr := newAmqpConnector()
+	if connectorErr != nil {
+		e = connectorErr
+		return
+	}
+	connection, dialErr := connector.Dial("remote request")
+	if dialErr != nil {
+		e = dialErr
+		return
+	}
+	defer connection.Close()
+
+	channel, chanErr := connection.Channel()
+	if chanErr != nil {
+		e = fmt.Errorf("Unable to get the AMQP channel:\n\t%v", chanErr)
+		return
+	}
+	defer channel.Close()
+
+	// Declare an exclusive queue for the reply, bound to the exchange with its own name as the routing key
+	exchangeName := viper.GetString("amqp.exchange")
+	if exchDeclErr := channel.ExchangeDeclare(exchangeName, "topic", false, false, false, false, nil); exchDeclErr != nil {
+		e = fmt.Errorf("Unable to declare exchange <%s>:\n\t%v", exchangeName, exchDeclErr)
+		return
+	}
+	replyQueue, queueDeclErr := channel.QueueDeclare("", false, true, true, false, nil)
+	if queueDeclErr != nil {
+		e = fmt.Errorf("Unable to declare the reply queue:\n\t%v", queueDeclErr)
+		return
+	}
+	if queueBindErr := channel.QueueBind(replyQueue.Name, replyQueue.Name, exchangeName, false, nil); queueBindErr != nil {
+		e = fmt.Errorf("Unable to bind the reply queue:\n\t%v", queueBindErr)
+		return
+	}
+	messageQueue, consumeErr := channel.Consume(replyQueue.Name, "", true, true, false, false, nil)
+	if consumeErr != nil {
+		e = fmt.Errorf("Unable to start consuming from the reply queue:\n\t%v", consumeErr)
+		return
+	}
+
+	request := PrepareRequest(target, "application/json", msgOp, nil)
+	request.Payload = payload
+	messageBody, encodeErr := encodeP8Message(request)
+	if encodeErr != nil {
+		e = encodeErr
+		return
+	}
+	correlationId := uuid.New()
+	message := amqp.Publishing{
+		ContentEncoding: request.Encoding,
+		Body:            messageBody,
+		ReplyTo:         replyQueue.Name,
+		CorrelationId:   correlationId,
+	}
+	if pubErr := channel.Publish(exchangeName, strings.Join(target, TargetSeparator), false, false, message); pubErr != nil {
+		e = fmt.Errorf("Error while sending message:\n\t%v", pubErr)
+		return
+	}
+
+	timeoutChan := time.After(timeout)
+	for {
+		select {
+		case delivery, queueOk := <-messageQueue:
+			if !queueOk {
+				e = errors.New("The reply queue closed unexpectedly")
+				return
+			}
+			if delivery.CorrelationId != correlationId {
+				continue
+			}
+			// the routing key is the reply queue name, which doesn't include a target
+			return decodeP8Message(busMessageFromDelivery(delivery))
+		case <-timeoutChan:
+			e = fmt.Errorf("Timed out after %v waiting for a reply", timeout)
+			return
+		}
+	}
+}
+
 // PrepareRequest sets up most of the fields in a P8Message request object.
 // The payload is not set here.
 func PrepareRequest(target []string, encoding string, msgOp MsgCodeT, replyChan chan P8Message) (p8Message P8Message) {
@@ -590,6 +1041,19 @@ func PrepareRequest(target []string, encoding string, msgOp MsgCodeT, replyChan
 	return
 }
 
+// PrepareAlert sets up most of the fields in a P8Message alert object.
+// The payload is not set here.
+func PrepareAlert(target []string, encoding string) (p8Message P8Message) {
+	p8Message = P8Message{
+		Target:     target,
+		Encoding:   encoding,
+		MsgType:    MTAlert,
+		TimeStamp:  time.Now().UTC().Format(TimeFormat),
+		SenderInfo: MasterSenderInfo,
+	}
+	return
+}
+
 // PrepareReply sets up most of the fields in a P8Message reply object.
 // The payload is not set here.
 func PrepareReply(target []string, encoding string, corrId string, retCode MsgCodeT, retMsg string, replyChan chan P8Message) (p8Message P8Message) {
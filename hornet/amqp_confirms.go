@@ -0,0 +1,86 @@
+/*
+* amqp_confirms.go
+*
+* delivery guarantees for outgoing AMQP messages.
+*
+* In confirm mode, the broker acknowledges (or rejects) each message that the sender publishes.
+* Messages are published with the mandatory flag, so that the broker returns any message that can't be
+* routed to a queue (e.g. because nothing is bound to its routing key).  The outcome for each message
+* (delivered, returned or nacked) is logged, and is reported to the message's originator if it asked for it.
+ */
+
+package hornet
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// amqpConfirmTracker follows the messages published in confirm mode until the broker acknowledges them.
+// Delivery tags are assigned by the broker in the order of publication, starting at 1 for each channel.
+type amqpConfirmTracker struct {
+	nextTag     uint64
+	unconfirmed map[uint64]BusMessage
+	// returned messages, by correlation ID; the broker acknowledges a message after returning it
+	returned map[string]amqp.Return
+}
+
+func newAmqpConfirmTracker() *amqpConfirmTracker {
+	t := &amqpConfirmTracker{}
+	t.Reset()
+	return t
+}
+
+// Reset is used when the channel is closed; it returns the messages that were not confirmed, in the order in which they were published
+func (t *amqpConfirmTracker) Reset() (unconfirmed []BusMessage) {
+	for tag := uint64(1); tag < t.nextTag; tag++ {
+		if message, isUnconfirmed := t.unconfirmed[tag]; isUnconfirmed {
+			unconfirmed = append(unconfirmed, message)
+		}
+	}
+	t.nextTag = 1
+	t.unconfirmed = make(map[uint64]BusMessage)
+	t.returned = make(map[string]amqp.Return)
+	return
+}
+
+// Len returns the number of messages waiting for confirmation
+func (t *amqpConfirmTracker) Len() int {
+	return len(t.unconfirmed)
+}
+
+// Published records a message that was published
+func (t *amqpConfirmTracker) Published(message BusMessage) {
+	t.unconfirmed[t.nextTag] = message
+	t.nextTag++
+}
+
+// Returned records a message that the broker returned as unroutable
+func (t *amqpConfirmTracker) Returned(returned amqp.Return) {
+	t.returned[returned.CorrelationId] = returned
+}
+
+// Confirmed reports the outcome for the message with the confirmation's delivery tag
+func (t *amqpConfirmTracker) Confirmed(confirmation amqp.Confirmation) {
+	message, isUnconfirmed := t.unconfirmed[confirmation.DeliveryTag]
+	if !isUnconfirmed {
+		Log.Warningf("Received a confirmation for an unknown AMQP message (delivery tag %d)", confirmation.DeliveryTag)
+		return
+	}
+	delete(t.unconfirmed, confirmation.DeliveryTag)
+
+	returned, wasReturned := t.returned[message.CorrelationId]
+	delete(t.returned, message.CorrelationId)
+	switch {
+	case !confirmation.Ack:
+		Log.Errorf("AMQP message to <%s> was rejected (nacked) by the broker", message.RoutingKey)
+		reportDelivery(message, RCErrAmqp, "The message was rejected by the broker")
+	case wasReturned:
+		Log.Errorf("AMQP message to <%s> was returned by the broker: (%d) %s", message.RoutingKey, returned.ReplyCode, returned.ReplyText)
+		reportDelivery(message, RCErrAmqpRoutingKey, fmt.Sprintf("The message was returned by the broker: (%d) %s", returned.ReplyCode, returned.ReplyText))
+	default:
+		Log.Debugf("AMQP message to <%s> was delivered", message.RoutingKey)
+		reportDelivery(message, RCSuccess, "The message was delivered")
+	}
+}
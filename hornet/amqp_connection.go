@@ -0,0 +1,164 @@
+/*
+* amqp_connection.go
+*
+* connections to the AMQP broker.
+*
+* The broker can be given either as a URL (amqp.url), e.g.
+*    "url": "amqps://my.server:5671/my-vhost"
+* or by its parts (amqp.broker, amqp.port and amqp.vhost).  If authentication is in use, the credentials
+* from the authenticators file are added to the URL (escaped as needed), unless the URL already includes them.
+* TLS is used with the amqps scheme, or if amqp.tls is configured; amqp.tls can give the CA certificate,
+* and the certificate and key to present to the broker.
+ */
+
+package hornet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+
+	"github.com/project8/hornet/gogitver"
+)
+
+// amqpConnector opens connections to the broker; the receiver, the sender and remote requests all use it
+type amqpConnector struct {
+	brokerURL url.URL
+	config    amqp.Config
+	name      string
+}
+
+// newAmqpConnector sets up the connections from the amqp configuration
+func newAmqpConnector() (connector *amqpConnector, e error) {
+	connector = &amqpConnector{}
+	if viper.IsSet("amqp.url") {
+		parsedURL, parseErr := url.Parse(viper.GetString("amqp.url"))
+		if parseErr != nil {
+			e = fmt.Errorf("Invalid AMQP URL: %v", parseErr)
+			return
+		}
+		if parsedURL.Scheme != "amqp" && parsedURL.Scheme != "amqps" {
+			e = fmt.Errorf("The AMQP URL scheme must be amqp or amqps, not <%s>", parsedURL.Scheme)
+			return
+		}
+		connector.brokerURL = *parsedURL
+	} else {
+		connector.brokerURL = url.URL{Scheme: "amqp", Host: viper.GetString("amqp.broker")}
+		if viper.IsSet("amqp.port") {
+			connector.brokerURL.Host += ":" + viper.GetString("amqp.port")
+		}
+		if viper.IsSet("amqp.vhost") {
+			// the vhost is the URL path, after the leading slash
+			connector.brokerURL.Path = "/" + viper.GetString("amqp.vhost")
+		}
+	}
+	if connector.brokerURL.Host == "" {
+		e = errors.New("No AMQP broker is given")
+		return
+	}
+
+	// the credentials are escaped when the URL is formatted
+	if viper.GetBool("amqp.use-auth") && connector.brokerURL.User == nil {
+		if Authenticators.Amqp.Available == false {
+			e = errors.New("AMQP authentication is not available")
+			return
+		}
+		connector.brokerURL.User = url.UserPassword(Authenticators.Amqp.Username, Authenticators.Amqp.Password)
+	}
+
+	connector.config.Heartbeat = 10 * time.Second
+	if viper.IsSet("amqp.heartbeat") {
+		connector.config.Heartbeat = viper.GetDuration("amqp.heartbeat")
+	}
+	connector.config.Locale = "en_US"
+
+	if viper.IsSet("amqp.tls") {
+		tlsConfig, tlsErr := amqpTLSConfig()
+		if tlsErr != nil {
+			e = tlsErr
+			return
+		}
+		connector.config.TLSClientConfig = tlsConfig
+		connector.brokerURL.Scheme = "amqps"
+	}
+
+	// the connection name is shown by the broker's management tools
+	connector.name = viper.GetString("amqp.connection-name")
+	if connector.name == "" {
+		hostname, _ := os.Hostname()
+		connector.name = "hornet@" + hostname
+	}
+	return
+}
+
+// amqpTLSConfig reads the TLS settings:
+//   amqp.tls.ca-file: the CA certificate(s) used to verify the broker; by default the system's CAs are used
+//   amqp.tls.cert-file and amqp.tls.key-file: the client certificate and key, if the broker requires them
+//   amqp.tls.server-name: the name expected in the broker's certificate, if it's not the broker's host name
+//   amqp.tls.insecure-skip-verify: don't verify the broker's certificate (for testing only)
+func amqpTLSConfig() (tlsConfig *tls.Config, e error) {
+	tlsConfig = &tls.Config{
+		ServerName:         viper.GetString("amqp.tls.server-name"),
+		InsecureSkipVerify: viper.GetBool("amqp.tls.insecure-skip-verify"),
+	}
+	if caFile := viper.GetString("amqp.tls.ca-file"); caFile != "" {
+		caData, readErr := ioutil.ReadFile(caFile)
+		if readErr != nil {
+			e = fmt.Errorf("Unable to read the AMQP CA file: %v", readErr)
+			return
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			e = fmt.Errorf("No certificates found in the AMQP CA file <%s>", caFile)
+			return
+		}
+	}
+	certFile, keyFile := viper.GetString("amqp.tls.cert-file"), viper.GetString("amqp.tls.key-file")
+	if (certFile == "") != (keyFile == "") {
+		e = errors.New("Both amqp.tls.cert-file and amqp.tls.key-file must be given for a client certificate")
+		return
+	}
+	if certFile != "" {
+		certificate, certErr := tls.LoadX509KeyPair(certFile, keyFile)
+		if certErr != nil {
+			e = fmt.Errorf("Unable to load the AMQP client certificate: %v", certErr)
+			return
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return
+}
+
+// String gives the broker's URL without the password, so that it can be logged
+func (c *amqpConnector) String() string {
+	safeURL := c.brokerURL
+	if safeURL.User != nil {
+		safeURL.User = url.User(safeURL.User.Username())
+	}
+	return safeURL.String()
+}
+
+// Dial opens a connection to the broker; the purpose (e.g. "receiver") is added to the connection name
+func (c *amqpConnector) Dial(purpose string) (connection *amqp.Connection, e error) {
+	config := c.config
+	if c.config.TLSClientConfig != nil {
+		config.TLSClientConfig = c.config.TLSClientConfig.Clone()
+	}
+	config.Properties = amqp.Table{
+		"product":         "hornet",
+		"version":         gogitver.Tag(),
+		"connection_name": c.name + " (" + purpose + ")",
+	}
+	if connection, e = amqp.DialConfig(c.brokerURL.String(), config); e != nil {
+		e = fmt.Errorf("Unable to connect to the AMQP broker at (%s) for %s:\n\t%v", c.String(), purpose, e)
+	}
+	return
+}
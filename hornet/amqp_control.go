@@ -0,0 +1,234 @@
+/*
+* amqp_control.go
+*
+* remote control of a running hornet instance, via request messages sent to hornet's queue:
+*   [queue].status (get): replies with the state of hornet's components and the pipeline
+*   [queue].files (get): replies with the files in the pipeline and the stage that each has reached
+*   [queue].schedule (run): schedules the files given (as absolute paths) in the payload "values"
+*   [queue].pause, [queue].resume (cmd): stops or restarts sending files to the stages given in the payload "values"
+*   [queue].config (get): replies with the configuration
+* These are used by the slow-control system and run scripts.
+ */
+
+package hornet
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/project8/hornet/gogitver"
+)
+
+var hornetStartTime = time.Now()
+
+// controlRequestOps are the message operations of the remote-control requests, by target
+var controlRequestOps = map[string]MsgCodeT{
+	"status":   MOGet,
+	"files":    MOGet,
+	"schedule": MORun,
+	"pause":    MOCommand,
+	"resume":   MOCommand,
+	"config":   MOGet,
+}
+
+// checkControlRequestOp returns false, and replies with an error, if a remote-control request has the wrong message operation
+func checkControlRequestOp(request P8Message) bool {
+	expectedOp, isControlRequest := controlRequestOps[request.Target[0]]
+	if !isControlRequest || request.MsgOp == expectedOp {
+		return true
+	}
+	Log.Errorf("Request for <%s> has message operation %d; expected %d", request.Target[0], request.MsgOp, expectedOp)
+	SendReply(request, RCErrInvalidMethod, fmt.Sprintf("Invalid message operation for <%s>: %d (expected %d)", request.Target[0], request.MsgOp, expectedOp), nil)
+	return false
+}
+
+// handleStatusRequest replies with the state of hornet's components and the queue depths of the pipeline
+func handleStatusRequest(request P8Message) {
+	stats := GetPipelineStats()
+	stages := make([]map[string]interface{}, 0, len(stats.Stages))
+	workers := map[string]interface{}{"busy": 0, "total": 0}
+	for _, stage := range stats.Stages {
+		stages = append(stages, map[string]interface{}{
+			"name":      stage.Name,
+			"pending":   stage.Pending,
+			"queued":    stage.Queued,
+			"in_flight": stage.InFlight,
+			"limit":     stage.Limit,
+			"paused":    stage.Paused,
+		})
+		if stage.Name == "workers" {
+			workers = map[string]interface{}{"busy": stage.InFlight, "total": stage.Limit, "waiting": stage.Pending}
+		}
+	}
+	hostname, _ := os.Hostname()
+	SendReply(request, RCSuccess, "", map[string]interface{}{
+		"version":  gogitver.Tag(),
+		"hostname": hostname,
+		"uptime":   time.Since(hornetStartTime).Round(time.Second).String(),
+		"components": map[string]interface{}{
+			"amqp_sender":     AmqpSenderIsActive.Load(),
+			"amqp_receiver":   AmqpReceiverIsActive.Load(),
+			"watcher":         WatcherIsActive.Load(),
+			"run_tracker":     RunTrackerIsActive.Load(),
+			"shipping_paused": ShippingIsPaused(),
+		},
+		"pipeline": map[string]interface{}{
+			"in_pipeline":     stats.InPipeline,
+			"max_in_pipeline": stats.MaxInPipeline,
+			"saturated":       PipelineIsSaturated(),
+			"to_be_scheduled": stats.SchQueueDepth,
+			"held_by_watcher": stats.WatcherPending,
+		},
+		"stages":  stages,
+		"workers": workers,
+	})
+}
+
+// handleFilesRequest replies with the files in the pipeline, in the payload "files"
+func handleFilesRequest(request P8Message) {
+	files := make([]map[string]interface{}, 0)
+	for _, status := range GetFilesInPipeline() {
+		file := map[string]interface{}{
+			"path":  status.Path,
+			"stage": status.Stage,
+			"since": status.Since.UTC().Format(TimeFormat),
+		}
+		if status.DatabaseID != "" {
+			file["database_id"] = status.DatabaseID
+		}
+		files = append(files, file)
+	}
+	SendReply(request, RCSuccess, "", map[string]interface{}{"files": files})
+}
+
+// handleScheduleRequest schedules the files in the payload "values"; a priority can be given in the payload "priority".
+// The reply payload lists the files that were scheduled.
+func handleScheduleRequest(request P8Message) {
+	valuesIfc, _ := GetPayloadValue(request.Payload, "values")
+	paths := ConvertToStringSlice(valuesIfc)
+	if len(paths) == 0 {
+		Log.Error("No files provided for the schedule request")
+		SendReply(request, RCErrBadPayload, "No files provided in the payload values", nil)
+		return
+	}
+	priorityIfc, hasPriority := GetPayloadValue(request.Payload, "priority")
+
+	scheduled := []string{}
+	var failures []string
+	for _, path := range paths {
+		// relative paths would be interpreted with respect to hornet's directory, not the requester's
+		if !filepath.IsAbs(path) {
+			failures = append(failures, fmt.Sprintf("<%s> is not an absolute path", path))
+			continue
+		}
+		if !PathIsRegularFile(path) {
+			failures = append(failures, fmt.Sprintf("<%s> is not a regular file", path))
+			continue
+		}
+		if hasPriority {
+			SetSubmissionPriority(path, ConvertToInt(priorityIfc))
+		}
+		if schErr := ScheduleFile(path); schErr != nil {
+			takeSubmissionPriority(path)
+			failures = append(failures, schErr.Error())
+			continue
+		}
+		Log.Infof("Scheduled <%s> on request", path)
+		scheduled = append(scheduled, path)
+	}
+	payload := map[string]interface{}{"scheduled": scheduled}
+	if len(failures) > 0 {
+		Log.Errorf("Unable to schedule files on request:\n\t%s", strings.Join(failures, "\n\t"))
+		SendReply(request, RCErrInvalidValue, strings.Join(failures, "; "), payload)
+		return
+	}
+	SendReply(request, RCSuccess, "", payload)
+}
+
+// handleStageRequest pauses or resumes sending files to the stages in the payload "values" (e.g. "mover", "shipper" or "shipper:archive").
+// The workers can't be paused.  The reply payload lists the paused stages.
+func handleStageRequest(request P8Message, pause bool) {
+	valuesIfc, _ := GetPayloadValue(request.Payload, "values")
+	names := ConvertToStringSlice(valuesIfc)
+	if len(names) == 0 {
+		Log.Error("No stages provided for the pause/resume request")
+		SendReply(request, RCErrBadPayload, "No stages provided in the payload values", nil)
+		return
+	}
+
+	stats := GetPipelineStats()
+	knownStages := make(map[string]bool)
+	for _, stage := range stats.Stages {
+		if stage.Name == "workers" {
+			continue
+		}
+		knownStages[stage.Name] = true
+		if strings.HasPrefix(stage.Name, "shipper:") {
+			knownStages["shipper"] = true
+		}
+	}
+	for _, name := range names {
+		if !knownStages[name] {
+			Log.Errorf("Unable to pause or resume unknown stage <%s>", name)
+			SendReply(request, RCErrInvalidValue, "Unknown (or unpausable) stage: "+name, nil)
+			return
+		}
+	}
+	for _, name := range names {
+		SetStagePaused(name, pause)
+	}
+
+	paused := []string{}
+	for _, stage := range GetPipelineStats().Stages {
+		if StageIsPaused(stage.Name) {
+			paused = append(paused, stage.Name)
+		}
+	}
+	SendReply(request, RCSuccess, "", map[string]interface{}{"paused": paused})
+}
+
+// handleConfigRequest replies with the configuration, in the payload "config"; passwords and tokens are left out
+func handleConfigRequest(request P8Message) {
+	SendReply(request, RCSuccess, "", map[string]interface{}{"config": redactSettings(viper.AllSettings())})
+}
+
+// redactSettings copies the settings, replacing anything that looks like a credential
+func redactSettings(settings map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		lowerKey := strings.ToLower(key)
+		switch typedValue := value.(type) {
+		case map[string]interface{}:
+			redacted[key] = redactSettings(typedValue)
+		case []interface{}:
+			list := make([]interface{}, len(typedValue))
+			for iItem, item := range typedValue {
+				if itemMap, isMap := item.(map[string]interface{}); isMap {
+					list[iItem] = redactSettings(itemMap)
+				} else {
+					list[iItem] = item
+				}
+			}
+			redacted[key] = list
+		case string:
+			if strings.Contains(lowerKey, "password") || strings.Contains(lowerKey, "secret") || strings.Contains(lowerKey, "token") {
+				redacted[key] = "[redacted]"
+			} else if parsedURL, parseErr := url.Parse(typedValue); parseErr == nil && parsedURL.User != nil {
+				// e.g. the AMQP URL can include the password
+				parsedURL.User = url.User(parsedURL.User.Username())
+				redacted[key] = parsedURL.String()
+			} else {
+				redacted[key] = typedValue
+			}
+		default:
+			redacted[key] = value
+		}
+	}
+	return redacted
+}
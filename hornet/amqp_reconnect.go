@@ -0,0 +1,215 @@
+/*
+* amqp_reconnect.go
+*
+* reconnection to the AMQP broker, and buffering of outgoing messages while the connection is down.
+*
+* If the connection to the broker is lost (e.g. the broker is restarted), the AMQP sender and receiver
+* reconnect, with a delay that doubles after each failed attempt.  Meanwhile, the sender keeps outgoing
+* messages in memory, and, if a spill directory is configured, on disk once the memory buffer is full,
+* so that (for example) file information for the run database is not lost.
+ */
+
+package hornet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+// amqpBackoff gives the delays between attempts to reconnect to the broker; the delay doubles after each attempt, up to a maximum
+type amqpBackoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+// newAmqpBackoff sets up the reconnection delays from amqp.reconnect-delay (default 1s) and amqp.reconnect-max-delay (default 1m)
+func newAmqpBackoff() *amqpBackoff {
+	b := &amqpBackoff{initial: time.Second, max: time.Minute}
+	if viper.IsSet("amqp.reconnect-delay") {
+		b.initial = viper.GetDuration("amqp.reconnect-delay")
+	}
+	if viper.IsSet("amqp.reconnect-max-delay") {
+		b.max = viper.GetDuration("amqp.reconnect-max-delay")
+	}
+	b.next = b.initial
+	return b
+}
+
+// Next returns the delay before the next attempt
+func (b *amqpBackoff) Next() (delay time.Duration) {
+	delay = b.next
+	if b.next *= 2; b.next > b.max {
+		b.next = b.max
+	}
+	return
+}
+
+// Reset is used once a connection succeeds
+func (b *amqpBackoff) Reset() {
+	b.next = b.initial
+}
+
+// reconnectAmqp calls connect until it succeeds, waiting between attempts.
+// It returns false if a control message (i.e. a request to stop) is received while waiting.
+func reconnectAmqp(name string, connect func() error, backoff *amqpBackoff, ctrlQueue chan ControlMessage) bool {
+	for {
+		delay := backoff.Next()
+		Log.Infof("AMQP %s will reconnect in %v", name, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctrlQueue:
+			return false
+		}
+		if connErr := connect(); connErr != nil {
+			Log.Warning(connErr.Error())
+			continue
+		}
+		backoff.Reset()
+		Log.Noticef("AMQP %s has reconnected to the broker", name)
+		return true
+	}
+}
+
+// amqpPublishing gives the AMQP form of a message
+func (m BusMessage) amqpPublishing() amqp.Publishing {
+	publishing := amqp.Publishing{
+		ContentEncoding: m.ContentEncoding,
+		Body:            m.Body,
+		ReplyTo:         m.ReplyTo,
+		CorrelationId:   m.CorrelationId,
+	}
+	if m.Persistent {
+		publishing.DeliveryMode = amqp.Persistent
+	}
+	return publishing
+}
+
+// amqpOutbox holds outgoing messages while the sender is disconnected.
+// Messages are kept in memory up to a limit, after which they're written to the spill directory, if there is one.
+// Once messages have been spilled, new messages are also spilled, so that they're sent in order.
+type amqpOutbox struct {
+	maxInMemory int
+	spillDir    string
+	memory      []BusMessage
+	nSpilled    int
+	spillCount  uint64
+}
+
+const amqpSpillExtension = ".amqp-msg"
+
+// newAmqpOutbox creates the outbox; messages left in the spill directory by an earlier run are included
+func newAmqpOutbox(maxInMemory int, spillDir string) (outbox *amqpOutbox, e error) {
+	outbox = &amqpOutbox{maxInMemory: maxInMemory, spillDir: spillDir}
+	if spillDir == "" {
+		return
+	}
+	if e = os.MkdirAll(spillDir, os.ModePerm); e != nil {
+		e = fmt.Errorf("Unable to create the AMQP spill directory: %v", e)
+		return
+	}
+	spilled, listErr := outbox.spilledFiles()
+	if listErr != nil {
+		e = listErr
+		return
+	}
+	outbox.nSpilled = len(spilled)
+	return
+}
+
+// Len returns the number of messages waiting to be sent
+func (o *amqpOutbox) Len() int {
+	return len(o.memory) + o.nSpilled
+}
+
+// Add keeps a message until it can be sent; an error is returned if there's no room for it
+func (o *amqpOutbox) Add(message BusMessage) error {
+	if o.nSpilled == 0 && len(o.memory) < o.maxInMemory {
+		o.memory = append(o.memory, message)
+		return nil
+	}
+	if o.spillDir == "" {
+		return fmt.Errorf("The outgoing message buffer is full (%d messages)", o.maxInMemory)
+	}
+	encoded, encodeErr := json.Marshal(message)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	// the file names sort in the order in which the messages were spilled
+	o.spillCount++
+	filename := fmt.Sprintf("%020d-%08d%s", time.Now().UnixNano(), o.spillCount, amqpSpillExtension)
+	if writeErr := ioutil.WriteFile(filepath.Join(o.spillDir, filename), encoded, 0644); writeErr != nil {
+		return fmt.Errorf("Unable to spill the message to disk: %v", writeErr)
+	}
+	o.nSpilled++
+	return nil
+}
+
+// Requeue puts messages back at the front of the outbox, e.g. messages that were published but not confirmed before the connection was lost.
+// They're kept in memory regardless of the limit, since they're older than any spilled messages.
+func (o *amqpOutbox) Requeue(messages []BusMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	o.memory = append(append([]BusMessage{}, messages...), o.memory...)
+}
+
+// Flush sends the waiting messages in order, stopping at the first one that can't be sent
+func (o *amqpOutbox) Flush(publish func(BusMessage) error) error {
+	for len(o.memory) > 0 {
+		if pubErr := publish(o.memory[0]); pubErr != nil {
+			return pubErr
+		}
+		o.memory = o.memory[1:]
+	}
+	if o.nSpilled == 0 {
+		return nil
+	}
+	spilled, listErr := o.spilledFiles()
+	if listErr != nil {
+		return listErr
+	}
+	for _, path := range spilled {
+		encoded, readErr := ioutil.ReadFile(path)
+		if readErr != nil {
+			return fmt.Errorf("Unable to read a spilled message: %v", readErr)
+		}
+		var message BusMessage
+		if decodeErr := json.Unmarshal(encoded, &message); decodeErr != nil {
+			// a corrupt file would otherwise block all later messages
+			Log.Errorf("Unable to decode spilled message <%s>; it will be skipped: %v", path, decodeErr)
+		} else if pubErr := publish(message); pubErr != nil {
+			return pubErr
+		}
+		if removeErr := os.Remove(path); removeErr != nil {
+			return fmt.Errorf("Unable to remove a spilled message: %v", removeErr)
+		}
+		o.nSpilled--
+	}
+	o.nSpilled = 0
+	return nil
+}
+
+func (o *amqpOutbox) spilledFiles() (paths []string, e error) {
+	entries, readErr := ioutil.ReadDir(o.spillDir)
+	if readErr != nil {
+		e = fmt.Errorf("Unable to read the AMQP spill directory: %v", readErr)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), amqpSpillExtension) {
+			paths = append(paths, filepath.Join(o.spillDir, entry.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return
+}
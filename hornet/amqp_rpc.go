@@ -0,0 +1,164 @@
+/*
+* amqp_rpc.go
+*
+* request/reply messaging over AMQP.
+*
+* Replies are matched to their requests by correlation ID.  The AMQP sender registers the reply channel
+* of each outgoing request that has one, and the AMQP receiver delivers each reply to the channel that's
+* waiting for it.  Entries for requests that are never answered are removed once they expire.
+*
+* Request sends a request and waits for the reply, e.g.
+*    reply, err := Request(ctx, []string{"run_db", "do_insert"}, MOCommand, payload)
+ */
+
+package hornet
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/spf13/viper"
+)
+
+// pendingReply is a request waiting for a reply
+type pendingReply struct {
+	replyChan chan P8Message
+	expires   time.Time
+}
+
+// replyRegistry maps correlation IDs to the channels waiting for replies; it's used by both the AMQP sender and receiver
+type replyRegistry struct {
+	mutex     sync.Mutex
+	waiting   map[string]pendingReply
+	lastSweep time.Time
+}
+
+// how often expired entries are removed from the registry
+const replySweepInterval = time.Minute
+
+var replies = &replyRegistry{waiting: make(map[string]pendingReply)}
+
+// Register adds a channel for the reply to the request with the given correlation ID; the entry is removed after it expires
+func (r *replyRegistry) Register(corrId string, replyChan chan P8Message, expires time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.waiting[corrId] = pendingReply{replyChan: replyChan, expires: expires}
+	if now := time.Now(); now.Sub(r.lastSweep) > replySweepInterval {
+		r.sweep(now)
+		r.lastSweep = now
+	}
+}
+
+// Cancel removes the entry for a request, e.g. once its reply has been received or it's been abandoned
+func (r *replyRegistry) Cancel(corrId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.waiting, corrId)
+}
+
+// Deliver passes a reply to the channel waiting for it, if any; the reply is dropped if the channel is full.
+// Only the first reply to a request is delivered.
+func (r *replyRegistry) Deliver(corrId string, reply P8Message) bool {
+	r.mutex.Lock()
+	pending, isWaiting := r.waiting[corrId]
+	delete(r.waiting, corrId)
+	r.mutex.Unlock()
+	if !isWaiting {
+		return false
+	}
+	select {
+	case pending.replyChan <- reply:
+		return true
+	default:
+		Log.Warningf("Unable to deliver the reply to request <%s>; the reply channel is full", corrId)
+		return false
+	}
+}
+
+// Len returns the number of requests waiting for replies
+func (r *replyRegistry) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.waiting)
+}
+
+// sweep removes the expired entries; the mutex must be held
+func (r *replyRegistry) sweep(now time.Time) {
+	for corrId, pending := range r.waiting {
+		if now.After(pending.expires) {
+			Log.Debugf("No reply was received for request <%s>", corrId)
+			delete(r.waiting, corrId)
+		}
+	}
+}
+
+// requestTimeout is how long to wait for a reply when no deadline is given: amqp.request-timeout (default 10s)
+func requestTimeout() time.Duration {
+	if viper.IsSet("amqp.request-timeout") {
+		return viper.GetDuration("amqp.request-timeout")
+	}
+	return 10 * time.Second
+}
+
+// Request sends a request through the AMQP sender and waits for the reply.
+// If the context has no deadline, the request times out after amqp.request-timeout.
+// An error is returned if no reply is received, if the request can't be delivered to any queue,
+// or if the reply's return code isn't RCSuccess (in which case the reply is also returned).
+func Request(ctx context.Context, target []string, msgOp MsgCodeT, payload interface{}) (reply P8Message, e error) {
+	routingKey := strings.Join(target, TargetSeparator)
+	if !AmqpSenderIsActive.Load() || !AmqpReceiverIsActive.Load() {
+		e = fmt.Errorf("Unable to send the request to <%s>; the AMQP sender and receiver must be active", routingKey)
+		return
+	}
+	start := time.Now()
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout())
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	request := PrepareRequest(target, "application/json", msgOp, nil)
+	request.CorrId = uuid.New()
+	request.Payload = payload
+	// the delivery report gives an early error if the request can't be routed
+	request.DeliveryChan = make(chan P8Message, 1)
+
+	// the reply channel is registered before the request is sent, so the reply can't arrive first
+	replyChan := make(chan P8Message, 1)
+	replies.Register(request.CorrId, replyChan, deadline)
+	defer replies.Cancel(request.CorrId)
+
+	select {
+	case SendMessageQueue <- request:
+	case <-ctx.Done():
+		e = fmt.Errorf("Unable to send the request to <%s>: %v", routingKey, ctx.Err())
+		return
+	}
+
+	for {
+		select {
+		case report := <-request.DeliveryChan:
+			if report.RetCode != RCSuccess {
+				e = fmt.Errorf("The request to <%s> was not delivered: (%d) %s", routingKey, report.RetCode, report.RetMsg)
+				return
+			}
+		case reply = <-replyChan:
+			if reply.RetCode != RCSuccess {
+				e = fmt.Errorf("The request to <%s> failed: (%d) %s", routingKey, reply.RetCode, reply.RetMsg)
+			}
+			return
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				e = fmt.Errorf("No reply to the request to <%s> after %v", routingKey, time.Since(start).Round(time.Millisecond))
+			} else {
+				e = fmt.Errorf("The request to <%s> was cancelled", routingKey)
+			}
+			return
+		}
+	}
+}
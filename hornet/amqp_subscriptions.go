@@ -0,0 +1,158 @@
+/*
+* amqp_subscriptions.go
+*
+* actions triggered by alert and info messages from other services.
+*
+* Each subscription binds hornet's queue to a routing-key pattern (with the AMQP topic wildcards, * and #),
+* and maps the alert and info messages received with matching routing keys to an action:
+*   schedule: schedule the file(s) given (as absolute paths) in the payload element "key" (default "path")
+*   stop-run: end the run(s) given in the payload element "key" (default "run_id"); the run tracker must be active
+*   pause-shipping, resume-shipping: no payload is needed
+* e.g.
+*    "subscriptions": [
+*        {"routing-key": "daq.file_written", "action": "schedule", "key": "path"},
+*        {"routing-key": "daq.run_stopped", "action": "stop-run", "key": "run_id"}
+*    ]
+* This lets the DAQ notify hornet directly, instead of relying only on filesystem events.
+ */
+
+package hornet
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// amqpSubscription maps the alert and info messages received with routing keys that match a pattern to an action
+type amqpSubscription struct {
+	RoutingKey string
+	Action     string
+	Key        string
+}
+
+// default payload element for each action that needs one
+var subscriptionActionKeys = map[string]string{
+	"schedule":        "path",
+	"stop-run":        "run_id",
+	"pause-shipping":  "",
+	"resume-shipping": "",
+}
+
+// getAmqpSubscriptions reads and validates the subscriptions (amqp.subscriptions)
+func getAmqpSubscriptions() (subscriptions []amqpSubscription, e error) {
+	subscriptionsIfc := viper.Get("amqp.subscriptions")
+	if subscriptionsIfc == nil {
+		return
+	}
+	subscriptionsRaw, isList := subscriptionsIfc.([]interface{})
+	if !isList {
+		e = fmt.Errorf("The AMQP subscriptions must be a list")
+		return
+	}
+	for iSub, subIfc := range subscriptionsRaw {
+		subMap, isMap := subIfc.(map[string]interface{})
+		if !isMap {
+			e = fmt.Errorf("AMQP subscription %d is not a map", iSub)
+			return
+		}
+		subscription := amqpSubscription{
+			RoutingKey: ConvertToString(subMap["routing-key"]),
+			Action:     ConvertToString(subMap["action"]),
+			Key:        ConvertToString(subMap["key"]),
+		}
+		if _, hasRoutingKey := subMap["routing-key"]; !hasRoutingKey || subscription.RoutingKey == "" {
+			e = fmt.Errorf("AMQP subscription %d is missing its routing key", iSub)
+			return
+		}
+		defaultKey, knownAction := subscriptionActionKeys[subscription.Action]
+		if !knownAction {
+			e = fmt.Errorf("Unknown action for AMQP subscription %d <%s>: %v", iSub, subscription.RoutingKey, subMap["action"])
+			return
+		}
+		if _, hasKey := subMap["key"]; !hasKey {
+			subscription.Key = defaultKey
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return
+}
+
+// topicMatches checks a routing key against a binding pattern, in which * matches exactly one word and # matches zero or more words
+func topicMatches(pattern, routingKey string) bool {
+	return wordsMatch(strings.Split(pattern, TargetSeparator), strings.Split(routingKey, TargetSeparator))
+}
+
+func wordsMatch(patternWords, keyWords []string) bool {
+	if len(patternWords) == 0 {
+		return len(keyWords) == 0
+	}
+	switch patternWords[0] {
+	case "#":
+		for iSkip := 0; iSkip <= len(keyWords); iSkip++ {
+			if wordsMatch(patternWords[1:], keyWords[iSkip:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(keyWords) > 0 && wordsMatch(patternWords[1:], keyWords[1:])
+	default:
+		return len(keyWords) > 0 && patternWords[0] == keyWords[0] && wordsMatch(patternWords[1:], keyWords[1:])
+	}
+}
+
+// handleSubscribedMessage carries out the actions of the subscriptions that match an alert or info message's routing key
+func handleSubscribedMessage(subscriptions []amqpSubscription, routingKey string, message P8Message) {
+	for _, subscription := range subscriptions {
+		if !topicMatches(subscription.RoutingKey, routingKey) {
+			continue
+		}
+		Log.Debugf("Message with routing key <%s> matches subscription <%s> (%s)", routingKey, subscription.RoutingKey, subscription.Action)
+
+		var values []string
+		if subscription.Key != "" {
+			valueIfc, _ := GetPayloadValue(message.Payload, subscription.Key)
+			values = ConvertToStringSlice(valueIfc)
+			if len(values) == 0 {
+				Log.Errorf("Message with routing key <%s> has no payload element <%s> for the %s action", routingKey, subscription.Key, subscription.Action)
+				continue
+			}
+		}
+
+		switch subscription.Action {
+		case "schedule":
+			for _, path := range values {
+				// relative paths would be interpreted with respect to hornet's directory, not the sender's
+				if !filepath.IsAbs(path) {
+					Log.Errorf("Unable to schedule <%s> from <%s>: it's not an absolute path", path, routingKey)
+					continue
+				}
+				if schErr := ScheduleFile(path); schErr != nil {
+					Log.Errorf("Unable to schedule <%s> from <%s>: %v", path, routingKey, schErr)
+					continue
+				}
+				Log.Infof("Scheduled <%s> on message <%s>", path, routingKey)
+			}
+		case "stop-run":
+			if !RunTrackerIsActive.Load() {
+				Log.Errorf("Run-stop message <%s> received, but the run tracker is not active", routingKey)
+				continue
+			}
+			// the receiver doesn't wait for the run tracker
+			for _, runId := range values {
+				select {
+				case RunStopQueue <- RunStopRequest{ID: runId}:
+				default:
+					Log.Errorf("Unable to stop run <%s> on message <%s>: the run tracker's queue is full", runId, routingKey)
+				}
+			}
+		case "pause-shipping":
+			SetShippingPaused(true)
+		case "resume-shipping":
+			SetShippingPaused(false)
+		}
+	}
+}
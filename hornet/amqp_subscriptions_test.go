@@ -0,0 +1,40 @@
+package hornet
+
+import (
+	"testing"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		routingKey string
+		expected   bool
+	}{
+		{"daq.run_stopped", "daq.run_stopped", true},
+		{"daq.run_stopped", "daq.run_started", false},
+		{"daq.run_stopped", "daq.run_stopped.extra", false},
+		{"daq.*", "daq.run_stopped", true},
+		{"daq.*", "daq", false},
+		{"daq.*", "daq.run_stopped.extra", false},
+		{"*.run_stopped", "psyllid.run_stopped", true},
+		{"daq.#", "daq", true},
+		{"daq.#", "daq.run_stopped", true},
+		{"daq.#", "daq.run_stopped.extra", true},
+		{"daq.#", "dac.run_stopped", false},
+		{"#", "anything.at.all", true},
+		{"#.file_ready", "file_ready", true},
+		{"#.file_ready", "daq.a.file_ready", true},
+		{"#.file_ready", "daq.file_ready.not", false},
+		{"daq.#.ready", "daq.ready", true},
+		{"daq.#.ready", "daq.a.b.ready", true},
+		{"daq.*.#", "daq", false},
+		{"daq.*.#", "daq.a", true},
+		// wildcards only match whole words
+		{"daq.run*", "daq.run_stopped", false},
+	}
+	for _, test := range tests {
+		if matches := topicMatches(test.pattern, test.routingKey); matches != test.expected {
+			t.Errorf("topicMatches(%q, %q): got %v; expected %v", test.pattern, test.routingKey, matches, test.expected)
+		}
+	}
+}
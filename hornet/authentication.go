@@ -6,6 +6,7 @@
 * The current set of authenticators is:
 *   - AMQP (username/password)
 *   - Slack (token)
+*   - S3 (access key/secret key)
  */
 
 package hornet
@@ -28,9 +29,16 @@ type SlackCredentialType struct {
 	Available bool
 }
 
+type S3CredentialType struct {
+	AccessKey string `json:"access-key"`
+	SecretKey string `json:"secret-key"`
+	Available bool
+}
+
 type AuthenticatorsType struct {
 	Amqp  AmqpCredentialType  `json:"amqp"`
 	Slack SlackCredentialType `json:"slack"`
+	S3    S3CredentialType    `json:"s3"`
 }
 
 var Authenticators AuthenticatorsType
@@ -69,9 +77,15 @@ func LoadAuthenticators() (e error) {
 		Authenticators.Slack.Available = true
 	}
 
-	Log.Infof("Authenticators ready for use:\n\t%s%t\n\t%s%t",
+	// S3
+	if len(Authenticators.S3.AccessKey) > 0 && len(Authenticators.S3.SecretKey) > 0 {
+		Authenticators.S3.Available = true
+	}
+
+	Log.Infof("Authenticators ready for use:\n\t%s%t\n\t%s%t\n\t%s%t",
 		"AMQP: ", Authenticators.Amqp.Available,
 		"Slack: ", Authenticators.Slack.Available,
+		"S3: ", Authenticators.S3.Available,
 	)
 
 	return
@@ -0,0 +1,143 @@
+/*
+* bus.go
+*
+* the message bus carries hornet's messages to and from the other services.
+*
+* The rest of hornet sends messages on SendMessageQueue, and handles the messages that are received
+* (see handleReceivedMessage); the bus only moves encoded messages, routed by topic.  There are two implementations:
+*    - AMQP (amqp.go), which uses the broker given in the amqp configuration;
+*    - in-memory (memory_bus.go), which routes messages within hornet, for tests and offline runs.
+* The implementation is chosen with amqp.bus ("amqp", the default, or "memory").
+ */
+
+package hornet
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/spf13/viper"
+)
+
+// BusMessage is an encoded message, with its routing information
+type BusMessage struct {
+	RoutingKey      string
+	ContentEncoding string
+	CorrelationId   string
+	ReplyTo         string
+	Body            []byte
+	Persistent      bool
+	AllowUnroutable bool
+	// the delivery report (see amqp_confirms.go) can't be kept for messages that are spilled to disk
+	DeliveryChan chan P8Message `json:"-"`
+}
+
+// MessageBus is a transport for hornet's messages.
+// The receiver and sender run until they receive StopExecution on the control queue, and set
+// AmqpReceiverIsActive and AmqpSenderIsActive while they're able to receive and send.
+type MessageBus interface {
+	// Name identifies the bus in log messages
+	Name() string
+	// RunReceiver binds the queue to the routing-key patterns (which can include the topic wildcards * and #),
+	// and passes each message received to the handler
+	RunReceiver(queueName string, bindings []string, handle func(BusMessage), ctrlQueue, reqQueue chan ControlMessage)
+	// RunSender encodes (with prepareBusMessage) and sends the outgoing messages; the outcome of each is given with reportDelivery
+	RunSender(outgoing <-chan P8Message, ctrlQueue, reqQueue chan ControlMessage)
+}
+
+// NewMessageBus creates the bus given in the configuration (amqp.bus)
+func NewMessageBus() (bus MessageBus, e error) {
+	switch busType := viper.GetString("amqp.bus"); busType {
+	case "", "amqp":
+		return newAmqpBus()
+	case "memory":
+		return NewMemoryBus(), nil
+	default:
+		e = fmt.Errorf("Unknown message bus (amqp.bus): <%s>", busType)
+		return
+	}
+}
+
+// StartMessageBus starts the receiver and sender goroutines for a bus
+func StartMessageBus(bus MessageBus, ctrlQueue, reqQueue chan ControlMessage, threadCountQueue chan uint, poolCount *sync.WaitGroup) (e error) {
+	queueName := viper.GetString("amqp.queue")
+	// the queue is also bound to the routing keys of the subscriptions to alert and info messages (see amqp_subscriptions.go)
+	subscriptions, subErr := getAmqpSubscriptions()
+	if subErr != nil {
+		e = subErr
+		return
+	}
+	bindings := []string{queueName + ".#"}
+	for _, subscription := range subscriptions {
+		bindings = append(bindings, subscription.RoutingKey)
+	}
+
+	Log.Infof("Starting %s receiver", bus.Name())
+	poolCount.Add(1)
+	threadCountQueue <- 1
+	go func() {
+		defer poolCount.Done()
+		defer Log.Infof("%s receiver is finished.", bus.Name())
+		bus.RunReceiver(queueName, bindings, func(message BusMessage) {
+			handleReceivedMessage(message, queueName, subscriptions, reqQueue)
+		}, ctrlQueue, reqQueue)
+	}()
+
+	Log.Infof("Starting %s sender", bus.Name())
+	poolCount.Add(1)
+	threadCountQueue <- 1
+	go func() {
+		defer poolCount.Done()
+		defer Log.Infof("%s sender is finished.", bus.Name())
+		bus.RunSender(SendMessageQueue, ctrlQueue, reqQueue)
+	}()
+	return
+}
+
+// prepareBusMessage encodes an outgoing message.  A correlation ID is assigned if the message doesn't have one,
+// and if a reply is requested (as indicated by a non-nil reply channel), the channel is registered (see amqp_rpc.go).
+// Replies are sent to hornet's queue.
+func prepareBusMessage(p8Message P8Message) (message BusMessage, e error) {
+	correlationId := p8Message.CorrId
+	if p8Message.CorrId == "" {
+		correlationId = uuid.New()
+	}
+
+	messageBody, encodeErr := encodeP8Message(p8Message)
+	if encodeErr != nil {
+		e = encodeErr
+		return
+	}
+
+	if p8Message.ReplyChan != nil {
+		replies.Register(correlationId, p8Message.ReplyChan, time.Now().Add(requestTimeout()))
+	}
+
+	message = BusMessage{
+		RoutingKey:      strings.Join(p8Message.Target, TargetSeparator),
+		ContentEncoding: p8Message.Encoding,
+		Body:            messageBody,
+		ReplyTo:         viper.GetString("amqp.queue"),
+		CorrelationId:   correlationId,
+		DeliveryChan:    p8Message.DeliveryChan,
+		AllowUnroutable: p8Message.AllowUnroutable,
+	}
+	return
+}
+
+// reportDelivery sends the outcome of publishing a message to its originator, if it asked for it, as a reply.
+// The sender never waits for the originator, so the delivery channel should be buffered.
+func reportDelivery(message BusMessage, retCode MsgCodeT, retMsg string) {
+	if message.DeliveryChan == nil {
+		return
+	}
+	report := PrepareReply([]string{message.RoutingKey}, message.ContentEncoding, message.CorrelationId, retCode, retMsg, nil)
+	select {
+	case message.DeliveryChan <- report:
+	default:
+		Log.Warningf("Unable to report the delivery of the message to <%s>; the delivery channel is full", message.RoutingKey)
+	}
+}
@@ -19,7 +19,6 @@ import (
 	"regexp"
 	"strings"
 	"text/template"
-	"time"
 
 	"github.com/spf13/viper"
 )
@@ -32,6 +31,7 @@ type TypeInfo struct {
 	RegexpTemplate   *regexp.Regexp
 	DoHash           bool
 	Jobs             []int
+	Priority         int
 }
 
 type JobInfo struct {
@@ -39,6 +39,7 @@ type JobInfo struct {
 	FileType        string
 	Command         string
 	CommandTemplate *template.Template
+	Priority        int
 }
 
 // ValidateClassifierConfig checks the sanity of the classifier section of a configuration.
@@ -96,6 +97,8 @@ func ValidateClassifierConfig() (e error) {
 // getSubPath extracts the sub path from a file's full path by comparing it to the (ordered) list of base paths
 func getSubPath(path string) (subPath string) {
 	subPath = ""
+	basePathsMutex.RLock()
+	defer basePathsMutex.RUnlock()
 	for _, basePath := range BasePaths {
 		if strings.HasPrefix(path, basePath) {
 			var relErr error
@@ -141,6 +144,9 @@ func Classifier(context OperatorContext) {
 			types[iType].RegexpTemplate = regexp.MustCompile(regexpTemplate.(string))
 		}
 		types[iType].DoHash = typeMap["do-hash"].(bool)
+		if priority, hasPriority := typeMap["priority"]; hasPriority {
+			types[iType].Priority = ConvertToInt(priority)
+		}
 		Log.Infof("Adding type:\n\t%v", types[iType])
 	}
 
@@ -157,6 +163,9 @@ func Classifier(context OperatorContext) {
 		jobs[iJob].Name = jobMap["name"].(string)
 		jobs[iJob].FileType = jobMap["file-type"].(string)
 		jobs[iJob].Command = jobMap["command"].(string)
+		if priority, hasPriority := jobMap["priority"]; hasPriority {
+			jobs[iJob].Priority = ConvertToInt(priority)
+		}
 		if jobs[iJob].CommandTemplate, cmdErr = template.New("cmd").Parse(jobs[iJob].Command); cmdErr != nil {
 			Log.Criticalf("Template error while processing <%v>", jobs[iJob].Command)
 			context.ReqQueue <- ThreadCannotContinue
@@ -168,12 +177,17 @@ func Classifier(context OperatorContext) {
 		for iType, _ := range types {
 			if types[iType].Name == jobs[iJob].FileType {
 				types[iType].Jobs = append(types[iType].Jobs, iJob)
+				// a file's priority is the highest of its type's and its jobs' priorities
+				if jobs[iJob].Priority > types[iType].Priority {
+					types[iType].Priority = jobs[iJob].Priority
+				}
 				Log.Infof("Type <%s> will now perform job %d <%s>: %v", types[iType].Name, iJob, jobs[iJob].Name, types[iType].Jobs)
 			}
 		}
 	}
 
 	// Process the base paths
+	basePathsMutex.Lock()
 	BasePaths = make([]string, 0)
 
 	if viper.GetBool("watcher.active") {
@@ -207,32 +221,7 @@ func Classifier(context OperatorContext) {
 
 	//BasePaths = append(BasePaths, []string(basePaths)...)
 	Log.Infof("Base paths: %v", BasePaths)
-
-	// Sending the file info
-	sendtoRoutingKey := viper.GetString("classifier.send-to")
-	sendFileInfo := viper.GetBool("classifier.send-file-info")
-	var masterFileInfoMessage P8Message
-	if sendFileInfo {
-		if AmqpSenderIsActive == false {
-			// sometimes the AMQP sender takes a little time to startup, so wait a second
-			var waitTime int = 1
-			if viper.IsSet("classifier.wait-for-sender") {
-				waitTime = viper.GetInt("classifier.wait-for-sender")
-			}
-			time.Sleep(time.Duration(waitTime) * time.Second)
-			if AmqpSenderIsActive == false {
-				Log.Critical("Cannot start classifier because the AMQP sender routine is not active, and sending file info has been requested")
-				context.ReqQueue <- ThreadCannotContinue
-				return
-			}
-		}
-		masterFileInfoMessage = PrepareRequest([]string{sendtoRoutingKey}, "application/json", MOCommand, nil)
-		masterFileInfoMessage.Payload = make(map[string]interface{})
-		masterFileInfoMessage.Payload.(map[string]interface{})["values"] = []string{"do_insert"}
-		masterFileInfoMessage.Payload.(map[string]interface{})["file_name"] = ""
-		masterFileInfoMessage.Payload.(map[string]interface{})["file_hash"] = ""
-		masterFileInfoMessage.Payload.(map[string]interface{})["run_id"] = 0
-	}
+	basePathsMutex.Unlock()
 
 	Log.Info("Classifier started successfully")
 
@@ -263,21 +252,22 @@ classifierLoop:
 				IsFatal:  false,
 			}
 
-			if _, existsErr := os.Stat(inputFilePath); os.IsNotExist(existsErr) {
+			fileStat, existsErr := os.Stat(inputFilePath)
+			if os.IsNotExist(existsErr) {
 				opReturn.Err = fmt.Errorf("[classifier] file <%s> does not exist", inputFilePath)
 				opReturn.IsFatal = true
 				Log.Critical(opReturn.Err.Error())
 				context.RetStream <- opReturn
 				break
 			}
+			// the size is recorded now, since the file may be moved or removed before its run is complete
+			if existsErr == nil {
+				opReturn.FHeader.Size = fileStat.Size()
+			}
 
 			_, inputFilename := filepath.Split(inputFilePath)
 
 			acceptType := bool(false)
-			var fileInfoMessage P8Message
-			if sendFileInfo {
-				fileInfoMessage = masterFileInfoMessage
-			}
 
 		typeLoop:
 			for _, typeInfo := range types {
@@ -288,14 +278,15 @@ classifierLoop:
 				if typeInfo.DoMatchRegexp {
 					allSubmatches := typeInfo.RegexpTemplate.FindAllStringSubmatch(inputFilename, -1)
 					acceptType = acceptType && len(allSubmatches) == 1 && len(allSubmatches[0]) > 1 && allSubmatches[0][0] == inputFilename
-					if acceptType && sendFileInfo {
+					if acceptType {
+						// named subexpressions are recorded as the file's metadata
+						opReturn.FHeader.Metadata = make(map[string]string)
 						subexpNames := typeInfo.RegexpTemplate.SubexpNames()
 						if len(allSubmatches[0]) > 1 {
 							for iSubmatch, submatch := range allSubmatches[0][1:] {
 								subexpName := subexpNames[iSubmatch+1]
 								if len(subexpName) > 0 {
-									Log.Debugf("Adding to payload: %s: %s", subexpName, submatch)
-									fileInfoMessage.Payload.(map[string]interface{})[subexpName] = submatch
+									opReturn.FHeader.Metadata[subexpName] = submatch
 								}
 							}
 						}
@@ -307,6 +298,7 @@ classifierLoop:
 					opReturn.FHeader.FileType = typeInfo.Name
 					opReturn.FHeader.SubPath = getSubPath(opReturn.FHeader.HotPath)
 					opReturn.FHeader.JobQueue = make(chan Job, maxJobs)
+					opReturn.FHeader.Priority = typeInfo.Priority
 					if typeInfo.DoHash {
 						if hash, hashErr := Hash(inputFilePath); hashErr != nil {
 							opReturn.Err = hashErr
@@ -317,12 +309,6 @@ classifierLoop:
 							Log.Debugf("File <%s> hash: %s", inputFilename, opReturn.FHeader.FileHash)
 						}
 					}
-					if sendFileInfo {
-						fileInfoMessage.TimeStamp = time.Now().UTC().Format(TimeFormat)
-						fileInfoMessage.Payload.(map[string]interface{})["file_name"] = inputFilename
-						fileInfoMessage.Payload.(map[string]interface{})["file_hash"] = opReturn.FHeader.FileHash
-						SendMessageQueue <- fileInfoMessage
-					}
 					// jobs for the job queue
 					Log.Debugf("Type %s has %d jobs: %v", typeInfo.Name, len(typeInfo.Jobs), typeInfo.Jobs)
 					for _, jobId := range typeInfo.Jobs {
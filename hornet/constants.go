@@ -48,6 +48,33 @@ const (
 	MOCommand MsgCodeT = 9
 )
 
+// Return codes, following dripline: 1-99 are warnings, 100-199 AMQP errors, 200-299 resource errors,
+// 300-399 service errors (i.e. problems with a request), and 400-499 client errors
 const (
-	RCSuccess MsgCodeT = 0
+	RCSuccess                MsgCodeT = 0
+	RCWarnNoActionTaken      MsgCodeT = 1
+	RCErrAmqp                MsgCodeT = 100
+	RCErrAmqpConnection      MsgCodeT = 101
+	RCErrAmqpRoutingKey      MsgCodeT = 102
+	RCErrResource            MsgCodeT = 200
+	RCErrResourceConnection  MsgCodeT = 201
+	RCErrResourceNoResponse  MsgCodeT = 202
+	RCErrResourceSubService  MsgCodeT = 203
+	RCErrService             MsgCodeT = 300
+	RCErrNoEncoding          MsgCodeT = 301
+	RCErrDecodingFail        MsgCodeT = 302
+	RCErrBadPayload          MsgCodeT = 303
+	RCErrInvalidValue        MsgCodeT = 304
+	RCErrTimeout             MsgCodeT = 305
+	RCErrInvalidMethod       MsgCodeT = 306
+	RCErrAccessDenied        MsgCodeT = 307
+	RCErrInvalidKey          MsgCodeT = 308
+	RCErrDeprecated          MsgCodeT = 309
+	RCErrInvalidSpecifier    MsgCodeT = 310
+	RCErrClient              MsgCodeT = 400
+	RCErrClientInvalidReq    MsgCodeT = 401
+	RCErrClientHandlingReply MsgCodeT = 402
+	RCErrClientUnableToSend  MsgCodeT = 403
+	RCErrClientTimeout       MsgCodeT = 404
+	RCErrUnhandledException  MsgCodeT = 999
 )
@@ -0,0 +1,158 @@
+/*
+* destinations.go
+*
+* shipping destinations are the cold-storage locations to which the shippers send files.
+*
+* Files can be replicated to several destinations (e.g. a local archive and a remote archive), which are
+* listed in shipper.destinations.  Each destination has a name and the settings for its transport, e.g.
+*    "destinations": [
+*        {"name": "local-archive", "transport": "local", "dest-dir": "/archive"},
+*        {"name": "remote-archive", "hostname": "my.server", "dest-dir": "/remote-data", "types": ["egg"]}
+*    ]
+* Settings that are not given for a destination are taken from the shipper section.
+* If there's no list of destinations, the shipper section describes a single destination, "default".
+ */
+
+package hornet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// DefaultDestinationName is the name of the destination described by the shipper section, when no destinations are listed
+const DefaultDestinationName = "default"
+
+// ShippingDestination is a cold-storage location to which files are shipped
+type ShippingDestination struct {
+	Name string
+	// file types that are shipped to this destination; if empty, all files are shipped
+	Types []string
+	// a file is only finished once it's been shipped to all of its required destinations
+	Required bool
+	// settings for the destination's transport
+	Settings map[string]interface{}
+}
+
+// ShipmentStatus is the result of shipping a file to one destination
+type ShipmentStatus struct {
+	Required     bool
+	Shipped      bool
+	Err          string
+	ColdPath     string
+	FileColdPath string
+}
+
+// GetShippingDestinations returns the destinations from the shipper configuration, in the order in which they're listed
+func GetShippingDestinations() (destinations []ShippingDestination, e error) {
+	shipperSettings := viper.GetStringMap("shipper")
+	destinationsIfc, hasDestinations := shipperSettings["destinations"]
+	if !hasDestinations {
+		destinations = []ShippingDestination{{Name: DefaultDestinationName, Required: true, Settings: shipperSettings}}
+		return
+	}
+
+	destinationList, isList := destinationsIfc.([]interface{})
+	if !isList || len(destinationList) == 0 {
+		e = errors.New("The shipper destinations must be a non-empty list")
+		return
+	}
+	names := make(map[string]bool)
+	hasRequired := false
+	for iDestination, destinationIfc := range destinationList {
+		destinationMap, isMap := destinationIfc.(map[string]interface{})
+		if !isMap {
+			e = fmt.Errorf("Shipper destination %d is not an object", iDestination)
+			return
+		}
+		// the destination's settings override those in the shipper section
+		settings := make(map[string]interface{})
+		for key, value := range shipperSettings {
+			if key != "destinations" {
+				settings[key] = value
+			}
+		}
+		for key, value := range destinationMap {
+			settings[strings.ToLower(key)] = value
+		}
+
+		destination := ShippingDestination{
+			Name:     getSetting(destinationMap, "name"),
+			Types:    ConvertToStringSlice(settings["types"]),
+			Required: true,
+			Settings: settings,
+		}
+		if destination.Name == "" {
+			e = fmt.Errorf("Shipper destination %d has no name", iDestination)
+			return
+		}
+		if names[destination.Name] {
+			e = fmt.Errorf("Shipper destination <%s> is listed more than once", destination.Name)
+			return
+		}
+		names[destination.Name] = true
+		if requiredIfc, hasRequiredSetting := destinationMap["required"]; hasRequiredSetting {
+			required, isBool := requiredIfc.(bool)
+			if !isBool {
+				e = fmt.Errorf("The required setting of shipper destination <%s> must be true or false", destination.Name)
+				return
+			}
+			destination.Required = required
+		}
+		hasRequired = hasRequired || destination.Required
+		destinations = append(destinations, destination)
+	}
+	if !hasRequired {
+		e = errors.New("At least one shipper destination must be required")
+	}
+	return
+}
+
+// AppliesTo checks whether files of the given type are shipped to the destination
+func (d ShippingDestination) AppliesTo(fileType string) bool {
+	if len(d.Types) == 0 {
+		return true
+	}
+	for _, destinationType := range d.Types {
+		if destinationType == fileType {
+			return true
+		}
+	}
+	return false
+}
+
+// fileShipments tracks the shipments of a file to its destinations; it's only used by the scheduler
+type fileShipments struct {
+	header   FileInfo
+	pending  int
+	statuses map[string]ShipmentStatus
+}
+
+// finish records the shipments in the file's header, and checks whether the shipments to all required destinations succeeded.
+// The file's cold path is that of the first destination (in the configured order) to which it was shipped, preferring required destinations.
+func (s *fileShipments) finish(destinations []ShippingDestination) (header FileInfo, succeeded bool) {
+	header = s.header
+	header.Shipments = s.statuses
+	succeeded = true
+	var coldStatus *ShipmentStatus
+	for _, destination := range destinations {
+		status, hasStatus := s.statuses[destination.Name]
+		if !hasStatus {
+			continue
+		}
+		if status.Required && !status.Shipped {
+			succeeded = false
+		}
+		if status.Shipped && (coldStatus == nil || (status.Required && !coldStatus.Required)) {
+			coldStatus = &status
+		}
+	}
+	if coldStatus != nil {
+		header.ColdPath = coldStatus.ColdPath
+		header.FileColdPath = coldStatus.FileColdPath
+	}
+	return
+}
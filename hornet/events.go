@@ -0,0 +1,155 @@
+/*
+* events.go
+*
+* pipeline events are alert messages that hornet publishes as files pass through the pipeline, so that
+* dashboards and the run database can follow the flow of data in real time.
+*
+* Events are enabled with amqp.events; each is published with the routing key [routing-key].[event],
+* unless another routing key is given for it (an empty routing key turns the event off), e.g.
+*    "events": {
+*        "active": true,
+*        "routing-key": "hornet_events",
+*        "routing-keys": {"shipped": "run_db.file_shipped", "job-started": ""}
+*    }
+* The payload includes the event name, the file's information (in "file") and details of the event.
+ */
+
+package hornet
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+// PipelineEvent is a stage transition of a file
+type PipelineEvent string
+
+const (
+	EventClassified  PipelineEvent = "classified"
+	EventRegistered  PipelineEvent = "registered"
+	EventMoved       PipelineEvent = "moved"
+	EventJobStarted  PipelineEvent = "job-started"
+	EventJobFinished PipelineEvent = "job-finished"
+	EventShipped     PipelineEvent = "shipped"
+	EventFailed      PipelineEvent = "failed"
+)
+
+var pipelineEventNames = []PipelineEvent{EventClassified, EventRegistered, EventMoved, EventJobStarted, EventJobFinished, EventShipped, EventFailed}
+
+// routing keys of the events that are published; nil if events are not in use
+var eventRoutingKeys map[PipelineEvent]string
+
+// ValidateEventsConfig checks the events section of the AMQP configuration
+func ValidateEventsConfig() (e error) {
+	if viper.GetBool("amqp.events.active") == false {
+		return
+	}
+	if viper.GetString("amqp.events.routing-key") == "" {
+		e = fmt.Errorf("The routing key for pipeline events is not set (amqp.events.routing-key)")
+		Log.Error(e.Error())
+	}
+	known := make(map[string]bool)
+	for _, event := range pipelineEventNames {
+		known[string(event)] = true
+	}
+	for name := range viper.GetStringMapString("amqp.events.routing-keys") {
+		if !known[name] {
+			e = fmt.Errorf("Unknown pipeline event in amqp.events.routing-keys: <%s>", name)
+			Log.Error(e.Error())
+		}
+	}
+	return
+}
+
+// ConfigurePipelineEvents sets up the routing keys of the events; it's called by the scheduler before any files are processed
+func ConfigurePipelineEvents() {
+	eventRoutingKeys = nil
+	if viper.GetBool("amqp.active") == false || viper.GetBool("amqp.events.active") == false {
+		return
+	}
+	prefix := viper.GetString("amqp.events.routing-key")
+	overrides := viper.GetStringMapString("amqp.events.routing-keys")
+	eventRoutingKeys = make(map[PipelineEvent]string)
+	for _, event := range pipelineEventNames {
+		routingKey, hasOverride := overrides[string(event)]
+		if !hasOverride {
+			routingKey = prefix + TargetSeparator + string(event)
+		}
+		if routingKey != "" {
+			eventRoutingKeys[event] = routingKey
+		}
+	}
+	Log.Infof("Pipeline events will be published: %v", eventRoutingKeys)
+}
+
+// PublishEvent sends an alert for a file's stage transition, with the given details in the payload.
+// The pipeline doesn't wait for the AMQP sender: the event is dropped if the send-message queue is full.
+func PublishEvent(event PipelineEvent, header FileInfo, details map[string]interface{}) {
+	routingKey, isPublished := eventRoutingKeys[event]
+	if !isPublished || !AmqpSenderIsActive.Load() {
+		return
+	}
+	payload := map[string]interface{}{
+		"event": string(event),
+		"file":  fileInfoPayload(header),
+	}
+	for key, value := range details {
+		payload[key] = value
+	}
+	message := PrepareAlert([]string{routingKey}, "application/json")
+	message.Payload = payload
+	// events may have no listeners, so they're not returned if they can't be routed
+	message.AllowUnroutable = true
+	select {
+	case SendMessageQueue <- message:
+	default:
+		Log.Warningf("Unable to publish the %s event for <%s>; the send-message queue is full", event, header.Filename)
+	}
+}
+
+// fileInfoPayload gives the information about a file for a message payload
+func fileInfoPayload(header FileInfo) map[string]interface{} {
+	metadata := make(map[string]interface{}, len(header.Metadata))
+	for key, value := range header.Metadata {
+		metadata[key] = value
+	}
+	payload := map[string]interface{}{
+		"file_name":      header.Filename,
+		"file_type":      header.FileType,
+		"file_hash":      header.FileHash,
+		"sub_path":       header.SubPath,
+		"file_hot_path":  header.FileHotPath,
+		"file_warm_path": header.FileWarmPath,
+		"file_cold_path": header.FileColdPath,
+		"priority":       header.Priority,
+		"metadata":       metadata,
+	}
+	if header.DatabaseID != "" {
+		payload["database_id"] = header.DatabaseID
+	}
+	if len(header.Shipments) > 0 {
+		names := make([]string, 0, len(header.Shipments))
+		for name := range header.Shipments {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		shipments := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			status := header.Shipments[name]
+			shipment := map[string]interface{}{
+				"destination":    name,
+				"required":       status.Required,
+				"shipped":        status.Shipped,
+				"file_cold_path": status.FileColdPath,
+			}
+			if status.Err != "" {
+				shipment["error"] = status.Err
+			}
+			shipments = append(shipments, shipment)
+		}
+		payload["shipments"] = shipments
+	}
+	return payload
+}
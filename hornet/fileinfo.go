@@ -7,6 +7,8 @@
 package hornet
 
 import (
+	"path/filepath"
+	"sync"
 	"text/template"
 )
 
@@ -30,8 +32,49 @@ type FileInfo struct {
 	FileColdPath string
 	JobQueue     chan Job
 	FinishedJobs []Job
+	Metadata     map[string]string
+	Priority     int
+	// size in bytes, when the file was classified
+	Size int64
+	// ID given to the file by the run database when it's registered (see registration.go)
+	DatabaseID string
+	// status of the shipment to each destination, by destination name; set once shipping is complete
+	Shipments map[string]ShipmentStatus
 }
 
 // Base paths are special locations on top of which a file system exists
 // These are defined in the classifier config; if a watcher is in use, its path is added to this
+// Access from running threads should go through the BasePaths functions, which are protected by basePathsMutex
 var BasePaths []string
+var basePathsMutex sync.RWMutex
+
+// AddBasePath adds a path to the front of the list of base paths, if it's not already present.
+// Paths added while hornet is running (e.g. new watch directories) take precedence over the configured base paths.
+// It returns false if the path was already present.
+func AddBasePath(path string) bool {
+	absPath, _ := filepath.Abs(path)
+	basePathsMutex.Lock()
+	defer basePathsMutex.Unlock()
+	for _, basePath := range BasePaths {
+		if basePath == absPath {
+			return false
+		}
+	}
+	BasePaths = append([]string{absPath}, BasePaths...)
+	Log.Infof("Base paths: %v", BasePaths)
+	return true
+}
+
+// RemoveBasePath removes a path from the list of base paths
+func RemoveBasePath(path string) {
+	absPath, _ := filepath.Abs(path)
+	basePathsMutex.Lock()
+	defer basePathsMutex.Unlock()
+	for iPath, basePath := range BasePaths {
+		if basePath == absPath {
+			BasePaths = append(BasePaths[:iPath], BasePaths[iPath+1:]...)
+			break
+		}
+	}
+	Log.Infof("Base paths: %v", BasePaths)
+}
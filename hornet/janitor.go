@@ -0,0 +1,338 @@
+/*
+* janitor.go
+*
+* the janitor removes files from hot and warm storage once their downstream copies are safely in place.
+*
+* Hot files are removed:
+*    - after they've been shipped, if the source policy is delete-after-ship;
+*    - once they're older than the maximum age, if the source policy is delete-after-age;
+*    - oldest first, when the hot storage is over its quota.
+* Warm files are removed once they're older than the maximum age, or oldest first when the warm storage is over its quota.
+*
+* A hot file is only removed if its warm copy exists (and, for delete-after-ship, its cold copy);
+* a warm file is only removed if its cold copy exists.
+ */
+
+package hornet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// SourcePolicy specifies what happens to the original (hot) file once it has been copied to warm storage
+type SourcePolicy uint
+
+const (
+	// SourceDelete removes the hot file as soon as it has been copied to warm storage
+	SourceDelete SourcePolicy = iota
+	// SourceKeep leaves the hot file in place
+	SourceKeep
+	// SourceDeleteAfterShip removes the hot file once it has been shipped to cold storage
+	SourceDeleteAfterShip
+	// SourceDeleteAfterAge removes the hot file once it's older than the janitor's hot-max-age
+	SourceDeleteAfterAge
+)
+
+var sourcePolicyNames = map[string]SourcePolicy{
+	"delete":            SourceDelete,
+	"keep":              SourceKeep,
+	"delete-after-ship": SourceDeleteAfterShip,
+	"delete-after-age":  SourceDeleteAfterAge,
+}
+
+// GetSourcePolicy returns the source policy from the mover configuration; the default is delete
+func GetSourcePolicy() (policy SourcePolicy, e error) {
+	if viper.IsSet("mover.source-policy") == false {
+		return
+	}
+	policyName := viper.GetString("mover.source-policy")
+	policy, isValid := sourcePolicyNames[policyName]
+	if !isValid {
+		e = fmt.Errorf("Invalid source policy: <%s>", policyName)
+	}
+	return
+}
+
+// JanitorIsNeeded returns true if the janitor should run, either because it's been activated,
+// or because the source policy relies on it
+func JanitorIsNeeded() bool {
+	policy, _ := GetSourcePolicy()
+	return viper.GetBool("janitor.active") || policy == SourceDeleteAfterShip || policy == SourceDeleteAfterAge
+}
+
+// Queue for hot files to be removed now that they've been shipped (for the delete-after-ship policy); nil if the janitor is not in use
+var janitorShippedQueue chan FileInfo
+
+// ValidateJanitorConfig checks the sanity of the janitor configuration.
+// It makes the following guarantees
+//   1) The source policy is valid
+//   2) The delete-after-ship policy is only used if the shipper is active
+//   3) The delete-after-age policy has a maximum age for hot files
+//   4) The quotas are valid sizes
+//   5) Warm files are only cleaned up if the shipper is active
+func ValidateJanitorConfig() (e error) {
+	policy, policyErr := GetSourcePolicy()
+	if policyErr != nil {
+		e = policyErr
+		Log.Error(e.Error())
+	}
+
+	shipperIsActive := viper.GetBool("shipper.active")
+	if policy == SourceDeleteAfterShip && !shipperIsActive {
+		e = errors.New("The delete-after-ship source policy requires the shipper to be active")
+		Log.Error(e.Error())
+	}
+
+	if policy == SourceDeleteAfterAge && viper.GetDuration("janitor.hot-max-age") <= 0 {
+		e = errors.New("The delete-after-age source policy requires a maximum age for hot files (janitor.hot-max-age)")
+		Log.Error(e.Error())
+	} else if policy != SourceDeleteAfterAge && viper.IsSet("janitor.hot-max-age") {
+		Log.Warning("The maximum age for hot files is only used with the delete-after-age source policy")
+	}
+
+	hotQuota, quotaErr := GetConfigSizeInBytes("janitor.hot-quota")
+	if quotaErr != nil {
+		e = quotaErr
+		Log.Error(e.Error())
+	}
+	if (viper.GetDuration("janitor.hot-max-age") > 0 || hotQuota > 0) && !viper.GetBool("watcher.active") {
+		Log.Warning("The hot storage (the watched directories) is only checked by the janitor if the watcher is active")
+	}
+	warmQuota, quotaErr := GetConfigSizeInBytes("janitor.warm-quota")
+	if quotaErr != nil {
+		e = quotaErr
+		Log.Error(e.Error())
+	}
+
+	if (viper.GetDuration("janitor.warm-max-age") > 0 || warmQuota > 0) && !shipperIsActive {
+		e = errors.New("Warm files can only be cleaned up if the shipper is active")
+		Log.Error(e.Error())
+	}
+
+	return
+}
+
+// janitorFile is a file that's a candidate for removal
+type janitorFile struct {
+	path    string
+	subPath string
+	size    int64
+	modTime time.Time
+}
+
+// listFiles returns the regular files in a set of directory trees, oldest first, along with their total size.
+// The sub-path of each file is determined by the subPath function from the directory containing it.
+func listFiles(baseDirs []string, subPath func(dir string) string) (files []janitorFile, totalSize int64) {
+	for _, baseDir := range baseDirs {
+		walkErr := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// a file may have been removed while walking; carry on with the rest
+				return nil
+			}
+			if info.Mode().IsRegular() == false || strings.HasSuffix(path, ".hmtemp") {
+				return nil
+			}
+			files = append(files, janitorFile{
+				path:    path,
+				subPath: subPath(filepath.Dir(path)),
+				size:    info.Size(),
+				modTime: info.ModTime(),
+			})
+			totalSize += info.Size()
+			return nil
+		})
+		if walkErr != nil {
+			Log.Warningf("Error while listing the files in %s: %v", baseDir, walkErr)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	return
+}
+
+// cleanUp removes the files that are older than the maximum age, and then the oldest files until the total size is within the quota.
+// A maximum age or quota of 0 means there's no limit.  Files are only removed if hasCopies returns true.
+func cleanUp(area string, files []janitorFile, totalSize int64, maxAge time.Duration, quota int64, hasCopies func(file janitorFile) (bool, error)) {
+	now := time.Now()
+	nRemoved := 0
+	for _, file := range files {
+		tooOld := maxAge > 0 && now.Sub(file.modTime) > maxAge
+		overQuota := quota > 0 && totalSize > quota
+		if !tooOld && !overQuota {
+			// files are ordered by age, so none of the remaining files are too old
+			break
+		}
+		copiesExist, checkErr := hasCopies(file)
+		if checkErr != nil {
+			Log.Warningf("Unable to verify the downstream copies of <%s>; it will not be removed: %v", file.path, checkErr)
+			continue
+		}
+		if !copiesExist {
+			Log.Debugf("The downstream copies of <%s> are not present; it will not be removed", file.path)
+			continue
+		}
+		if rmErr := Remove(file.path); rmErr != nil {
+			continue
+		}
+		Log.Infof("Removed %s file <%s> (modified %v)", area, file.path, file.modTime)
+		totalSize -= file.size
+		nRemoved++
+	}
+	if nRemoved > 0 {
+		Log.Noticef("Janitor removed %d %s file(s)", nRemoved, area)
+	}
+	if quota > 0 && totalSize > quota {
+		Log.Warningf("The %s storage is over its quota (%d bytes used; %d allowed), but no more files can be removed", area, totalSize, quota)
+	}
+}
+
+// warmCopyExists checks whether the warm copy of a hot file is present and has the same size
+func warmCopyExists(warmDirBase, subPath, filename string, size int64) (bool, error) {
+	fileInfo, statErr := os.Stat(filepath.Join(warmDirBase, subPath, filename))
+	if os.IsNotExist(statErr) {
+		return false, nil
+	}
+	if statErr != nil {
+		return false, statErr
+	}
+	return fileInfo.Mode().IsRegular() && fileInfo.Size() == size, nil
+}
+
+// Janitor is a goroutine that removes hot and warm files according to the source policy and the janitor configuration.
+// Hot files that have been shipped are received from the scheduler on the shipped queue (for the delete-after-ship policy);
+// the hot and warm storage are checked periodically for files that are too old or over the quotas.
+func Janitor(shippedQueue chan FileInfo, ctrlQueue, reqQueue chan ControlMessage, poolCount *sync.WaitGroup) {
+	// decrement the wg counter at the end
+	defer poolCount.Done()
+	defer Log.Info("Janitor is finished.")
+
+	if configErr := ValidateJanitorConfig(); configErr != nil {
+		Log.Criticalf("Error in the janitor configuration: %s", configErr.Error())
+		reqQueue <- ThreadCannotContinue
+		return
+	}
+
+	policy, _ := GetSourcePolicy()
+	shipperIsActive := viper.GetBool("shipper.active")
+
+	warmDirBase, dirErr := filepath.Abs(viper.GetString("mover.dest-dir"))
+	if dirErr != nil {
+		Log.Criticalf("Warm-storage directory is not valid: <%v>", viper.GetString("mover.dest-dir"))
+		reqQueue <- ThreadCannotContinue
+		return
+	}
+
+	interval := 10 * time.Minute
+	if viper.IsSet("janitor.interval") {
+		interval = viper.GetDuration("janitor.interval")
+	}
+	var hotMaxAge time.Duration
+	if policy == SourceDeleteAfterAge {
+		hotMaxAge = viper.GetDuration("janitor.hot-max-age")
+	}
+	// the quotas have been validated already
+	hotQuota, _ := GetConfigSizeInBytes("janitor.hot-quota")
+	warmMaxAge := viper.GetDuration("janitor.warm-max-age")
+	warmQuota, _ := GetConfigSizeInBytes("janitor.warm-quota")
+	Log.Debugf("Janitor interval: %v; hot storage: max. age %v, quota %d bytes; warm storage: max. age %v, quota %d bytes", interval, hotMaxAge, hotQuota, warmMaxAge, warmQuota)
+
+	// hot files need a warm copy, and also a cold copy if they're only to be removed once shipped
+	hotFileHasCopies := func(file janitorFile) (bool, error) {
+		filename := filepath.Base(file.path)
+		if hasWarm, warmErr := warmCopyExists(warmDirBase, file.subPath, filename, file.size); !hasWarm || warmErr != nil {
+			return hasWarm, warmErr
+		}
+		if policy == SourceDeleteAfterShip {
+			return ColdCopyExists(file.subPath, filename, file.size)
+		}
+		return true, nil
+	}
+	warmFileHasCopies := func(file janitorFile) (bool, error) {
+		return ColdCopyExists(file.subPath, filepath.Base(file.path), file.size)
+	}
+
+	checkStorage := func() {
+		if hotMaxAge > 0 || hotQuota > 0 {
+			// the hot storage is the set of watched directories (not the other base paths); nested directories are only listed once
+			watchDirs, watchErr := ModifyWatchDirs(WatcherListDirs, nil)
+			if watchErr != nil {
+				Log.Warningf("Unable to get the watch directories; the hot storage will not be checked: %v", watchErr)
+			} else {
+				var hotDirs []string
+				for iDir, watchDir := range watchDirs {
+					others := append(append([]string{}, watchDirs[:iDir]...), watchDirs[iDir+1:]...)
+					if !isWithinWatchDirs(watchDir, others) {
+						hotDirs = append(hotDirs, watchDir)
+					}
+				}
+				// sub-paths are determined as they are by the classifier
+				files, totalSize := listFiles(hotDirs, getSubPath)
+				cleanUp("hot", files, totalSize, hotMaxAge, hotQuota, hotFileHasCopies)
+			}
+		}
+		if shipperIsActive && (warmMaxAge > 0 || warmQuota > 0) {
+			files, totalSize := listFiles([]string{warmDirBase}, func(dir string) string {
+				subPath, _ := filepath.Rel(warmDirBase, dir)
+				return subPath
+			})
+			cleanUp("warm", files, totalSize, warmMaxAge, warmQuota, warmFileHasCopies)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	Log.Info("Janitor started successfully")
+
+janitorLoop:
+	for {
+		select {
+		case controlMsg, queueOk := <-ctrlQueue:
+			if !queueOk {
+				Log.Error("Control queue has closed unexpectedly")
+				break janitorLoop
+			}
+			if controlMsg == StopExecution {
+				Log.Info("Janitor stopping on interrupt.")
+				break janitorLoop
+			}
+		case fileHeader, queueOk := <-shippedQueue:
+			if !queueOk {
+				Log.Error("Janitor queue has closed unexpectedly")
+				reqQueue <- StopExecution
+				break janitorLoop
+			}
+			fileInfo, statErr := os.Stat(fileHeader.FileHotPath)
+			if statErr != nil {
+				Log.Warningf("Unable to get file information on hot file <%s>: %v", fileHeader.FileHotPath, statErr)
+				continue janitorLoop
+			}
+			copiesExist, checkErr := hotFileHasCopies(janitorFile{
+				path:    fileHeader.FileHotPath,
+				subPath: fileHeader.SubPath,
+				size:    fileInfo.Size(),
+				modTime: fileInfo.ModTime(),
+			})
+			switch {
+			case checkErr != nil:
+				Log.Warningf("Unable to verify the downstream copies of <%s>; it will not be removed: %v", fileHeader.FileHotPath, checkErr)
+			case !copiesExist:
+				Log.Warningf("The downstream copies of <%s> are not present; it will not be removed", fileHeader.FileHotPath)
+			default:
+				if rmErr := Remove(fileHeader.FileHotPath); rmErr == nil {
+					Log.Infof("Removed shipped hot file <%s>", fileHeader.FileHotPath)
+				}
+			}
+		case <-ticker.C:
+			checkStorage()
+		} // select
+	} // for
+}
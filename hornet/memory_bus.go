@@ -0,0 +1,154 @@
+/*
+* memory_bus.go
+*
+* an in-memory message bus, which routes messages between queues within the process, like an AMQP topic exchange.
+*
+* It's used for tests and offline runs, when there's no broker: hornet's receiver and sender work as they
+* would with AMQP, and other services can be stood in for by subscribing queues and publishing messages, e.g.
+*    bus := hornet.NewMemoryBus()
+*    replies := bus.Subscribe("client", "client")
+*    bus.Publish(hornet.BusMessage{RoutingKey: "hornet.status", ContentEncoding: "application/json", ReplyTo: "client", Body: body})
+ */
+
+package hornet
+
+import (
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// number of messages that each queue holds before further messages are dropped
+const memoryQueueSize = 1000
+
+type memoryQueue struct {
+	bindings []string
+	messages chan BusMessage
+}
+
+// MemoryBus is a message bus that routes messages within the process
+type MemoryBus struct {
+	mutex  sync.Mutex
+	queues map[string]*memoryQueue
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{queues: make(map[string]*memoryQueue)}
+}
+
+func (b *MemoryBus) Name() string {
+	return "in-memory bus"
+}
+
+// Subscribe creates a queue (if it doesn't already exist), binds it to the routing-key patterns, and returns its messages
+func (b *MemoryBus) Subscribe(queueName string, bindings ...string) <-chan BusMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	queue, exists := b.queues[queueName]
+	if !exists {
+		queue = &memoryQueue{messages: make(chan BusMessage, memoryQueueSize)}
+		b.queues[queueName] = queue
+	}
+	queue.bindings = append(queue.bindings, bindings...)
+	return queue.messages
+}
+
+// Unsubscribe deletes a queue; messages still in the queue are dropped
+func (b *MemoryBus) Unsubscribe(queueName string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.queues, queueName)
+}
+
+// Publish passes a message to each queue with a binding that matches its routing key, and returns the number of queues that received it.
+// The publisher never waits: if a queue is full, the message is dropped for that queue.
+func (b *MemoryBus) Publish(message BusMessage) (nRouted int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for queueName, queue := range b.queues {
+		for _, binding := range queue.bindings {
+			if !topicMatches(binding, message.RoutingKey) {
+				continue
+			}
+			select {
+			case queue.messages <- message:
+				nRouted++
+			default:
+				Log.Warningf("In-memory queue <%s> is full; the message to <%s> was dropped", queueName, message.RoutingKey)
+			}
+			break
+		}
+	}
+	return
+}
+
+// RunReceiver passes the messages for hornet's queue to the handler
+func (b *MemoryBus) RunReceiver(queueName string, bindings []string, handle func(BusMessage), ctrlQueue, reqQueue chan ControlMessage) {
+	messages := b.Subscribe(queueName, bindings...)
+	defer b.Unsubscribe(queueName)
+
+	Log.Info("In-memory receiver started successfully")
+	AmqpReceiverIsActive.Store(true)
+	defer func() { AmqpReceiverIsActive.Store(false) }()
+
+	for {
+		select {
+		case controlMsg, queueOk := <-ctrlQueue:
+			if !queueOk {
+				Log.Error("Control queue has closed unexpectedly")
+				return
+			}
+			if controlMsg == StopExecution {
+				Log.Info("In-memory receiver stopping on interrupt.")
+				return
+			}
+		case message := <-messages:
+			handle(message)
+		}
+	}
+}
+
+// RunSender publishes the outgoing messages on the bus.
+// As with AMQP (with amqp.mandatory), a message that can't be routed to any queue is reported as returned.
+func (b *MemoryBus) RunSender(outgoing <-chan P8Message, ctrlQueue, reqQueue chan ControlMessage) {
+	mandatory := true
+	if viper.IsSet("amqp.mandatory") {
+		mandatory = viper.GetBool("amqp.mandatory")
+	}
+
+	Log.Info("In-memory sender started successfully")
+	AmqpSenderIsActive.Store(true)
+	defer func() { AmqpSenderIsActive.Store(false) }()
+
+	for {
+		select {
+		case controlMsg, queueOk := <-ctrlQueue:
+			if !queueOk {
+				Log.Error("Control queue has closed unexpectedly")
+				return
+			}
+			if controlMsg == StopExecution {
+				Log.Info("In-memory sender stopping on interrupt.")
+				return
+			}
+		case p8Message, queueOk := <-outgoing:
+			if !queueOk {
+				Log.Error("Send-message queue has closed")
+				reqQueue <- StopExecution
+				return
+			}
+			message, prepErr := prepareBusMessage(p8Message)
+			if prepErr != nil {
+				Log.Error(prepErr.Error())
+				continue
+			}
+			Log.Debugf("Sending message to routing key <%s>", message.RoutingKey)
+			if b.Publish(message) == 0 && mandatory && !message.AllowUnroutable {
+				Log.Errorf("Message to <%s> could not be routed to any queue", message.RoutingKey)
+				reportDelivery(message, RCErrAmqpRoutingKey, "The message was returned: no queue is bound to its routing key")
+				continue
+			}
+			reportDelivery(message, RCSuccess, "The message was delivered")
+		}
+	}
+}
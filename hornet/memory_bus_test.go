@@ -0,0 +1,195 @@
+package hornet
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// startTestBus starts hornet's receiver and sender on an in-memory bus, with "hornet" as hornet's queue.
+// The configuration is set before they start.  The returned function stops them.
+func startTestBus(t *testing.T, config map[string]interface{}) (bus *MemoryBus, stop func()) {
+	t.Helper()
+	viper.Reset()
+	viper.Set("amqp.queue", "hornet")
+	for key, value := range config {
+		viper.Set(key, value)
+	}
+	bus = NewMemoryBus()
+	ctrlQueue := make(chan ControlMessage, 2)
+	reqQueue := make(chan ControlMessage, 10)
+	threadCountQueue := make(chan uint, 10)
+	var poolCount sync.WaitGroup
+	if startErr := StartMessageBus(bus, ctrlQueue, reqQueue, threadCountQueue, &poolCount); startErr != nil {
+		t.Fatal(startErr)
+	}
+	for start := time.Now(); !AmqpSenderIsActive.Load() || !AmqpReceiverIsActive.Load(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("The in-memory receiver and sender did not start")
+		}
+	}
+	stop = func() {
+		ctrlQueue <- StopExecution
+		ctrlQueue <- StopExecution
+		poolCount.Wait()
+		viper.Reset()
+	}
+	return
+}
+
+// publishTestMessage encodes a message and publishes it on the bus, as another service would
+func publishTestMessage(t *testing.T, bus *MemoryBus, message P8Message, replyTo string) {
+	t.Helper()
+	body, encodeErr := encodeP8Message(message)
+	if encodeErr != nil {
+		t.Fatal(encodeErr)
+	}
+	bus.Publish(BusMessage{
+		RoutingKey:      message.Target[0],
+		ContentEncoding: message.Encoding,
+		CorrelationId:   message.CorrId,
+		ReplyTo:         replyTo,
+		Body:            body,
+	})
+}
+
+// receiveTestMessage waits for a message on a queue, and decodes it
+func receiveTestMessage(t *testing.T, messages <-chan BusMessage) P8Message {
+	t.Helper()
+	select {
+	case message := <-messages:
+		p8Message, decodeErr := decodeP8Message(message)
+		if decodeErr != nil {
+			t.Fatal(decodeErr)
+		}
+		return p8Message
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message was received")
+	}
+	return P8Message{}
+}
+
+func TestMemoryBusRequest(t *testing.T) {
+	bus, stop := startTestBus(t, nil)
+	defer stop()
+	replies := bus.Subscribe("client", "client")
+
+	tests := []struct {
+		target          string
+		msgOp           MsgCodeT
+		payload         interface{}
+		expectedRetCode MsgCodeT
+		expectedKey     string
+	}{
+		{"hornet.status", MOGet, nil, RCSuccess, "components"},
+		{"hornet.files", MOGet, nil, RCSuccess, "files"},
+		{"hornet.pause", MOCommand, map[string]interface{}{}, RCErrBadPayload, ""},
+		{"hornet.no-such-target", MOGet, nil, RCErrInvalidKey, ""},
+		// requests with the wrong operation aren't executed
+		{"hornet.status", MOCommand, nil, RCErrInvalidMethod, ""},
+		{"hornet.schedule", MOGet, map[string]interface{}{"values": []string{"/data/file.egg"}}, RCErrInvalidMethod, ""},
+	}
+	for iTest, test := range tests {
+		request := PrepareRequest([]string{test.target}, "application/json", test.msgOp, nil)
+		request.CorrId = fmt.Sprintf("corr-%d", iTest)
+		request.Payload = test.payload
+		publishTestMessage(t, bus, request, "client")
+
+		reply := receiveTestMessage(t, replies)
+		if reply.MsgType != MTReply || reply.CorrId != request.CorrId {
+			t.Errorf("<%s>: got message type %d with correlation ID %q; expected a reply with %q", test.target, reply.MsgType, reply.CorrId, request.CorrId)
+		}
+		if reply.RetCode != test.expectedRetCode {
+			t.Errorf("<%s>: got return code %d (%s); expected %d", test.target, reply.RetCode, reply.RetMsg, test.expectedRetCode)
+		}
+		if test.expectedKey != "" {
+			if _, hasKey := GetPayloadValue(reply.Payload, test.expectedKey); !hasKey {
+				t.Errorf("<%s>: the reply payload has no <%s>: %v", test.target, test.expectedKey, reply.Payload)
+			}
+		}
+	}
+}
+
+// TestMemoryBusRegistration registers a file with a stand-in run database, which fails the first attempt
+// with a retriable error, and acknowledges the second with the file's ID
+func TestMemoryBusRegistration(t *testing.T) {
+	bus, stop := startTestBus(t, map[string]interface{}{
+		"registration.active":       true,
+		"registration.send-to":      "run_db",
+		"registration.timeout":      "2s",
+		"registration.retry-delay":  "10ms",
+		"registration.max-attempts": 3,
+	})
+	defer stop()
+
+	// the run database replies to each request in turn with these return codes
+	retCodes := []MsgCodeT{RCErrResourceConnection, RCSuccess}
+	requests := make(chan P8Message, len(retCodes))
+	runDB := bus.Subscribe("run_db", "run_db")
+	go func() {
+		for _, retCode := range retCodes {
+			message := <-runDB
+			request, decodeErr := decodeP8Message(message)
+			if decodeErr != nil {
+				t.Error(decodeErr)
+				return
+			}
+			requests <- request
+			reply := PrepareReply([]string{message.ReplyTo}, request.Encoding, request.CorrId, retCode, "", nil)
+			if retCode == RCSuccess {
+				reply.Payload = map[string]interface{}{"file_id": 42}
+			}
+			publishTestMessage(t, bus, reply, "")
+		}
+	}()
+
+	var poolCount sync.WaitGroup
+	context := OperatorContext{
+		FileStream: make(chan FileInfo, 1),
+		RetStream:  make(chan OperatorReturn, 1),
+		CtrlQueue:  make(chan ControlMessage, 1),
+		ReqQueue:   make(chan ControlMessage, 1),
+		PoolCount:  &poolCount,
+	}
+	poolCount.Add(1)
+	go Registrar(context, 0)
+	defer func() {
+		context.CtrlQueue <- StopExecution
+		poolCount.Wait()
+	}()
+
+	context.FileStream <- FileInfo{
+		Filename: "run12_file.egg",
+		FileType: "egg",
+		FileHash: "dc5e29010b13215bbf8cfc6997f15489",
+		// metadata can't replace the values set by hornet
+		Metadata: map[string]string{"run_id": "12", "file_name": "other.egg", "values": "do_delete"},
+	}
+	var opReturn OperatorReturn
+	select {
+	case opReturn = <-context.RetStream:
+	case controlMsg := <-context.ReqQueue:
+		t.Fatalf("The registrar stopped (%v)", controlMsg)
+	case <-time.After(10 * time.Second):
+		t.Fatal("The file was not returned by the registrar")
+	}
+	if opReturn.Err != nil || opReturn.FHeader.DatabaseID != "42" {
+		t.Errorf("Got error %v and database ID %q; expected no error and ID 42", opReturn.Err, opReturn.FHeader.DatabaseID)
+	}
+
+	if len(requests) != len(retCodes) {
+		t.Fatalf("The run database received %d request(s); expected %d", len(requests), len(retCodes))
+	}
+	request := <-requests
+	if values, _ := GetPayloadValue(request.Payload, "values"); len(ConvertToStringSlice(values)) != 1 || ConvertToStringSlice(values)[0] != "do_insert" {
+		t.Errorf("The request values are %v; expected [do_insert]", values)
+	}
+	for key, expected := range map[string]string{"file_name": "run12_file.egg", "file_type": "egg", "run_id": "12"} {
+		if value, _ := GetPayloadValue(request.Payload, key); ConvertToString(value) != expected {
+			t.Errorf("The request's <%s> is %v; expected %s", key, value, expected)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+/*
+* message.go
+*
+* the schema of Project 8 wire-protocol messages, and its validation.
+*
+* Every message has a message type (msgtype), a timestamp and the sender's information (sender_info).
+* Requests also need a message operation (msgop), and replies a return code (retcode).  The specifier,
+* lockout key, return message and payload are optional.  Messages are decoded from JSON and msgpack into
+* the same structure: maps have string keys, strings are strings (not byte slices), and integers are int64.
+ */
+
+package hornet
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// MessageError is a problem with a received message; the return code can be used to reply to the sender
+type MessageError struct {
+	RetCode MsgCodeT
+	Msg     string
+}
+
+func (e MessageError) Error() string {
+	return fmt.Sprintf("Invalid message (%d): %s", e.RetCode, e.Msg)
+}
+
+// parseP8Message validates a decoded message body, and fills a P8Message with its contents.
+// If the message type could be determined, it's set in the P8Message even if there's an error.
+func parseP8Message(body map[string]interface{}) (p8Message P8Message, e error) {
+	body = normalizeMessageValue(body).(map[string]interface{})
+
+	var missing, invalid []string
+	if msgTypeIfc, hasMsgType := body["msgtype"]; !hasMsgType {
+		missing = append(missing, "msgtype")
+	} else if msgType, isCode := messageCode(msgTypeIfc); !isCode {
+		invalid = append(invalid, "msgtype")
+	} else {
+		switch msgType {
+		case MTReply, MTRequest, MTAlert, MTInfo:
+			p8Message.MsgType = msgType
+		default:
+			e = MessageError{RCErrInvalidValue, fmt.Sprintf("Unknown message type: %d", msgType)}
+			return
+		}
+	}
+
+	if timestampIfc, hasTimestamp := body["timestamp"]; !hasTimestamp {
+		missing = append(missing, "timestamp")
+	} else if timestamp, isString := timestampIfc.(string); !isString {
+		invalid = append(invalid, "timestamp")
+	} else {
+		p8Message.TimeStamp = timestamp
+	}
+
+	if senderInfoIfc, hasSenderInfo := body["sender_info"]; !hasSenderInfo {
+		missing = append(missing, "sender_info")
+	} else if senderInfo, isMap := senderInfoIfc.(map[string]interface{}); !isMap {
+		invalid = append(invalid, "sender_info")
+	} else {
+		fields := map[string]*string{
+			"package":  &p8Message.SenderInfo.Package,
+			"exe":      &p8Message.SenderInfo.Exe,
+			"version":  &p8Message.SenderInfo.Version,
+			"commit":   &p8Message.SenderInfo.Commit,
+			"hostname": &p8Message.SenderInfo.Hostname,
+			"username": &p8Message.SenderInfo.Username,
+		}
+		for key, field := range fields {
+			if valueIfc, hasValue := senderInfo[key]; hasValue && valueIfc != nil {
+				if value, isString := valueIfc.(string); isString {
+					*field = value
+				} else {
+					invalid = append(invalid, "sender_info."+key)
+				}
+			}
+		}
+	}
+
+	// the message operation is required for requests, and the return code for replies
+	if msgOpIfc, hasMsgOp := body["msgop"]; !hasMsgOp {
+		if p8Message.MsgType == MTRequest {
+			missing = append(missing, "msgop")
+		}
+	} else if msgOp, isCode := messageCode(msgOpIfc); !isCode {
+		invalid = append(invalid, "msgop")
+	} else {
+		p8Message.MsgOp = msgOp
+	}
+	if retCodeIfc, hasRetCode := body["retcode"]; !hasRetCode {
+		if p8Message.MsgType == MTReply {
+			missing = append(missing, "retcode")
+		}
+	} else if retCode, isCode := messageCode(retCodeIfc); !isCode {
+		invalid = append(invalid, "retcode")
+	} else {
+		p8Message.RetCode = retCode
+	}
+
+	optionalStrings := map[string]*string{
+		"return_msg":  &p8Message.RetMsg,
+		"specifier":   &p8Message.Specifier,
+		"lockout_key": &p8Message.LockoutKey,
+	}
+	for key, field := range optionalStrings {
+		if valueIfc, hasValue := body[key]; hasValue && valueIfc != nil {
+			if value, isString := valueIfc.(string); isString {
+				*field = value
+			} else {
+				invalid = append(invalid, key)
+			}
+		}
+	}
+
+	p8Message.Payload = body["payload"]
+
+	if len(missing) > 0 || len(invalid) > 0 {
+		var problems []string
+		if len(missing) > 0 {
+			problems = append(problems, "missing required element(s): "+strings.Join(missing, ", "))
+		}
+		if len(invalid) > 0 {
+			sort.Strings(invalid)
+			problems = append(problems, "invalid element(s): "+strings.Join(invalid, ", "))
+		}
+		e = MessageError{RCErrDecodingFail, "Message has " + strings.Join(problems, "; ")}
+		return
+	}
+
+	if p8Message.MsgType == MTRequest {
+		switch p8Message.MsgOp {
+		case MOSet, MOGet, MOConfig, MOSend, MORun, MOCommand:
+		default:
+			e = MessageError{RCErrInvalidMethod, fmt.Sprintf("Unknown message operation: %d", p8Message.MsgOp)}
+			return
+		}
+	}
+	return
+}
+
+// messageCode converts a decoded message code (message type, operation or return code) to a MsgCodeT
+func messageCode(codeIfc interface{}) (code MsgCodeT, isCode bool) {
+	switch typedCode := codeIfc.(type) {
+	case int64:
+		if typedCode >= 0 {
+			return MsgCodeT(typedCode), true
+		}
+	case uint64:
+		return MsgCodeT(typedCode), true
+	case float64:
+		// some JSON encoders give integers as floating-point numbers
+		if typedCode >= 0 && typedCode == math.Trunc(typedCode) {
+			return MsgCodeT(typedCode), true
+		}
+	}
+	return
+}
+
+// normalizeMessageValue converts a decoded value, so that JSON- and msgpack-encoded messages give the same types:
+// maps have string keys, byte slices become strings, and integers become int64 (unless they're too large)
+func normalizeMessageValue(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(typedValue))
+		for key, item := range typedValue {
+			normalized[fmt.Sprint(normalizeMessageValue(key))] = normalizeMessageValue(item)
+		}
+		return normalized
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(typedValue))
+		for key, item := range typedValue {
+			normalized[key] = normalizeMessageValue(item)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(typedValue))
+		for iItem, item := range typedValue {
+			normalized[iItem] = normalizeMessageValue(item)
+		}
+		return normalized
+	case []byte:
+		return string(typedValue)
+	case uint64:
+		if typedValue <= math.MaxInt64 {
+			return int64(typedValue)
+		}
+	case int:
+		return int64(typedValue)
+	case int8:
+		return int64(typedValue)
+	case int16:
+		return int64(typedValue)
+	case int32:
+		return int64(typedValue)
+	case uint:
+		return int64(typedValue)
+	case uint8:
+		return int64(typedValue)
+	case uint16:
+		return int64(typedValue)
+	case uint32:
+		return int64(typedValue)
+	case float32:
+		return float64(typedValue)
+	}
+	return value
+}
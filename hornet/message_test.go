@@ -0,0 +1,150 @@
+package hornet
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+// encodeTestBody encodes a message body as another service would, without going through a P8Message
+func encodeTestBody(t *testing.T, encoding string, body map[string]interface{}) []byte {
+	t.Helper()
+	var handle codec.Handle = new(codec.JsonHandle)
+	if encoding == "application/msgpack" {
+		handle = new(codec.MsgpackHandle)
+	}
+	var encoded []byte
+	if encodeErr := codec.NewEncoderBytes(&encoded, handle).Encode(body); encodeErr != nil {
+		t.Fatal(encodeErr)
+	}
+	return encoded
+}
+
+// testMessageBody returns a valid message body of the given type
+func testMessageBody(msgType MsgCodeT) map[string]interface{} {
+	body := map[string]interface{}{
+		"msgtype":   msgType,
+		"timestamp": "2018-04-01T12:00:00Z",
+		"sender_info": map[string]interface{}{
+			"package":  "dripline",
+			"exe":      "/usr/bin/dripline",
+			"version":  "2.1.0",
+			"commit":   "abcdef",
+			"hostname": "daq1",
+			"username": "project8",
+		},
+		"payload": map[string]interface{}{
+			"values":   []interface{}{"/data/run 1/file.egg", 12},
+			"priority": 3,
+			"nested":   map[string]interface{}{"flag": true, "ratio": 0.5},
+		},
+	}
+	switch msgType {
+	case MTRequest:
+		body["msgop"] = MOCommand
+	case MTReply:
+		body["retcode"] = RCSuccess
+		body["return_msg"] = "done"
+	}
+	return body
+}
+
+func TestDecodeP8Message(t *testing.T) {
+	var decoded []P8Message
+	for _, encoding := range []string{"application/json", "application/msgpack"} {
+		message, decodeErr := decodeP8Message(BusMessage{
+			RoutingKey:      "hornet.schedule",
+			ContentEncoding: encoding,
+			CorrelationId:   "corr-1",
+			ReplyTo:         "client",
+			Body:            encodeTestBody(t, encoding, testMessageBody(MTRequest)),
+		})
+		if decodeErr != nil {
+			t.Fatalf("%s: %v", encoding, decodeErr)
+		}
+		if message.MsgType != MTRequest || message.MsgOp != MOCommand || message.SenderInfo.Hostname != "daq1" ||
+			message.Target[0] != "schedule" || message.CorrId != "corr-1" || message.ReplyTo != "client" {
+			t.Errorf("%s: unexpected message: %+v", encoding, message)
+		}
+		// strings aren't byte slices, and integers are int64, whichever the encoding
+		expectedPayload := map[string]interface{}{
+			"values":   []interface{}{"/data/run 1/file.egg", int64(12)},
+			"priority": int64(3),
+			"nested":   map[string]interface{}{"flag": true, "ratio": 0.5},
+		}
+		if !reflect.DeepEqual(message.Payload, expectedPayload) {
+			t.Errorf("%s: got payload %#v; expected %#v", encoding, message.Payload, expectedPayload)
+		}
+		message.Encoding = ""
+		decoded = append(decoded, message)
+	}
+	if !reflect.DeepEqual(decoded[0], decoded[1]) {
+		t.Errorf("The JSON- and msgpack-encoded messages were decoded differently:\n%+v\n%+v", decoded[0], decoded[1])
+	}
+
+	if _, decodeErr := decodeP8Message(BusMessage{ContentEncoding: "text/plain", Body: []byte("hello")}); decodeErr.(MessageError).RetCode != RCErrNoEncoding {
+		t.Errorf("Unknown encoding: got %v; expected return code %d", decodeErr, RCErrNoEncoding)
+	}
+	if _, decodeErr := decodeP8Message(BusMessage{ContentEncoding: "application/json", Body: []byte("{not json")}); decodeErr.(MessageError).RetCode != RCErrDecodingFail {
+		t.Errorf("Invalid JSON: got %v; expected return code %d", decodeErr, RCErrDecodingFail)
+	}
+}
+
+func TestParseP8Message(t *testing.T) {
+	tests := []struct {
+		name            string
+		msgType         MsgCodeT
+		modify          func(body map[string]interface{})
+		expectedRetCode MsgCodeT // RCSuccess if the message is valid
+	}{
+		{"valid request", MTRequest, func(body map[string]interface{}) {}, RCSuccess},
+		{"valid reply", MTReply, func(body map[string]interface{}) {}, RCSuccess},
+		{"alert without msgop", MTAlert, func(body map[string]interface{}) {}, RCSuccess},
+		{"msgop as a float", MTRequest, func(body map[string]interface{}) { body["msgop"] = 1.0 }, RCSuccess},
+		{"missing msgtype", MTRequest, func(body map[string]interface{}) { delete(body, "msgtype") }, RCErrDecodingFail},
+		{"msgtype as a string", MTRequest, func(body map[string]interface{}) { body["msgtype"] = "3" }, RCErrDecodingFail},
+		{"unknown msgtype", MTRequest, func(body map[string]interface{}) { body["msgtype"] = 7 }, RCErrInvalidValue},
+		{"missing timestamp", MTRequest, func(body map[string]interface{}) { delete(body, "timestamp") }, RCErrDecodingFail},
+		{"timestamp as a number", MTRequest, func(body map[string]interface{}) { body["timestamp"] = 12 }, RCErrDecodingFail},
+		{"missing sender_info", MTRequest, func(body map[string]interface{}) { delete(body, "sender_info") }, RCErrDecodingFail},
+		{"sender_info as a string", MTRequest, func(body map[string]interface{}) { body["sender_info"] = "daq1" }, RCErrDecodingFail},
+		{"sender_info element as a number", MTRequest, func(body map[string]interface{}) {
+			body["sender_info"].(map[string]interface{})["exe"] = 3
+		}, RCErrDecodingFail},
+		{"request without msgop", MTRequest, func(body map[string]interface{}) { delete(body, "msgop") }, RCErrDecodingFail},
+		{"negative msgop", MTRequest, func(body map[string]interface{}) { body["msgop"] = -1 }, RCErrDecodingFail},
+		{"unknown msgop", MTRequest, func(body map[string]interface{}) { body["msgop"] = 42 }, RCErrInvalidMethod},
+		{"reply without retcode", MTReply, func(body map[string]interface{}) { delete(body, "retcode") }, RCErrDecodingFail},
+		{"fractional retcode", MTReply, func(body map[string]interface{}) { body["retcode"] = 1.5 }, RCErrDecodingFail},
+		{"return_msg as a number", MTReply, func(body map[string]interface{}) { body["return_msg"] = 5 }, RCErrDecodingFail},
+		{"specifier as a list", MTRequest, func(body map[string]interface{}) { body["specifier"] = []interface{}{"a"} }, RCErrDecodingFail},
+	}
+	for _, test := range tests {
+		for _, encoding := range []string{"application/json", "application/msgpack"} {
+			body := testMessageBody(test.msgType)
+			test.modify(body)
+			message, decodeErr := decodeP8Message(BusMessage{
+				RoutingKey:      "hornet.status",
+				ContentEncoding: encoding,
+				Body:            encodeTestBody(t, encoding, body),
+			})
+			retCode := RCSuccess
+			if decodeErr != nil {
+				messageErr, isMessageErr := decodeErr.(MessageError)
+				if !isMessageErr {
+					t.Errorf("%s (%s): got %v; expected a MessageError", test.name, encoding, decodeErr)
+					continue
+				}
+				retCode = messageErr.RetCode
+			}
+			if retCode != test.expectedRetCode {
+				t.Errorf("%s (%s): got return code %d (%v); expected %d", test.name, encoding, retCode, decodeErr, test.expectedRetCode)
+			}
+			// the message type is kept if it's valid, so that invalid requests get a reply
+			if body["msgtype"] == test.msgType && message.MsgType != test.msgType {
+				t.Errorf("%s (%s): got message type %d; expected %d", test.name, encoding, message.MsgType, test.msgType)
+			}
+		}
+	}
+}
@@ -12,21 +12,40 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
+// CopyOptions specifies which properties of the source file are given to the destination file
+type CopyOptions struct {
+	PreserveMode   bool
+	PreserveMtime  bool
+	PreserveOwner  bool
+	PreserveXattrs bool
+	// maximum copy rate in bytes per second; 0 means no limit
+	RateLimit int64
+}
+
 /// copy will copy the contents of one file to another.  the arguments are both
 // strings i.e. paths to the original and the desired destination.  if something
 // goes wrong, it returns an error.
-func copy(source, destination string) error {
+// The contents are synced to disk before the file is renamed to its final name,
+// and the destination directory is synced afterwards, so that the copy is durable
+// before the original is removed.
+func copy(source, destination string, options CopyOptions) error {
 	src, srcErr := os.Open(source)
 	if srcErr != nil {
 		return srcErr
 	}
 	defer src.Close()
 
+	srcInfo, statErr := src.Stat()
+	if statErr != nil {
+		return statErr
+	}
+
 	tempDest := destination + ".hmtemp"
 	dst, dstErr := os.Create(tempDest)
 	if dstErr != nil {
@@ -35,27 +54,67 @@ func copy(source, destination string) error {
 	// we can't defer the Close() call because we need to rename after the close
 	//defer dst.Close()
 
-	if _, cpyErr := io.Copy(dst, src); cpyErr != nil {
+	if _, cpyErr := io.Copy(dst, NewRateLimitedReader(src, options.RateLimit)); cpyErr != nil {
 		dst.Close()
+		Remove(tempDest)
 		return cpyErr
 	}
+	if syncErr := dst.Sync(); syncErr != nil {
+		dst.Close()
+		Remove(tempDest)
+		return syncErr
+	}
 	dst.Close() // this has to be done before calling Rename()
 
+	// the properties are set on the temporary file so that the destination only appears once it's complete
+	if propErr := copyProperties(source, srcInfo, tempDest, options); propErr != nil {
+		Remove(tempDest)
+		return propErr
+	}
+
 	if renameErr := os.Rename(tempDest, destination); renameErr != nil {
 		return renameErr
 	}
-	if chmodErr := os.Chmod(destination, 0664); chmodErr != nil {
+
+	return SyncDirectory(filepath.Dir(destination))
+}
+
+// copyProperties gives the destination file the requested properties of the source file
+func copyProperties(source string, srcInfo os.FileInfo, destination string, options CopyOptions) error {
+	if options.PreserveXattrs {
+		if xattrErr := CopyXattrs(source, destination); xattrErr != nil {
+			return fmt.Errorf("Unable to copy extended attributes: %v", xattrErr)
+		}
+	}
+	// ownership is set before the mode, since changing the owner can clear the setuid and setgid bits
+	if options.PreserveOwner {
+		if ownErr := CopyOwnership(srcInfo, destination); ownErr != nil {
+			return fmt.Errorf("Unable to set the owner: %v", ownErr)
+		}
+	}
+	mode := os.FileMode(0664)
+	if options.PreserveMode {
+		mode = srcInfo.Mode().Perm()
+	}
+	if chmodErr := os.Chmod(destination, mode); chmodErr != nil {
 		return chmodErr
 	}
-
+	if options.PreserveMtime {
+		if timeErr := os.Chtimes(destination, time.Now(), srcInfo.ModTime()); timeErr != nil {
+			return fmt.Errorf("Unable to set the modification time: %v", timeErr)
+		}
+	}
 	return nil
 }
 
 // Copy copies a file from one place to another.
-func Copy(src, dest string) (e error) {
-	if copyErr := copy(src, dest); copyErr != nil {
+func Copy(src, dest string, options CopyOptions) (e error) {
+	if copyErr := copy(src, dest, options); copyErr != nil {
 		Log.Errorf("File copy failed! (%v -> %v) [%v]\n", src, dest, copyErr)
 		e = errors.New("Failed to copy file")
+		if _, statErr := os.Lstat(dest); os.IsNotExist(statErr) {
+			return
+		}
 		if remErr := Remove(dest); remErr != nil {
 			Log.Errorf("Failed to remove the failed-copy (destination) file [%v]", remErr)
 			e = errors.New("Failed to copy file & failed to removed the failed-copy destination file")
@@ -64,6 +123,60 @@ func Copy(src, dest string) (e error) {
 	return
 }
 
+// Space on each filesystem that's been claimed by copies in progress, so that concurrent movers don't overcommit the free space
+var claimedSpace = make(map[string]uint64)
+var claimedSpaceMutex sync.Mutex
+
+// claimFreeSpace returns an error if copying a file of the given size to the directory would leave less than
+// the reserved amount of free space on its filesystem, taking into account the other copies in progress.
+// Otherwise the space is claimed until releaseFreeSpace is called.
+func claimFreeSpace(dir, fsID string, size int64, reserve uint64) error {
+	claimedSpaceMutex.Lock()
+	defer claimedSpaceMutex.Unlock()
+	free, freeErr := FreeSpace(dir)
+	if freeErr != nil {
+		return fmt.Errorf("Unable to determine the free space in %s: %v", dir, freeErr)
+	}
+	needed := uint64(size) + reserve + claimedSpace[fsID]
+	if free < needed {
+		return fmt.Errorf("Insufficient free space in %s: %d bytes available, %d bytes needed (including a reserve of %d bytes and %d bytes for other copies in progress)", dir, free, needed, reserve, claimedSpace[fsID])
+	}
+	claimedSpace[fsID] += uint64(size)
+	return nil
+}
+
+// releaseFreeSpace releases the space claimed for a copy once it has finished
+func releaseFreeSpace(fsID string, size int64) {
+	claimedSpaceMutex.Lock()
+	defer claimedSpaceMutex.Unlock()
+	if claimedSpace[fsID] <= uint64(size) {
+		delete(claimedSpace, fsID)
+		return
+	}
+	claimedSpace[fsID] -= uint64(size)
+}
+
+// move moves a file within a filesystem, either by renaming it, or by linking it to its new location
+// and then removing the original.  Unlike renaming, linking will not replace an existing destination file.
+// If the original is to be kept, the file is linked and the original is not removed.
+// If the error is from removing the original, removeFailed is true; the file is still available at the destination.
+func move(source, destination string, useHardlink, keepSource bool) (removeFailed bool, e error) {
+	if useHardlink == false && keepSource == false {
+		e = os.Rename(source, destination)
+		return
+	}
+	if e = os.Link(source, destination); e != nil {
+		return
+	}
+	if keepSource {
+		return
+	}
+	if e = os.Remove(source); e != nil {
+		removeFailed = true
+	}
+	return
+}
+
 // Remove deletes a file
 func Remove(file string) (e error) {
 	if rmErr := os.Remove(file); rmErr != nil {
@@ -73,14 +186,19 @@ func Remove(file string) (e error) {
 	return
 }
 
+// MoverID is an identifier for a particular mover goroutine.
+type MoverID uint
+
 // Mover receives filenames over an unbuffered channel, and moves them from
 // their current place on the filesystem to a destination.
 // It is stopped when it receives a message from the main thread
 // to shut down.
-func Mover(context OperatorContext) {
+// Several movers can share the file stream; the limiter, which is shared by the movers,
+// caps the number of concurrent copies to each destination filesystem.
+func Mover(context OperatorContext, id MoverID, limiter *DestinationLimiter) {
 	// decrement the wg counter at the end
 	defer context.PoolCount.Done()
-	defer Log.Info("Mover is finished.")
+	defer Log.Infof("Mover (%d) is finished.", id)
 
 	destDirBase, dirErr := filepath.Abs(viper.GetString("mover.dest-dir"))
 	if dirErr != nil || PathIsDirectory(destDirBase) == false {
@@ -89,7 +207,64 @@ func Mover(context OperatorContext) {
 		return
 	}
 
-	Log.Info("Mover started successfully")
+	// files are moved with rename (or hardlink) when the source and destination are on the same filesystem, unless copying is forced
+	forceCopy := viper.GetBool("mover.force-copy")
+	sameFsMethod := "rename"
+	if viper.IsSet("mover.same-fs-method") {
+		sameFsMethod = viper.GetString("mover.same-fs-method")
+	}
+	if sameFsMethod != "rename" && sameFsMethod != "hardlink" {
+		Log.Criticalf("Invalid same-filesystem move method: <%s>", sameFsMethod)
+		context.ReqQueue <- ThreadCannotContinue
+		return
+	}
+	useHardlink := sameFsMethod == "hardlink"
+
+	// unless the source policy is delete, the original file is left in place (and later removed by the janitor, if requested)
+	sourcePolicy, policyErr := GetSourcePolicy()
+	if policyErr != nil {
+		Log.Critical(policyErr.Error())
+		context.ReqQueue <- ThreadCannotContinue
+		return
+	}
+	keepSource := sourcePolicy != SourceDelete
+	if keepSource {
+		// the original can't be renamed, so files on the same filesystem are linked
+		sameFsMethod = "hardlink"
+	}
+	Log.Debugf("Force copy: %v; same-filesystem method: %s; keep source: %v", forceCopy, sameFsMethod, keepSource)
+
+	// properties of the original file that are preserved when it's copied
+	var copyOptions CopyOptions
+	for _, property := range viper.GetStringSlice("mover.preserve") {
+		switch property {
+		case "mode":
+			copyOptions.PreserveMode = true
+		case "mtime":
+			copyOptions.PreserveMtime = true
+		case "owner":
+			copyOptions.PreserveOwner = true
+		case "xattrs":
+			copyOptions.PreserveXattrs = true
+		default:
+			Log.Criticalf("Invalid file property to preserve: <%s>", property)
+			context.ReqQueue <- ThreadCannotContinue
+			return
+		}
+	}
+	Log.Debugf("Copy options: %+v", copyOptions)
+
+	// free space (in bytes) that must remain on the destination filesystem after a file is copied
+	freeSpaceReserveBytes, reserveErr := GetConfigSizeInBytes("mover.free-space-reserve")
+	if reserveErr != nil {
+		Log.Critical(reserveErr.Error())
+		context.ReqQueue <- ThreadCannotContinue
+		return
+	}
+	freeSpaceReserve := uint64(freeSpaceReserveBytes)
+	Log.Debugf("Free-space reserve: %d bytes", freeSpaceReserve)
+
+	Log.Infof("Mover (%d) started successfully", id)
 
 moveLoop:
 	for {
@@ -102,7 +277,7 @@ moveLoop:
 				break moveLoop
 			}
 			if controlMsg == StopExecution {
-				Log.Info("Mover stopping on interrupt.")
+				Log.Infof("Mover (%d) stopping on interrupt.", id)
 				break moveLoop
 			}
 		case fileHeader, queueOk := <-context.FileStream:
@@ -128,13 +303,77 @@ moveLoop:
 				opReturn.Err = fmt.Errorf("Couldn't make directory %v: [%v]", destDirPath, mkErr)
 				opReturn.IsFatal = true
 				Log.Error(opReturn.Err.Error())
+				context.RetStream <- opReturn
+				continue moveLoop
 			}
 
-			deleteInputFile := true
+			deleteInputFile := !keepSource
 
-			// copy the file
+			// on the same filesystem, the file can be moved without copying its contents
 			timeStart := time.Now()
-			if copyErr := Copy(inputFilePath, outputFilePath); copyErr != nil {
+			if forceCopy == false {
+				sameFs, fsErr := SameFilesystem(inputFilePath, destDirPath)
+				if fsErr != nil {
+					Log.Warningf("Unable to determine whether the source and destination are on the same filesystem; the file will be copied: %v", fsErr)
+				} else if sameFs {
+					removeFailed, moveErr := move(inputFilePath, outputFilePath, useHardlink, keepSource)
+					switch {
+					case moveErr == nil:
+						Log.Infof("File move (%s) took %v", sameFsMethod, time.Since(timeStart))
+						// make the new and removed directory entries durable
+						if syncErr := SyncDirectory(destDirPath); syncErr != nil {
+							Log.Warningf("Unable to sync directory %s: %v", destDirPath, syncErr)
+						}
+						if syncErr := SyncDirectory(filepath.Dir(inputFilePath)); syncErr != nil {
+							Log.Warningf("Unable to sync directory %s: %v", filepath.Dir(inputFilePath), syncErr)
+						}
+						context.RetStream <- opReturn
+						continue moveLoop
+					case removeFailed:
+						opReturn.Err = fmt.Errorf("Error removing file %s", inputFilePath)
+						opReturn.IsFatal = true
+						Log.Error(opReturn.Err.Error())
+						context.RetStream <- opReturn
+						continue moveLoop
+					default:
+						Log.Warningf("Unable to move <%s> with %s; the file will be copied: %v", inputFilePath, sameFsMethod, moveErr)
+					}
+				}
+			}
+
+			// wait until a copy to the destination filesystem is allowed
+			destFsID, fsIDErr := FilesystemID(destDirPath)
+			if fsIDErr != nil {
+				Log.Warningf("Unable to identify the filesystem of %s: %v", destDirPath, fsIDErr)
+				destFsID = destDirPath
+			}
+			if limiter.Acquire(destFsID, context.CtrlQueue) == false {
+				Log.Infof("Mover (%d) stopping on interrupt.", id)
+				break moveLoop
+			}
+
+			// check that there's room for the copy
+			var copySize int64
+			if inputInfo, statErr := os.Stat(inputFilePath); statErr != nil {
+				opReturn.Err = fmt.Errorf("Unable to get file information on %s: %v", inputFilePath, statErr)
+			} else if spaceErr := claimFreeSpace(destDirPath, destFsID, inputInfo.Size(), freeSpaceReserve); spaceErr != nil {
+				opReturn.Err = spaceErr
+			} else {
+				copySize = inputInfo.Size()
+			}
+			if opReturn.Err != nil {
+				limiter.Release(destFsID)
+				opReturn.IsFatal = true
+				Log.Error(opReturn.Err.Error())
+				context.RetStream <- opReturn
+				continue moveLoop
+			}
+
+			// copy the file
+			copyErr := Copy(inputFilePath, outputFilePath, copyOptions)
+			releaseFreeSpace(destFsID, copySize)
+			limiter.Release(destFsID)
+			if copyErr != nil {
 				opReturn.Err = fmt.Errorf("Error copying (%v -> %v) [%v]", inputFilePath, outputFilePath, copyErr)
 				opReturn.IsFatal = true
 				Log.Error(opReturn.Err.Error())
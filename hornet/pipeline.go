@@ -0,0 +1,288 @@
+/*
+* pipeline.go
+*
+* Backpressure and metrics for the flow of files through hornet.
+*
+* The scheduler never blocks when passing a file to a stage: each stage has a limit on the
+* number of files in flight (sent to the stage and not yet returned), and files beyond that
+* limit are held in a pending list until the stage returns a file.  If the total number of
+* files in the pipeline reaches its limit, the scheduler stops accepting new files, and the
+* watcher holds its submissions until there's room.
+*
+* Within a stage with several instances (movers or shippers), the number of concurrent
+* transfers to each destination can also be limited.
+*
+* Sending files to a stage can be paused (e.g. remotely, during maintenance of a destination); the files
+* for a paused stage are held in its pending list.  The scheduler also records the stage that each file
+* in the pipeline has reached, so that the files in flight can be inspected.
+ */
+
+package hornet
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stageDispatcher passes files from the scheduler to a stage without blocking
+type stageDispatcher struct {
+	name     string
+	queue    chan FileInfo
+	pending  []FileInfo
+	inFlight int
+	limit    int
+}
+
+func newStageDispatcher(name string, queue chan FileInfo, limit int) *stageDispatcher {
+	// files in flight include those waiting in the queue, so the limit can't exceed the queue's capacity
+	if limit <= 0 || limit > cap(queue) {
+		limit = cap(queue)
+	}
+	Log.Debugf("In-flight limit for the %s: %d", name, limit)
+	return &stageDispatcher{
+		name:  name,
+		queue: queue,
+		limit: limit,
+	}
+}
+
+// Submit adds a file to the pending list and dispatches as many pending files as possible
+func (d *stageDispatcher) Submit(fileHeader FileInfo) {
+	setFileStage(fileHeader.FileHotPath, d.name)
+	d.pending = append(d.pending, fileHeader)
+	d.Dispatch()
+}
+
+// Dispatch sends pending files to the stage until the in-flight limit is reached or the queue is full
+func (d *stageDispatcher) Dispatch() {
+	if StageIsPaused(d.name) {
+		return
+	}
+	for len(d.pending) > 0 && d.inFlight < d.limit {
+		select {
+		case d.queue <- d.pending[0]:
+			Log.Infof("Sending <%s> to the %s", d.pending[0].Filename, d.name)
+			d.pending = d.pending[1:]
+			d.inFlight++
+		default:
+			return
+		}
+	}
+}
+
+// Returned records that the stage has returned a file, and dispatches the next pending file
+func (d *stageDispatcher) Returned() {
+	if d.inFlight > 0 {
+		d.inFlight--
+	}
+	d.Dispatch()
+}
+
+func (d *stageDispatcher) Stats() StageStats {
+	return StageStats{
+		Name:     d.name,
+		Pending:  len(d.pending),
+		Queued:   len(d.queue),
+		InFlight: d.inFlight,
+		Limit:    d.limit,
+		Paused:   StageIsPaused(d.name),
+	}
+}
+
+// StageStats holds the queue-depth metrics for one stage of the pipeline
+type StageStats struct {
+	Name     string
+	Pending  int // files held by the scheduler, waiting to be sent to the stage
+	Queued   int // files in the stage's file stream, waiting to be received by the stage
+	InFlight int // files sent to the stage and not yet returned (including those queued)
+	Limit    int // maximum number of files in flight
+	Paused   bool
+}
+
+// PipelineStats holds the queue-depth metrics for the whole pipeline
+type PipelineStats struct {
+	Stages         []StageStats
+	InPipeline     int // files accepted by the scheduler that haven't finished or failed
+	MaxInPipeline  int // 0 if there's no limit
+	SchQueueDepth  int // files submitted to the scheduling queue and not yet accepted
+	WatcherPending int // files found by the watcher and not yet submitted
+}
+
+var pipelineStats PipelineStats
+var pipelineStatsMutex sync.RWMutex
+
+func setPipelineStats(stats PipelineStats) {
+	pipelineStatsMutex.Lock()
+	stats.WatcherPending = pipelineStats.WatcherPending
+	pipelineStats = stats
+	pipelineStatsMutex.Unlock()
+}
+
+func setWatcherPending(nPending int) {
+	pipelineStatsMutex.Lock()
+	pipelineStats.WatcherPending = nPending
+	pipelineStatsMutex.Unlock()
+}
+
+// GetPipelineStats returns a copy of the current queue-depth metrics
+func GetPipelineStats() (stats PipelineStats) {
+	pipelineStatsMutex.RLock()
+	defer pipelineStatsMutex.RUnlock()
+	stats = pipelineStats
+	stats.Stages = append([]StageStats{}, pipelineStats.Stages...)
+	return
+}
+
+// PipelineIsSaturated returns true if the scheduler is not accepting new files
+// because the number of files in the pipeline has reached its limit
+func PipelineIsSaturated() bool {
+	pipelineStatsMutex.RLock()
+	defer pipelineStatsMutex.RUnlock()
+	return pipelineStats.MaxInPipeline > 0 && pipelineStats.InPipeline >= pipelineStats.MaxInPipeline
+}
+
+var pausedStages = make(map[string]bool)
+var pausedStagesMutex sync.RWMutex
+
+// SetStagePaused pauses or resumes sending files to a stage; "shipper" refers to the shippers for all destinations,
+// and pausing it is the same as pausing shipping (see SetShippingPaused)
+func SetStagePaused(name string, paused bool) {
+	if name == "shipper" {
+		SetShippingPaused(paused)
+		return
+	}
+	pausedStagesMutex.Lock()
+	defer pausedStagesMutex.Unlock()
+	if paused {
+		Log.Noticef("Sending files to the %s is paused", name)
+		pausedStages[name] = true
+	} else {
+		Log.Noticef("Sending files to the %s is resumed", name)
+		delete(pausedStages, name)
+	}
+}
+
+// StageIsPaused checks whether a stage is paused, either by its name or, for a shipper stage (e.g. "shipper:archive"),
+// because shipping is paused
+func StageIsPaused(name string) bool {
+	if (name == "shipper" || strings.HasPrefix(name, "shipper:")) && ShippingIsPaused() {
+		return true
+	}
+	pausedStagesMutex.RLock()
+	defer pausedStagesMutex.RUnlock()
+	return pausedStages[name]
+}
+
+// FileStatus describes a file in the pipeline
+type FileStatus struct {
+	Path  string
+	Stage string
+	Since time.Time // when the file reached the stage
+	// ID given to the file by the run database; empty until the file is registered
+	DatabaseID string
+}
+
+// files in the pipeline, by hot path
+var filesInFlight = make(map[string]FileStatus)
+var filesInFlightMutex sync.RWMutex
+
+// setFileStage records the stage that a file has reached
+func setFileStage(path, stage string) {
+	filesInFlightMutex.Lock()
+	filesInFlight[path] = FileStatus{Path: path, Stage: stage, Since: time.Now(), DatabaseID: filesInFlight[path].DatabaseID}
+	filesInFlightMutex.Unlock()
+}
+
+// setFileDatabaseID records the database ID of a file, if it's still in the pipeline
+func setFileDatabaseID(path, databaseID string) {
+	filesInFlightMutex.Lock()
+	if status, inFlight := filesInFlight[path]; inFlight {
+		status.DatabaseID = databaseID
+		filesInFlight[path] = status
+	}
+	filesInFlightMutex.Unlock()
+}
+
+// getFileDatabaseID returns the database ID recorded for a file; it's empty if the file hasn't been registered
+func getFileDatabaseID(path string) string {
+	filesInFlightMutex.RLock()
+	defer filesInFlightMutex.RUnlock()
+	return filesInFlight[path].DatabaseID
+}
+
+// forgetFile is used once a file has left the pipeline
+func forgetFile(path string) {
+	filesInFlightMutex.Lock()
+	delete(filesInFlight, path)
+	filesInFlightMutex.Unlock()
+}
+
+// GetFilesInPipeline returns the files in the pipeline and their stages, sorted by path
+func GetFilesInPipeline() (files []FileStatus) {
+	filesInFlightMutex.RLock()
+	for _, status := range filesInFlight {
+		files = append(files, status)
+	}
+	filesInFlightMutex.RUnlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return
+}
+
+// DestinationLimiter caps the number of concurrent transfers to each destination (e.g. a filesystem or a remote host).
+// It's shared by the instances of a stage.
+type DestinationLimiter struct {
+	limit int
+	mutex sync.Mutex
+	slots map[string]chan bool
+}
+
+// NewDestinationLimiter creates a limiter with the given number of concurrent transfers per destination; 0 means no limit
+func NewDestinationLimiter(limit int) *DestinationLimiter {
+	return &DestinationLimiter{
+		limit: limit,
+		slots: make(map[string]chan bool),
+	}
+}
+
+func (l *DestinationLimiter) destinationSlots(destination string) chan bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	slots, hasSlots := l.slots[destination]
+	if !hasSlots {
+		slots = make(chan bool, l.limit)
+		l.slots[destination] = slots
+	}
+	return slots
+}
+
+// Acquire waits until a transfer to the destination is allowed.
+// It returns false if the control queue is closed or a control message (i.e. a request to stop) is received while waiting,
+// in which case the transfer should not be made.
+func (l *DestinationLimiter) Acquire(destination string, ctrlQueue chan ControlMessage) bool {
+	if l == nil || l.limit <= 0 {
+		return true
+	}
+	slots := l.destinationSlots(destination)
+	select {
+	case slots <- true:
+		return true
+	default:
+	}
+	Log.Debugf("Waiting for a free transfer slot for <%s> (limit %d)", destination, l.limit)
+	select {
+	case slots <- true:
+		return true
+	case <-ctrlQueue:
+		return false
+	}
+}
+
+// Release records that a transfer to the destination has finished
+func (l *DestinationLimiter) Release(destination string) {
+	if l == nil || l.limit <= 0 {
+		return
+	}
+	<-l.destinationSlots(destination)
+}
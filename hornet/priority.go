@@ -0,0 +1,122 @@
+/*
+* priority.go
+*
+* the priority queue holds files that are waiting for a worker to become available.
+*
+* Files are taken from the queue in the following order:
+*    1. Highest effective priority; the effective priority is the file's priority, increased
+*       by 1 for each aging interval it has spent waiting (if aging is in use).
+*    2. Fewest files of the same type currently being processed by the workers, so that
+*       the workers are shared fairly between file types with the same priority.
+*    3. First come, first served.
+ */
+
+package hornet
+
+import (
+	"sync"
+	"time"
+)
+
+type pendingFile struct {
+	fHeader    FileInfo
+	submitTime time.Time
+	sequence   uint64
+}
+
+// workerPriorityQueue holds the files waiting for a worker, and tracks the number of files of each type being processed
+type workerPriorityQueue struct {
+	files        []pendingFile
+	aging        time.Duration
+	nextSequence uint64
+	activeByType map[string]int
+}
+
+func newWorkerPriorityQueue(aging time.Duration) *workerPriorityQueue {
+	return &workerPriorityQueue{
+		aging:        aging,
+		activeByType: make(map[string]int),
+	}
+}
+
+func (q *workerPriorityQueue) Len() int {
+	return len(q.files)
+}
+
+// Push adds a file to the queue
+func (q *workerPriorityQueue) Push(fHeader FileInfo) {
+	q.files = append(q.files, pendingFile{
+		fHeader:    fHeader,
+		submitTime: time.Now(),
+		sequence:   q.nextSequence,
+	})
+	q.nextSequence++
+}
+
+// effectivePriority includes the aging bonus for the time a file has been waiting
+func (q *workerPriorityQueue) effectivePriority(file *pendingFile, now time.Time) int {
+	if q.aging <= 0 {
+		return file.fHeader.Priority
+	}
+	return file.fHeader.Priority + int(now.Sub(file.submitTime)/q.aging)
+}
+
+// Pop removes and returns the next file to be processed; the queue must not be empty
+func (q *workerPriorityQueue) Pop() (fHeader FileInfo) {
+	now := time.Now()
+	iBest := 0
+	bestPriority := q.effectivePriority(&q.files[0], now)
+	for iFile := 1; iFile < len(q.files); iFile++ {
+		file := &q.files[iFile]
+		priority := q.effectivePriority(file, now)
+		if priority < bestPriority {
+			continue
+		}
+		if priority == bestPriority {
+			nActive, nBestActive := q.activeByType[file.fHeader.FileType], q.activeByType[q.files[iBest].fHeader.FileType]
+			if nActive > nBestActive || (nActive == nBestActive && file.sequence > q.files[iBest].sequence) {
+				continue
+			}
+		}
+		iBest = iFile
+		bestPriority = priority
+	}
+	fHeader = q.files[iBest].fHeader
+	q.files = append(q.files[:iBest], q.files[iBest+1:]...)
+	return
+}
+
+// StartedFile records that a file of the given type has been sent to the workers
+func (q *workerPriorityQueue) StartedFile(fileType string) {
+	q.activeByType[fileType]++
+}
+
+// FinishedFile records that the workers have finished with a file of the given type
+func (q *workerPriorityQueue) FinishedFile(fileType string) {
+	if q.activeByType[fileType] > 0 {
+		q.activeByType[fileType]--
+	}
+}
+
+// Priorities requested when files are submitted, by absolute path
+var submissionPriorities = make(map[string]int)
+var submissionPrioritiesMutex sync.Mutex
+
+// SetSubmissionPriority sets the priority for a file that is being submitted to the scheduling queue.
+// It overrides the priority determined by the classifier from the file's type and jobs.
+// This should be called before the file is submitted.
+func SetSubmissionPriority(path string, priority int) {
+	submissionPrioritiesMutex.Lock()
+	submissionPriorities[path] = priority
+	submissionPrioritiesMutex.Unlock()
+}
+
+// takeSubmissionPriority returns and forgets the priority requested for a file when it was submitted, if there was one
+func takeSubmissionPriority(path string) (priority int, hasPriority bool) {
+	submissionPrioritiesMutex.Lock()
+	defer submissionPrioritiesMutex.Unlock()
+	if priority, hasPriority = submissionPriorities[path]; hasPriority {
+		delete(submissionPriorities, path)
+	}
+	return
+}
@@ -0,0 +1,89 @@
+package hornet
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// popAll empties the queue, and returns the names of the files in the order they were taken
+func popAll(queue *workerPriorityQueue) string {
+	var names []string
+	for queue.Len() > 0 {
+		names = append(names, queue.Pop().Filename)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestWorkerPriorityQueue(t *testing.T) {
+	type queuedFile struct {
+		name     string
+		fileType string
+		priority int
+		// how long ago the file was submitted
+		waited time.Duration
+	}
+	tests := []struct {
+		name string
+		// number of files of each type being processed by the workers
+		active   map[string]int
+		files    []queuedFile
+		expected string
+	}{
+		{"priority", nil, []queuedFile{
+			{"low", "egg", 0, 0},
+			{"high", "egg", 5, 0},
+			{"middle", "egg", 2, 0},
+		}, "high middle low"},
+		{"first come, first served", nil, []queuedFile{
+			{"first", "egg", 1, 0},
+			{"second", "egg", 1, 0},
+			{"third", "egg", 1, 0},
+		}, "first second third"},
+		{"fairness between types", map[string]int{"egg": 3, "mat": 1}, []queuedFile{
+			{"egg1", "egg", 1, 0},
+			{"egg2", "egg", 1, 0},
+			{"mat1", "mat", 1, 0},
+			{"setup1", "setup", 1, 0},
+			{"other", "setup", 0, 0},
+		}, "setup1 mat1 egg1 egg2 other"},
+		{"priority before fairness", map[string]int{"egg": 3}, []queuedFile{
+			{"mat1", "mat", 1, 0},
+			{"egg1", "egg", 2, 0},
+		}, "egg1 mat1"},
+		// with a 1-minute aging interval, a file that has waited 3 minutes gains 3 levels of priority
+		{"aging", nil, []queuedFile{
+			{"new", "egg", 2, 0},
+			{"old", "egg", 0, 3*time.Minute + time.Second},
+			{"newer", "egg", 3, 0},
+			{"waited", "egg", 1, 90 * time.Second},
+		}, "old newer new waited"},
+	}
+	for _, test := range tests {
+		queue := newWorkerPriorityQueue(time.Minute)
+		for fileType, nActive := range test.active {
+			for iFile := 0; iFile < nActive; iFile++ {
+				queue.StartedFile(fileType)
+			}
+		}
+		for _, file := range test.files {
+			queue.Push(FileInfo{Filename: file.name, FileType: file.fileType, Priority: file.priority})
+			// the submission time is backdated for the aging
+			queue.files[queue.Len()-1].submitTime = time.Now().Add(-file.waited)
+		}
+		if order := popAll(queue); order != test.expected {
+			t.Errorf("%s: got %q; expected %q", test.name, order, test.expected)
+		}
+	}
+
+	// once the workers have finished with a type (the count doesn't go below zero), its files are no longer held back
+	queue := newWorkerPriorityQueue(0)
+	queue.StartedFile("egg")
+	queue.Push(FileInfo{Filename: "egg1", FileType: "egg"})
+	queue.Push(FileInfo{Filename: "mat1", FileType: "mat"})
+	queue.FinishedFile("egg")
+	queue.FinishedFile("egg")
+	if order := popAll(queue); order != "egg1 mat1" {
+		t.Errorf("After the files finished: got %q; expected %q", order, "egg1 mat1")
+	}
+}
@@ -0,0 +1,277 @@
+/*
+* registration.go
+*
+* the registrars register each classified file with the run database, as a request via AMQP.
+*
+* The reply's return code is checked; failed registrations are retried (with a doubling delay) when the failure
+* may be temporary: no reply, an AMQP or resource error, or a timeout.  The database ID given in the reply
+* (in the payload element given by id-key) is recorded on the file as its DatabaseID.
+*
+* If registration is required, files are only moved (and therefore processed and shipped) once they're registered,
+* and a file that can't be registered fails.  Otherwise files are moved while they're being registered, and a
+* failed registration is only logged.
+ */
+
+package hornet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RegistrarID is an identifier for a particular registrar goroutine.
+type RegistrarID uint
+
+type registrationSettings struct {
+	Target      []string
+	RunIDKey    string
+	IDKey       string
+	Timeout     time.Duration
+	MaxAttempts int
+	RetryDelay  time.Duration
+}
+
+// RegistrationIsActive reports whether files are registered with the run database.
+// The classifier options send-file-info, send-to and reply-timeout are still accepted in place of the registration options.
+func RegistrationIsActive() bool {
+	if viper.IsSet("registration.active") {
+		return viper.GetBool("registration.active")
+	}
+	return viper.GetBool("classifier.send-file-info")
+}
+
+// RegistrationIsRequired reports whether files must be registered before they're moved
+func RegistrationIsRequired() bool {
+	return RegistrationIsActive() && viper.GetBool("registration.required")
+}
+
+// ValidateRegistrationConfig checks the sanity of the registration section of a configuration.
+// It makes the following guarantees
+//   1) AMQP is active
+//   2) The routing key of the run database is set
+//   3) The number of attempts and the delays are positive
+func ValidateRegistrationConfig() (e error) {
+	if RegistrationIsActive() == false {
+		return
+	}
+
+	if viper.GetBool("amqp.active") == false {
+		e = errors.New("Files can only be registered if AMQP is active")
+		Log.Error(e.Error())
+	}
+	if _, settingsErr := getRegistrationSettings(); settingsErr != nil {
+		e = settingsErr
+		Log.Error(e.Error())
+	}
+	return
+}
+
+// getRegistrationSettings reads the registration section of the configuration, with the defaults for options that aren't set
+func getRegistrationSettings() (settings registrationSettings, e error) {
+	sendTo := viper.GetString("classifier.send-to")
+	if viper.IsSet("registration.send-to") {
+		sendTo = viper.GetString("registration.send-to")
+	}
+	if sendTo == "" {
+		e = errors.New("The routing key of the run database is not set (registration.send-to)")
+		return
+	}
+	settings.Target = []string{sendTo}
+
+	settings.RunIDKey = "run_id"
+	if viper.IsSet("registration.run-id-key") {
+		settings.RunIDKey = viper.GetString("registration.run-id-key")
+	}
+	settings.IDKey = "file_id"
+	if viper.IsSet("registration.id-key") {
+		settings.IDKey = viper.GetString("registration.id-key")
+	}
+
+	settings.Timeout = requestTimeout()
+	if viper.IsSet("registration.timeout") {
+		settings.Timeout = viper.GetDuration("registration.timeout")
+	} else if viper.IsSet("classifier.reply-timeout") {
+		settings.Timeout = viper.GetDuration("classifier.reply-timeout")
+	}
+	settings.MaxAttempts = 5
+	if viper.IsSet("registration.max-attempts") {
+		settings.MaxAttempts = viper.GetInt("registration.max-attempts")
+	}
+	settings.RetryDelay = 5 * time.Second
+	if viper.IsSet("registration.retry-delay") {
+		settings.RetryDelay = viper.GetDuration("registration.retry-delay")
+	}
+
+	if settings.Timeout <= 0 {
+		e = errors.New("The registration timeout must be > 0")
+	} else if settings.MaxAttempts <= 0 {
+		e = errors.New("The maximum number of registration attempts must be > 0")
+	} else if settings.RetryDelay <= 0 {
+		e = errors.New("The registration retry delay must be > 0")
+	}
+	return
+}
+
+// registrationPayload gives the request payload for a file: its metadata, the run ID (from the metadata),
+// which is sent as a number if possible, and its name, hash and type.
+// The metadata can't replace the values that are set by hornet.
+func registrationPayload(header FileInfo, runIDKey string) map[string]interface{} {
+	payload := make(map[string]interface{}, len(header.Metadata)+4)
+	for key, value := range header.Metadata {
+		payload[key] = value
+	}
+	if runID, hasRunID := header.Metadata[runIDKey]; hasRunID {
+		if numericID, convErr := strconv.ParseInt(runID, 10, 64); convErr == nil {
+			payload[runIDKey] = numericID
+		}
+	}
+	payload["values"] = []string{"do_insert"}
+	payload["file_name"] = header.Filename
+	payload["file_hash"] = header.FileHash
+	payload["file_type"] = header.FileType
+	return payload
+}
+
+// registrationIsRetriable reports whether a failed registration may succeed if it's tried again.
+// It may if there was no reply (the request wasn't delivered, or timed out), or if the run database replied
+// with an AMQP or resource error, or a timeout.
+func registrationIsRetriable(reply P8Message) bool {
+	if reply.MsgType != MTReply {
+		return true
+	}
+	switch {
+	case reply.RetCode >= 100 && reply.RetCode < 300:
+		return true
+	case reply.RetCode == RCErrTimeout, reply.RetCode == RCErrClientTimeout:
+		return true
+	}
+	return false
+}
+
+// registerFile sends the registration request for a file, and retries it until it succeeds, it fails permanently,
+// or the attempts run out.  Retries are abandoned if a message is received on the control queue, in which case stopped is true.
+func registerFile(header FileInfo, settings registrationSettings, ctrlQueue chan ControlMessage) (databaseID string, stopped bool, e error) {
+	payload := registrationPayload(header, settings.RunIDKey)
+	retryDelay := settings.RetryDelay
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+		reply, reqErr := Request(ctx, settings.Target, MOCommand, payload)
+		cancel()
+		if reqErr == nil {
+			if idIfc, hasID := GetPayloadValue(reply.Payload, settings.IDKey); hasID {
+				if ids := ConvertToStringSlice(idIfc); len(ids) > 0 {
+					databaseID = ids[0]
+				}
+			}
+			return
+		}
+
+		if !registrationIsRetriable(reply) {
+			e = fmt.Errorf("Registration of <%s> was rejected: %v", header.Filename, reqErr)
+			return
+		}
+		if attempt >= settings.MaxAttempts {
+			e = fmt.Errorf("Registration of <%s> failed after %d attempt(s): %v", header.Filename, attempt, reqErr)
+			return
+		}
+		Log.Warningf("Registration of <%s> failed (attempt %d of %d); retrying in %v: %v", header.Filename, attempt, settings.MaxAttempts, retryDelay, reqErr)
+		select {
+		case <-time.After(retryDelay):
+		case <-ctrlQueue:
+			stopped = true
+			return
+		}
+		retryDelay *= 2
+	}
+}
+
+// Registrar receives classified files, and registers each with the run database.
+// The database ID is returned with the file; if registration fails, the error is fatal.
+// Several registrars can share the file stream, so that one file's retries don't hold up the others.
+func Registrar(context OperatorContext, id RegistrarID) {
+	// decrement the wg counter at the end
+	defer context.PoolCount.Done()
+	defer Log.Infof("Registrar (%d) is finished.", id)
+
+	settings, settingsErr := getRegistrationSettings()
+	if settingsErr != nil {
+		Log.Critical(settingsErr.Error())
+		context.ReqQueue <- ThreadCannotContinue
+		return
+	}
+	Log.Debugf("Registration settings: %+v", settings)
+
+	if !AmqpSenderIsActive.Load() || !AmqpReceiverIsActive.Load() {
+		// sometimes the AMQP sender and receiver take a little time to startup, so wait a second
+		waitTime := 1
+		if viper.IsSet("registration.wait-for-sender") {
+			waitTime = viper.GetInt("registration.wait-for-sender")
+		} else if viper.IsSet("classifier.wait-for-sender") {
+			waitTime = viper.GetInt("classifier.wait-for-sender")
+		}
+		time.Sleep(time.Duration(waitTime) * time.Second)
+		if !AmqpSenderIsActive.Load() || !AmqpReceiverIsActive.Load() {
+			Log.Criticalf("Cannot start registrar (%d) because the AMQP sender and receiver routines are not active", id)
+			context.ReqQueue <- ThreadCannotContinue
+			return
+		}
+	}
+
+	Log.Infof("Registrar (%d) started successfully", id)
+
+registerLoop:
+	for {
+		select {
+		// the control messages can stop execution
+		case controlMsg, queueOk := <-context.CtrlQueue:
+			if !queueOk {
+				Log.Error("Control queue has closed unexpectedly")
+				break registerLoop
+			}
+			if controlMsg == StopExecution {
+				Log.Infof("Registrar (%d) stopping on interrupt.", id)
+				break registerLoop
+			}
+		case fileHeader, queueOk := <-context.FileStream:
+			if !queueOk {
+				Log.Error("File stream has closed unexpectedly")
+				context.ReqQueue <- StopExecution
+				break registerLoop
+			}
+			opReturn := OperatorReturn{
+				Operator: fmt.Sprintf("registrar_%d", id),
+				FHeader:  fileHeader,
+				Err:      nil,
+				IsFatal:  false,
+			}
+
+			databaseID, stopped, regErr := registerFile(fileHeader, settings, context.CtrlQueue)
+			if stopped {
+				Log.Infof("Registrar (%d) stopping on interrupt.", id)
+				break registerLoop
+			}
+			if regErr != nil {
+				opReturn.Err = regErr
+				opReturn.IsFatal = true
+				Log.Error(regErr.Error())
+			} else {
+				opReturn.FHeader.DatabaseID = databaseID
+				Log.Infof("Registered <%s> with the run database (ID: %s)", fileHeader.Filename, databaseID)
+			}
+			context.RetStream <- opReturn
+		}
+	}
+}
+
+// recallDatabaseID gives a file the database ID that was recorded for it, if it was registered while
+// it was in another stage
+func recallDatabaseID(header *FileInfo) {
+	if header.DatabaseID == "" {
+		header.DatabaseID = getFileDatabaseID(header.FileHotPath)
+	}
+}
@@ -0,0 +1,359 @@
+/*
+* runs.go
+*
+* the run tracker groups files into runs according to a metadata key (e.g. the run_id
+* captured by the classifier), determines when each run is complete, and then
+* performs the run-level jobs and notifications.
+*
+* A run is complete when no files from the run are still being processed and one of the following has occurred:
+*    - a file of an end-of-run type has finished processing;
+*    - a run-stop request has been received via AMQP;
+*    - no files from the run have been seen for the inactivity timeout.
+ */
+
+package hornet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RunEventType specifies what happened to a file, as reported to the run tracker
+type RunEventType uint
+
+const (
+	// RunFileStarted indicates that a file has been classified and is being processed
+	RunFileStarted RunEventType = iota
+	// RunFileFinished indicates that all processing of a file has finished successfully
+	RunFileFinished
+	// RunFileFailed indicates that processing of a file was stopped by a fatal error
+	RunFileFailed
+)
+
+// RunEvent is sent from the scheduler to the run tracker as files move through hornet
+type RunEvent struct {
+	Type    RunEventType
+	FHeader FileInfo
+}
+
+// RunInfo holds the information about a group of files that make up a run.
+// It's also used as the data for the run-job command templates.
+type RunInfo struct {
+	Key          string
+	ID           string
+	Files        []FileInfo
+	NFiles       int
+	NFailed      int
+	TotalBytes   int64
+	StartTime    time.Time
+	LastActivity time.Time
+	EndReason    string
+	ended        bool
+	inFlight     int
+}
+
+type RunJobInfo struct {
+	Name            string
+	Command         string
+	CommandTemplate *template.Template
+}
+
+// RunStopRequest asks the run tracker to end a run, identified by the value of the grouping key.
+// If the reply channel is not nil, the outcome is sent on it: nil if the run is being tracked; otherwise an error,
+// and the stop is kept pending, so that the run ends once its files have arrived and been processed.
+type RunStopRequest struct {
+	ID        string
+	ReplyChan chan error
+}
+
+// Globally-accessible queue for requests to stop a run
+var RunStopQueue = make(chan RunStopRequest, 10)
+
+// Value to confirm that the run tracker routine has started
+var RunTrackerIsActive atomic.Bool
+
+// ValidateRunsConfig checks the sanity of the runs section of a configuration.
+// It makes the following guarantees
+//   1) The grouping key is set
+//   2) Each run job has a name and a valid command template
+func ValidateRunsConfig() (e error) {
+	if viper.GetBool("runs.active") == false {
+		return
+	}
+
+	if viper.GetString("runs.group-by") == "" {
+		e = errors.New("The key used to group files into runs is not set (runs.group-by)")
+		Log.Error(e.Error())
+	}
+
+	if jobsRawIfc := viper.Get("runs.jobs"); jobsRawIfc != nil {
+		for iJob, jobMapIfc := range jobsRawIfc.([]interface{}) {
+			jobMap := jobMapIfc.(map[string](interface{}))
+			if name, hasName := jobMap["name"]; !hasName || name.(string) == "" {
+				e = fmt.Errorf("Run job %d is missing its name", iJob)
+				Log.Error(e.Error())
+			}
+			command, hasCommand := jobMap["command"]
+			if !hasCommand {
+				e = fmt.Errorf("Run job %d is missing its command", iJob)
+				Log.Error(e.Error())
+				continue
+			}
+			if _, cmdErr := template.New("cmd").Parse(command.(string)); cmdErr != nil {
+				e = fmt.Errorf("Template error in run job %d <%v>: %v", iJob, command, cmdErr)
+				Log.Error(e.Error())
+			}
+		}
+	}
+
+	return
+}
+
+// executeRunJob runs the command for a run job; the command template is filled in with the run information
+func executeRunJob(job RunJobInfo, run RunInfo) (e error) {
+	var cmdBuf bytes.Buffer
+	if tmplErr := job.CommandTemplate.Execute(&cmdBuf, run); tmplErr != nil {
+		e = fmt.Errorf("Unable to fill in the command for run job <%s>: %v", job.Name, tmplErr)
+		return
+	}
+	commandParts := strings.Fields(cmdBuf.String())
+	if len(commandParts) == 0 {
+		e = fmt.Errorf("Command for run job <%s> is empty", job.Name)
+		return
+	}
+	Log.Infof("Executing run job <%s>: %s %v", job.Name, commandParts[0], commandParts[1:])
+	startTime := time.Now()
+	outputBytes, runErr := exec.Command(commandParts[0], commandParts[1:]...).CombinedOutput()
+	if runErr != nil {
+		e = fmt.Errorf("Error running run job <%s> [%v].  Log: %v", job.Name, runErr, string(outputBytes))
+		return
+	}
+	Log.Infof("Run job <%s> finished.  Elapsed time: %v", job.Name, time.Since(startTime))
+	Log.Debugf("Run job output:\n%s", string(outputBytes))
+	return
+}
+
+// finishRun performs the run-level jobs and notifications for a completed run
+func finishRun(run RunInfo, jobs []RunJobInfo, sendTo string) {
+	Log.Noticef("Run %s=%s is complete (%s):\n\t - %d file(s) processed\n\t - %d file(s) failed\n\t - %d bytes\n\t - Duration: %v",
+		run.Key, run.ID, run.EndReason, run.NFiles, run.NFailed, run.TotalBytes, run.LastActivity.Sub(run.StartTime))
+
+	nJobErrors := 0
+	for _, job := range jobs {
+		if jobErr := executeRunJob(job, run); jobErr != nil {
+			Log.Error(jobErr.Error())
+			nJobErrors++
+		}
+	}
+
+	if sendTo != "" && AmqpSenderIsActive.Load() {
+		filenames := make([]string, 0, len(run.Files))
+		for _, file := range run.Files {
+			filenames = append(filenames, file.Filename)
+		}
+		runMessage := PrepareAlert([]string{sendTo}, "application/json")
+		runMessage.Payload = map[string]interface{}{
+			"group_key":    run.Key,
+			"group_value":  run.ID,
+			"end_reason":   run.EndReason,
+			"n_files":      run.NFiles,
+			"n_failed":     run.NFailed,
+			"total_bytes":  run.TotalBytes,
+			"start_time":   run.StartTime.UTC().Format(TimeFormat),
+			"end_time":     run.LastActivity.UTC().Format(TimeFormat),
+			"file_names":   filenames,
+			"n_job_errors": nJobErrors,
+		}
+		SendMessageQueue <- runMessage
+	}
+}
+
+// RunTracker is a goroutine that receives file events from the scheduler, groups the files into runs,
+// and finishes each run once it's complete.
+func RunTracker(eventQueue chan RunEvent, ctrlQueue, reqQueue chan ControlMessage, poolCount *sync.WaitGroup) {
+	// decrement the wg counter at the end
+	defer poolCount.Done()
+	defer Log.Info("Run tracker is finished.")
+
+	if configErr := ValidateRunsConfig(); configErr != nil {
+		Log.Criticalf("Error in the runs configuration: %s", configErr.Error())
+		reqQueue <- ThreadCannotContinue
+		return
+	}
+
+	groupKey := viper.GetString("runs.group-by")
+	endOfRunTypes := viper.GetStringSlice("runs.end-of-run-types")
+	sendTo := viper.GetString("runs.send-to")
+
+	inactivityTimeout := 10 * time.Minute
+	if viper.IsSet("runs.timeout") {
+		inactivityTimeout = viper.GetDuration("runs.timeout")
+	}
+	Log.Debugf("Run inactivity timeout: %v", inactivityTimeout)
+
+	var jobs []RunJobInfo
+	if jobsRawIfc := viper.Get("runs.jobs"); jobsRawIfc != nil {
+		for _, jobMapIfc := range jobsRawIfc.([]interface{}) {
+			jobMap := jobMapIfc.(map[string](interface{}))
+			job := RunJobInfo{
+				Name:    jobMap["name"].(string),
+				Command: jobMap["command"].(string),
+			}
+			job.CommandTemplate = template.Must(template.New("cmd").Parse(job.Command))
+			Log.Debugf("Adding run job:\n\t%v", job)
+			jobs = append(jobs, job)
+		}
+	}
+
+	isEndOfRunType := func(fileType string) bool {
+		for _, endType := range endOfRunTypes {
+			if endType == fileType {
+				return true
+			}
+		}
+		return false
+	}
+
+	// runs that are in progress, by the value of the grouping key
+	runs := make(map[string]*RunInfo)
+
+	completeRun := func(id string, reason string) {
+		run := runs[id]
+		run.EndReason = reason
+		delete(runs, id)
+		// run jobs can be slow, so they're performed asynchronously
+		poolCount.Add(1)
+		go func(run RunInfo) {
+			defer poolCount.Done()
+			finishRun(run, jobs, sendTo)
+		}(*run)
+	}
+
+	// stop requests for runs that aren't being tracked yet, with the times they were received;
+	// they're forgotten if no file from the run arrives within the inactivity timeout
+	pendingStops := make(map[string]time.Time)
+
+	checkInterval := time.Second
+	if inactivityTimeout < checkInterval {
+		checkInterval = inactivityTimeout
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	Log.Infof("Run tracker started successfully; grouping files by <%s>", groupKey)
+	RunTrackerIsActive.Store(true)
+	defer func() { RunTrackerIsActive.Store(false) }()
+
+runLoop:
+	for {
+		select {
+		case controlMsg, queueOk := <-ctrlQueue:
+			if !queueOk {
+				Log.Error("Control queue has closed unexpectedly")
+				break runLoop
+			}
+			if controlMsg == StopExecution {
+				Log.Info("Run tracker stopping on interrupt.")
+				for id, run := range runs {
+					Log.Warningf("Run %s=%s is incomplete: %d file(s) finished, %d in progress", groupKey, id, run.NFiles, run.inFlight)
+				}
+				break runLoop
+			}
+		case event, queueOk := <-eventQueue:
+			if !queueOk {
+				Log.Error("Run event queue has closed unexpectedly")
+				reqQueue <- StopExecution
+				break runLoop
+			}
+			id, hasKey := event.FHeader.Metadata[groupKey]
+			if !hasKey {
+				continue runLoop
+			}
+			now := time.Now()
+			run, runExists := runs[id]
+			if !runExists {
+				if event.Type != RunFileStarted {
+					Log.Warningf("Received an event for file <%s> from a run that is not being tracked (%s=%s)", event.FHeader.Filename, groupKey, id)
+					continue runLoop
+				}
+				Log.Infof("Starting to track run %s=%s", groupKey, id)
+				run = &RunInfo{
+					Key:       groupKey,
+					ID:        id,
+					StartTime: now,
+				}
+				runs[id] = run
+				if _, isPending := pendingStops[id]; isPending {
+					Log.Infof("Run %s=%s was stopped before its first file arrived", groupKey, id)
+					delete(pendingStops, id)
+					run.ended = true
+					run.EndReason = "run-stop request"
+				}
+			}
+			run.LastActivity = now
+			switch event.Type {
+			case RunFileStarted:
+				run.inFlight++
+			case RunFileFinished:
+				run.inFlight--
+				run.NFiles++
+				run.Files = append(run.Files, event.FHeader)
+				run.TotalBytes += event.FHeader.Size
+				if isEndOfRunType(event.FHeader.FileType) {
+					Log.Infof("End-of-run file <%s> received for run %s=%s", event.FHeader.Filename, groupKey, id)
+					run.ended = true
+					if run.EndReason == "" {
+						run.EndReason = "end-of-run file"
+					}
+				}
+			case RunFileFailed:
+				run.inFlight--
+				run.NFailed++
+			}
+			if run.ended && run.inFlight <= 0 {
+				completeRun(id, run.EndReason)
+			}
+		case stopRequest := <-RunStopQueue:
+			id := stopRequest.ID
+			run, runExists := runs[id]
+			if !runExists {
+				Log.Warningf("Run-stop request received for a run that is not being tracked (%s=%s); it will be stopped if its files arrive within %v", groupKey, id, inactivityTimeout)
+				pendingStops[id] = time.Now()
+				if stopRequest.ReplyChan != nil {
+					stopRequest.ReplyChan <- fmt.Errorf("Run %s=%s is not being tracked", groupKey, id)
+				}
+				continue runLoop
+			}
+			Log.Infof("Run-stop request received for run %s=%s", groupKey, id)
+			run.ended = true
+			run.EndReason = "run-stop request"
+			if run.inFlight <= 0 {
+				completeRun(id, run.EndReason)
+			}
+			if stopRequest.ReplyChan != nil {
+				stopRequest.ReplyChan <- nil
+			}
+		case now := <-ticker.C:
+			for id, run := range runs {
+				if run.inFlight <= 0 && now.Sub(run.LastActivity) >= inactivityTimeout {
+					completeRun(id, "inactivity timeout")
+				}
+			}
+			for id, received := range pendingStops {
+				if now.Sub(received) >= inactivityTimeout {
+					Log.Infof("No files arrived for run %s=%s after it was stopped; the stop request is forgotten", groupKey, id)
+					delete(pendingStops, id)
+				}
+			}
+		} // select
+	} // for
+}
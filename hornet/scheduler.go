@@ -9,7 +9,10 @@
 package hornet
 
 import (
+	"errors"
+	"fmt"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,6 +24,8 @@ type OperatorReturn struct {
 	FHeader  FileInfo
 	Err      error
 	IsFatal  bool
+	// for the shippers, the name of the destination
+	Destination string
 }
 
 type OperatorContext struct {
@@ -36,23 +41,126 @@ type OperatorContext struct {
 var filesScheduled, filesFinished int
 var summaryInterval time.Duration
 
+// number of files that skipped nearline processing because no worker was available, and number waiting for a worker
+var filesSkipped, filesWaiting int
+
+// number of files accepted by the scheduler that haven't finished or failed
+var filesInPipeline int
+
+// queue for file events sent to the run tracker; nil if the run tracker is not in use
+var runEventQueue chan RunEvent
+
+// events that couldn't be passed to the run tracker without waiting; they're sent, in order, as its queue empties
+var runEventsPending []RunEvent
+
+func notifyRunTracker(eventType RunEventType, header *FileInfo) {
+	if runEventQueue != nil {
+		runEventsPending = append(runEventsPending, RunEvent{Type: eventType, FHeader: *header})
+		flushRunEvents()
+	}
+}
+
+// flushRunEvents passes pending events to the run tracker until its queue is full
+func flushRunEvents() {
+	for len(runEventsPending) > 0 {
+		select {
+		case runEventQueue <- runEventsPending[0]:
+			runEventsPending = runEventsPending[1:]
+		default:
+			return
+		}
+	}
+}
+
+// shipped hot files that couldn't be passed to the janitor without waiting; they're sent, in order, as its queue empties
+var janitorShippedPending []FileInfo
+
+// flushJanitorShipped passes pending shipped files to the janitor until its queue is full
+func flushJanitorShipped() {
+	for len(janitorShippedPending) > 0 {
+		select {
+		case janitorShippedQueue <- janitorShippedPending[0]:
+			janitorShippedPending = janitorShippedPending[1:]
+		default:
+			return
+		}
+	}
+}
+
 func finishFile(header *FileInfo) {
 	Log.Infof("Completed work on file <%s>", header.Filename)
 	filesFinished++
+	filesInPipeline--
+	forgetFile(header.FileHotPath)
+	notifyRunTracker(RunFileFinished, header)
+}
+
+// failFile is used when processing of a file is stopped by a fatal error after it was classified
+func failFile(header *FileInfo, stage string, failErr error) {
+	filesInPipeline--
+	forgetFile(header.FileHotPath)
+	notifyRunTracker(RunFileFailed, header)
+	PublishEvent(EventFailed, *header, failureDetails(stage, failErr))
+}
+
+// failureDetails gives the details for the event of a file that failed in a stage
+func failureDetails(stage string, failErr error) map[string]interface{} {
+	details := map[string]interface{}{"stage": stage}
+	if failErr != nil {
+		details["error"] = failErr.Error()
+	}
+	return details
+}
+
+// the scheduling queue of the running scheduler, for files submitted with ScheduleFile
+var activeSchQueue chan string
+var activeSchQueueMutex sync.RWMutex
+
+// ScheduleFile submits a file to the running scheduler (e.g. on a remote request); an error is returned if it can't be submitted without waiting
+func ScheduleFile(path string) error {
+	activeSchQueueMutex.RLock()
+	defer activeSchQueueMutex.RUnlock()
+	if activeSchQueue == nil {
+		return errors.New("The scheduler is not running")
+	}
+	select {
+	case activeSchQueue <- path:
+		return nil
+	default:
+		return fmt.Errorf("The scheduling queue is full; <%s> was not scheduled", path)
+	}
 }
 
 func summaryLoop() {
 	time.Sleep(summaryInterval)
-	if filesScheduled != 0 || filesFinished != 0 {
-		Log.Noticef("Scheduler summary:\n\tIn the past %v,\n\t - Scheduled %d file(s)\n\t - Finished %d file(s)", summaryInterval, filesScheduled, filesFinished)
+	if filesScheduled != 0 || filesFinished != 0 || filesSkipped != 0 {
+		Log.Noticef("Scheduler summary:\n\tIn the past %v,\n\t - Scheduled %d file(s)\n\t - Finished %d file(s)\n\t - Skipped nearline processing for %d file(s)\n\t - %d file(s) waiting for a worker", summaryInterval, filesScheduled, filesFinished, filesSkipped, filesWaiting)
 		filesScheduled = 0
 		filesFinished = 0
+		filesSkipped = 0
+		stats := GetPipelineStats()
+		queueSummary := fmt.Sprintf("Queue summary:\n\t - %d file(s) in the pipeline\n\t - %d file(s) waiting to be scheduled\n\t - %d file(s) held by the watcher", stats.InPipeline, stats.SchQueueDepth, stats.WatcherPending)
+		for _, stage := range stats.Stages {
+			queueSummary += fmt.Sprintf("\n\t - %s: %d in flight (limit %d; %d queued), %d pending", stage.Name, stage.InFlight, stage.Limit, stage.Queued, stage.Pending)
+			if stage.Paused {
+				queueSummary += " (paused)"
+			}
+		}
+		Log.Info(queueSummary)
 	} /* else {
 		Log.Notice("No files scheduled or finished in the past %v", summaryInterval)
 	}*/
 	go summaryLoop()
 }
 
+// GetStageCount returns the number of instances configured for a stage (e.g. mover.n-movers); the default is 1
+func GetStageCount(key string) int {
+	if viper.IsSet(key) == false {
+		return 1
+	}
+	return viper.GetInt(key)
+}
+
 func Scheduler(schQueue chan string, ctrlQueue, reqQueue chan ControlMessage, threadCountQueue chan uint, poolCount *sync.WaitGroup) {
 	// Decrement the waitgroup counter when done
 	defer poolCount.Done()
@@ -74,28 +182,105 @@ func Scheduler(schQueue chan string, ctrlQueue, reqQueue chan ControlMessage, th
 		return
 	}
 
+	// by default, files skip nearline processing if no worker is available; otherwise they wait in the priority queue
+	waitForWorkers := viper.GetBool("scheduler.wait-for-workers")
+	maxWaiting := viper.GetInt("scheduler.max-waiting")
+	priorityAging := viper.GetDuration("scheduler.priority-aging")
+	Log.Debugf("Wait for workers: %v (max. waiting: %d; priority aging: %v)", waitForWorkers, maxWaiting, priorityAging)
+	workerWaitQueue := newWorkerPriorityQueue(priorityAging)
+
 	shipperIsActive := viper.GetBool("shipper.active")
 	Log.Debugf("Shipper active: %v", shipperIsActive)
 
-	// for now, we require that there's only 1 shipper
-	if viper.GetInt("shipper.n-shippers") != 1 {
-		Log.Critical("Currently can only have 1 shipper")
+	// movers and shippers share their stage queues; the number of concurrent transfers to each destination can be limited
+	nMovers := GetStageCount("mover.n-movers")
+	nShippers := GetStageCount("shipper.n-shippers")
+	Log.Debugf("Number of movers: %d; number of shippers: %d", nMovers, nShippers)
+	if nMovers <= 0 || nShippers <= 0 {
+		Log.Critical("Numbers of movers and shippers must be > 0")
 		reqQueue <- ThreadCannotContinue
 		return
 	}
+	moverLimiter := NewDestinationLimiter(viper.GetInt("mover.max-per-destination"))
+	shipperLimiter := NewDestinationLimiter(viper.GetInt("shipper.max-per-destination"))
+
+	// each file is shipped to the destinations that apply to its type
+	var shippingDestinations []ShippingDestination
+	if shipperIsActive {
+		var destErr error
+		if shippingDestinations, destErr = GetShippingDestinations(); destErr != nil {
+			Log.Criticalf("Error in the shipping destinations: %v", destErr)
+			reqQueue <- ThreadCannotContinue
+			return
+		}
+		for _, destination := range shippingDestinations {
+			Log.Debugf("Shipping destination <%s>: required: %v; types: %v", destination.Name, destination.Required, destination.Types)
+		}
+	}
+
+	// files are registered with the run database after they're classified (see registration.go); if registration is
+	// required, files are only moved once they're registered
+	registrationIsActive := RegistrationIsActive()
+	registrationIsRequired := RegistrationIsRequired()
+	nRegistrars := GetStageCount("registration.n-registrars")
+	Log.Debugf("Registration active: %v (required: %v; number of registrars: %d)", registrationIsActive, registrationIsRequired, nRegistrars)
+	if registrationIsActive {
+		if configErr := ValidateRegistrationConfig(); configErr != nil {
+			Log.Criticalf("Error in the registration configuration: %v", configErr)
+			reqQueue <- ThreadCannotContinue
+			return
+		}
+		if nRegistrars <= 0 {
+			Log.Critical("Number of registrars must be > 0")
+			reqQueue <- ThreadCannotContinue
+			return
+		}
+	}
+
+	// limit on the number of files in the pipeline; when it's reached, no new files are accepted
+	maxInPipeline := viper.GetInt("scheduler.max-in-pipeline")
+	Log.Debugf("Maximum number of files in the pipeline: %d", maxInPipeline)
 
 	// create the file queues
+	// the worker queue must be able to hold a file for each worker
 	classifierQueue := make(chan FileInfo, queueSize)
 	moverQueue := make(chan FileInfo, queueSize)
-	workerQueue := make(chan FileInfo, queueSize)
-	shipperQueue := make(chan FileInfo, queueSize)
+	workerQueueSize := queueSize
+	if nWorkers > workerQueueSize {
+		workerQueueSize = nWorkers
+	}
+	workerQueue := make(chan FileInfo, workerQueueSize)
+
+	// the stage dispatchers pass files to the stages without blocking
+	classifierStage := newStageDispatcher("classifier", classifierQueue, viper.GetInt("scheduler.max-in-flight.classifier"))
+	moverStage := newStageDispatcher("mover", moverQueue, viper.GetInt("scheduler.max-in-flight.mover"))
+	var registrationStage *stageDispatcher
+	if registrationIsActive {
+		registrationStage = newStageDispatcher("registration", make(chan FileInfo, queueSize), viper.GetInt("scheduler.max-in-flight.registration"))
+	}
+	// each shipping destination has its own queue and shippers
+	var shipperStages []*stageDispatcher
+	shipperStagesByDestination := make(map[string]*stageDispatcher)
+	for _, destination := range shippingDestinations {
+		stageName := "shipper"
+		if len(shippingDestinations) > 1 || destination.Name != DefaultDestinationName {
+			stageName = "shipper:" + destination.Name
+		}
+		shipperStage := newStageDispatcher(stageName, make(chan FileInfo, queueSize), viper.GetInt("scheduler.max-in-flight.shipper"))
+		shipperStages = append(shipperStages, shipperStage)
+		shipperStagesByDestination[destination.Name] = shipperStage
+	}
 
 	// create the return queues
 	classifierRetQueue := make(chan OperatorReturn, queueSize)
 	moverRetQueue := make(chan OperatorReturn, queueSize)
+	registrationRetQueue := make(chan OperatorReturn, queueSize)
 	workerRetQueue := make(chan OperatorReturn, queueSize)
 	shipperRetQueue := make(chan OperatorReturn, queueSize)
 
+	// alerts are published as files pass through the pipeline (see events.go); this is set up before the stages are started
+	ConfigurePipelineEvents()
+
 	// setup the classifier
 	classifierCtx := OperatorContext{
 		SchStream:        schQueue,
@@ -120,9 +305,29 @@ func Scheduler(schQueue chan string, ctrlQueue, reqQueue chan ControlMessage, th
 		ThreadCountQueue: threadCountQueue,
 		PoolCount:        poolCount,
 	}
-	poolCount.Add(1)
-	threadCountQueue <- 1
-	go Mover(moverCtx)
+	for i := 0; i < nMovers; i++ {
+		poolCount.Add(1)
+		threadCountQueue <- 1
+		go Mover(moverCtx, MoverID(i), moverLimiter)
+	}
+
+	// setup the registrars
+	if registrationIsActive {
+		registrationCtx := OperatorContext{
+			SchStream:        schQueue,
+			FileStream:       registrationStage.queue,
+			RetStream:        registrationRetQueue,
+			CtrlQueue:        ctrlQueue,
+			ReqQueue:         reqQueue,
+			ThreadCountQueue: threadCountQueue,
+			PoolCount:        poolCount,
+		}
+		for i := 0; i < nRegistrars; i++ {
+			poolCount.Add(1)
+			threadCountQueue <- 1
+			go Registrar(registrationCtx, RegistrarID(i))
+		}
+	}
 
 	// setup the workers
 	workerCtx := OperatorContext{
@@ -140,20 +345,41 @@ func Scheduler(schQueue chan string, ctrlQueue, reqQueue chan ControlMessage, th
 		go Worker(workerCtx, WorkerID(i))
 	}
 
-	if shipperIsActive {
-		// setup the shipper
+	// setup the shippers for each destination
+	for iDestination, destination := range shippingDestinations {
 		shipperCtx := OperatorContext{
 			SchStream:        schQueue,
-			FileStream:       shipperQueue,
+			FileStream:       shipperStages[iDestination].queue,
 			RetStream:        shipperRetQueue,
 			CtrlQueue:        ctrlQueue,
 			ReqQueue:         reqQueue,
 			ThreadCountQueue: threadCountQueue,
 			PoolCount:        poolCount,
 		}
+		for i := 0; i < nShippers; i++ {
+			poolCount.Add(1)
+			threadCountQueue <- 1
+			go Shipper(shipperCtx, ShipperID(iDestination*nShippers+i), destination, shipperLimiter)
+		}
+	}
+
+	// setup the run tracker
+	runEventsPending = nil
+	if viper.GetBool("runs.active") {
+		runEventQueue = make(chan RunEvent, queueSize)
+		poolCount.Add(1)
+		threadCountQueue <- 1
+		go RunTracker(runEventQueue, ctrlQueue, reqQueue, poolCount)
+	}
+
+	// setup the janitor
+	sourcePolicy, _ := GetSourcePolicy()
+	janitorShippedPending = nil
+	if JanitorIsNeeded() {
+		janitorShippedQueue = make(chan FileInfo, queueSize)
 		poolCount.Add(1)
 		threadCountQueue <- 1
-		go Shipper(shipperCtx)
+		go Janitor(janitorShippedQueue, ctrlQueue, reqQueue, poolCount)
 	}
 
 	// setup the watcher
@@ -174,8 +400,84 @@ func Scheduler(schQueue chan string, ctrlQueue, reqQueue chan ControlMessage, th
 
 	workersWorking := int(0)
 
+	sendToWorkers := func(fileHeader FileInfo) {
+		Log.Infof("Sending <%s> to the workers (priority %d)", fileHeader.Filename, fileHeader.Priority)
+		setFileStage(fileHeader.FileHotPath, "workers")
+		workersWorking++
+		workerWaitQueue.StartedFile(fileHeader.FileType)
+		workerQueue <- fileHeader
+	}
+
+	// files being shipped, by warm path; a file is finished once all of its shipments have returned
+	shipments := make(map[string]*fileShipments)
+
+	sendToShippers := func(fileHeader FileInfo) {
+		tracker := &fileShipments{header: fileHeader, statuses: make(map[string]ShipmentStatus)}
+		for _, destination := range shippingDestinations {
+			if destination.AppliesTo(fileHeader.FileType) {
+				tracker.statuses[destination.Name] = ShipmentStatus{Required: destination.Required}
+				tracker.pending++
+			}
+		}
+		if tracker.pending == 0 {
+			Log.Infof("No shipping destinations for <%s> (type %s)", fileHeader.Filename, fileHeader.FileType)
+			finishFile(&fileHeader)
+			return
+		}
+		shipments[fileHeader.FileWarmPath] = tracker
+		var stageNames []string
+		for _, destination := range shippingDestinations {
+			if _, isShipped := tracker.statuses[destination.Name]; isShipped {
+				shipperStagesByDestination[destination.Name].Submit(fileHeader)
+				stageNames = append(stageNames, shipperStagesByDestination[destination.Name].name)
+			}
+		}
+		setFileStage(fileHeader.FileHotPath, strings.Join(stageNames, ", "))
+	}
+
 	filesScheduled = 0
 	filesFinished = 0
+	filesSkipped = 0
+	filesWaiting = 0
+	filesInPipeline = 0
+
+	updateStats := func() {
+		stages := []StageStats{classifierStage.Stats()}
+		if registrationStage != nil {
+			stages = append(stages, registrationStage.Stats())
+		}
+		stages = append(stages, moverStage.Stats(), StageStats{
+			Name:     "workers",
+			Pending:  workerWaitQueue.Len(),
+			Queued:   len(workerQueue),
+			InFlight: workersWorking,
+			Limit:    nWorkers,
+		})
+		for _, shipperStage := range shipperStages {
+			stages = append(stages, shipperStage.Stats())
+		}
+		setPipelineStats(PipelineStats{
+			Stages:        stages,
+			InPipeline:    filesInPipeline,
+			MaxInPipeline: maxInPipeline,
+			SchQueueDepth: len(schQueue),
+		})
+	}
+
+	// stage queues are normally refilled when files are returned, but are also checked periodically
+	dispatchTicker := time.NewTicker(time.Second)
+	defer dispatchTicker.Stop()
+	wasSaturated := false
+
+	// files can now be submitted remotely
+	activeSchQueueMutex.Lock()
+	activeSchQueue = schQueue
+	activeSchQueueMutex.Unlock()
+	defer func() {
+		activeSchQueueMutex.Lock()
+		activeSchQueue = nil
+		activeSchQueueMutex.Unlock()
+	}()
 
 	summaryInterval = viper.GetDuration("scheduler.summary-interval")
 	Log.Infof("Scheduler summary interval: %v", summaryInterval)
@@ -183,6 +485,21 @@ func Scheduler(schQueue chan string, ctrlQueue, reqQueue chan ControlMessage, th
 
 scheduleLoop:
 	for {
+		updateStats()
+
+		// stop accepting new files if the pipeline is saturated
+		schInput := schQueue
+		if maxInPipeline > 0 && filesInPipeline >= maxInPipeline {
+			schInput = nil
+			if !wasSaturated {
+				Log.Infof("Pipeline is saturated (%d files); no new files will be accepted until files finish", filesInPipeline)
+				wasSaturated = true
+			}
+		} else if wasSaturated {
+			Log.Info("Pipeline is no longer saturated; accepting new files")
+			wasSaturated = false
+		}
+
 		select {
 		case controlMsg, queueOk := <-ctrlQueue:
 			if !queueOk {
@@ -195,7 +512,18 @@ scheduleLoop:
 				close(workerQueue)
 				break scheduleLoop
 			}
-		case file, queueOk := <-schQueue:
+		case <-dispatchTicker.C:
+			flushRunEvents()
+			flushJanitorShipped()
+			classifierStage.Dispatch()
+			if registrationStage != nil {
+				registrationStage.Dispatch()
+			}
+			moverStage.Dispatch()
+			for _, shipperStage := range shipperStages {
+				shipperStage.Dispatch()
+			}
+		case file, queueOk := <-schInput:
 			if !queueOk {
 				Log.Error("Scheduler queue has closed unexpectedly")
 				reqQueue <- StopExecution
@@ -212,8 +540,8 @@ scheduleLoop:
 						FileHotPath: absPath,
 					}
 					filesScheduled++
-					Log.Infof("Sending <%s> to the classifier", fileHeader.Filename)
-					classifierQueue <- fileHeader
+					filesInPipeline++
+					classifierStage.Submit(fileHeader)
 				} else {
 					Log.Infof("<%s> is not a regular file; ignoring", absPath)
 				}
@@ -224,6 +552,7 @@ scheduleLoop:
 				reqQueue <- StopExecution
 				break scheduleLoop
 			}
+			classifierStage.Returned()
 			if fileRet.Err != nil {
 				severity := "warning"
 				if fileRet.IsFatal {
@@ -231,10 +560,56 @@ scheduleLoop:
 				}
 				Log.Infof("Received %s from the classifier:\n\t%v", severity, fileRet.Err)
 			}
+			// the submission priority is forgotten here even if the file won't be processed further
+			priority, hasPriority := takeSubmissionPriority(fileRet.FHeader.FileHotPath)
+			if fileRet.IsFatal == false {
+				fileHeader := fileRet.FHeader
+				if hasPriority {
+					fileHeader.Priority = priority
+				}
+				notifyRunTracker(RunFileStarted, &fileHeader)
+				PublishEvent(EventClassified, fileHeader, nil)
+				if registrationIsRequired {
+					registrationStage.Submit(fileHeader)
+					break
+				}
+				// the file is registered while it's moved; its stage is recorded as the mover
+				if registrationIsActive {
+					registrationStage.Submit(fileHeader)
+				}
+				moverStage.Submit(fileHeader)
+			} else {
+				filesInPipeline--
+				forgetFile(fileRet.FHeader.FileHotPath)
+				PublishEvent(EventFailed, fileRet.FHeader, failureDetails("classifier", fileRet.Err))
+			}
+		case fileRet, queueOk := <-registrationRetQueue:
+			if !queueOk {
+				Log.Error("Registration return queue has closed unexpectedly")
+				reqQueue <- StopExecution
+				break scheduleLoop
+			}
+			registrationStage.Returned()
+			if fileRet.Err != nil {
+				severity := "warning"
+				if fileRet.IsFatal {
+					severity = "error"
+				}
+				Log.Infof("Received %s from the registrar:\n\t%v", severity, fileRet.Err)
+			}
 			if fileRet.IsFatal == false {
 				fileHeader := fileRet.FHeader
-				Log.Infof("Sending <%s> to the mover", fileHeader.Filename)
-				moverQueue <- fileHeader
+				PublishEvent(EventRegistered, fileHeader, nil)
+				if registrationIsRequired {
+					moverStage.Submit(fileHeader)
+				} else {
+					// the file has moved on; the ID is given to it when it next returns to the scheduler
+					setFileDatabaseID(fileHeader.FileHotPath, fileHeader.DatabaseID)
+				}
+			} else if registrationIsRequired {
+				failFile(&fileRet.FHeader, "registration", fileRet.Err)
+			} else {
+				Log.Warningf("<%s> was not registered with the run database; processing continues", fileRet.FHeader.Filename)
 			}
 		case fileRet, queueOk := <-moverRetQueue:
 			if !queueOk {
@@ -242,6 +617,8 @@ scheduleLoop:
 				reqQueue <- StopExecution
 				break scheduleLoop
 			}
+			moverStage.Returned()
+			recallDatabaseID(&fileRet.FHeader)
 			if fileRet.Err != nil {
 				severity := "warning"
 				if fileRet.IsFatal {
@@ -251,20 +628,32 @@ scheduleLoop:
 			}
 			if fileRet.IsFatal == false {
 				fileHeader := fileRet.FHeader
-				// only send to the workers if the file requests it and there's a worker available
-				if len(fileHeader.JobQueue) > 0 && workersWorking < nWorkers {
-					Log.Infof("Sending <%s> to the workers", fileHeader.Filename)
-					workersWorking++
-					workerQueue <- fileHeader
+				PublishEvent(EventMoved, fileHeader, nil)
+				// only send to the workers if the file requests it and there's a worker available;
+				// if requested, files wait in the priority queue for a worker
+				hasJobs := len(fileHeader.JobQueue) > 0
+				if hasJobs && workersWorking < nWorkers && workerWaitQueue.Len() == 0 {
+					sendToWorkers(fileHeader)
 					//fmt.Println("[scheduler] workers working:", workersWorking)
+				} else if hasJobs && waitForWorkers && (maxWaiting <= 0 || workerWaitQueue.Len() < maxWaiting) {
+					Log.Infof("<%s> is waiting for a worker (priority %d; %d file(s) waiting)", fileHeader.Filename, fileHeader.Priority, workerWaitQueue.Len()+1)
+					workerWaitQueue.Push(fileHeader)
+					setFileStage(fileHeader.FileHotPath, "waiting for a worker")
+					filesWaiting = workerWaitQueue.Len()
 				} else {
+					if hasJobs {
+						Log.Infof("Skipping nearline processing for <%s>: all %d workers are busy and %d file(s) are waiting", fileHeader.Filename, nWorkers, workerWaitQueue.Len())
+						filesSkipped++
+					}
 					if shipperIsActive == true {
-						Log.Infof("Sending <%s> to shipper (skipping nearline)", fileHeader.Filename)
-						shipperQueue <- fileHeader
+						Log.Infof("<%s> will go to the shipper (skipping nearline)", fileHeader.Filename)
+						sendToShippers(fileHeader)
 					} else {
 						finishFile(&fileRet.FHeader)
 					}
 				}
+			} else {
+				failFile(&fileRet.FHeader, "mover", fileRet.Err)
 			}
 		case fileRet, queueOk := <-workerRetQueue:
 			if !queueOk {
@@ -273,6 +662,12 @@ scheduleLoop:
 				break scheduleLoop
 			}
 			workersWorking--
+			workerWaitQueue.FinishedFile(fileRet.FHeader.FileType)
+			if workerWaitQueue.Len() > 0 && workersWorking < nWorkers {
+				sendToWorkers(workerWaitQueue.Pop())
+				filesWaiting = workerWaitQueue.Len()
+			}
+			recallDatabaseID(&fileRet.FHeader)
 			if fileRet.Err != nil {
 				severity := "warning"
 				if fileRet.IsFatal {
@@ -283,11 +678,12 @@ scheduleLoop:
 			if fileRet.IsFatal == false {
 				if shipperIsActive == true {
 					fileHeader := fileRet.FHeader // original data file is still the input file from the worker
-					Log.Infof("Sending <%s> to the shipper", fileHeader.Filename)
-					shipperQueue <- fileHeader
+					sendToShippers(fileHeader)
 				} else {
 					finishFile(&fileRet.FHeader)
 				}
+			} else {
+				failFile(&fileRet.FHeader, "workers", fileRet.Err)
 			}
 		case fileRet, queueOk := <-shipperRetQueue:
 			if !queueOk {
@@ -295,15 +691,51 @@ scheduleLoop:
 				reqQueue <- StopExecution
 				break scheduleLoop
 			}
+			if shipperStage, hasStage := shipperStagesByDestination[fileRet.Destination]; hasStage {
+				shipperStage.Returned()
+			}
+			recallDatabaseID(&fileRet.FHeader)
 			if fileRet.Err != nil {
 				severity := "warning"
 				if fileRet.IsFatal {
 					severity = "error"
 				}
-				Log.Infof("Received %s from the shipper:\n\t%v", severity, fileRet.Err)
+				Log.Infof("Received %s from the shipper for destination <%s>:\n\t%v", severity, fileRet.Destination, fileRet.Err)
 			}
-			if fileRet.IsFatal == false {
-				finishFile(&fileRet.FHeader)
+			tracker, isTracked := shipments[fileRet.FHeader.FileWarmPath]
+			if !isTracked {
+				Log.Errorf("Received a shipment of <%s> that was not expected", fileRet.FHeader.Filename)
+				break
+			}
+			status := tracker.statuses[fileRet.Destination]
+			status.Shipped = fileRet.IsFatal == false
+			if fileRet.Err != nil {
+				status.Err = fileRet.Err.Error()
+			}
+			status.ColdPath = fileRet.FHeader.ColdPath
+			status.FileColdPath = fileRet.FHeader.FileColdPath
+			tracker.statuses[fileRet.Destination] = status
+			if status.Shipped {
+				PublishEvent(EventShipped, fileRet.FHeader, map[string]interface{}{"destination": fileRet.Destination})
+			}
+			if tracker.pending--; tracker.pending > 0 {
+				break
+			}
+
+			// all of the shipments have returned
+			delete(shipments, fileRet.FHeader.FileWarmPath)
+			fileHeader, succeeded := tracker.finish(shippingDestinations)
+			recallDatabaseID(&fileHeader)
+			// the hot file can be removed once it's been shipped successfully
+			if succeeded && sourcePolicy == SourceDeleteAfterShip && janitorShippedQueue != nil {
+				janitorShippedPending = append(janitorShippedPending, fileHeader)
+				flushJanitorShipped()
+			}
+			if succeeded {
+				finishFile(&fileHeader)
+			} else {
+				Log.Errorf("<%s> was not shipped to all of its required destinations", fileHeader.Filename)
+				failFile(&fileHeader, "shipper", errors.New("The file was not shipped to all of its required destinations"))
 			}
 		}
 	}
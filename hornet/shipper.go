@@ -1,41 +1,321 @@
 /*
 * shipper.go
 *
-* the shipper thread sends data files to a remote destination for long-term storage via rsync
+* the shipper thread sends data files to a remote destination for long-term storage.
+* The files are sent with a transport (rsync by default); see transport.go.
  */
 
 package hornet
 
 import (
 	"fmt"
-	"os/exec"
+	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
-func Shipper(context OperatorContext) {
+// NewShipperTransport creates the transport for a shipping destination from its settings
+func NewShipperTransport(settings map[string]interface{}) (transport Transport, coldDirBase string, e error) {
+	if transport, e = NewTransport(settings); e != nil {
+		return
+	}
+	coldDirBase = getSetting(settings, "dest-dir")
+	if getSetting(settings, "hostname") == "" {
+		// for local ship, make the destination directory an absolute path
+		coldDirBase, _ = filepath.Abs(coldDirBase)
+	}
+	return
+}
+
+// ColdCopyExists checks whether a file with the given sub-path, filename and size is present in cold storage.
+// The file's type isn't known, so it must be present at all of the required destinations that take files of any type;
+// if all of the required destinations are limited to certain types, it must be present at one of them.
+func ColdCopyExists(subPath, filename string, size int64) (bool, error) {
+	destinations, destErr := GetShippingDestinations()
+	if destErr != nil {
+		return false, destErr
+	}
+	var typedDestinations []ShippingDestination
+	checkedAny := false
+	for _, destination := range destinations {
+		if !destination.Required {
+			continue
+		}
+		if len(destination.Types) > 0 {
+			typedDestinations = append(typedDestinations, destination)
+			continue
+		}
+		if exists, existsErr := coldCopyExistsAt(destination, subPath, filename, size); !exists || existsErr != nil {
+			return exists, existsErr
+		}
+		checkedAny = true
+	}
+	if checkedAny {
+		return true, nil
+	}
+	for _, destination := range typedDestinations {
+		if exists, existsErr := coldCopyExistsAt(destination, subPath, filename, size); exists || existsErr != nil {
+			return exists, existsErr
+		}
+	}
+	return false, nil
+}
+
+func coldCopyExistsAt(destination ShippingDestination, subPath, filename string, size int64) (bool, error) {
+	transport, _, transportErr := NewShipperTransport(destination.Settings)
+	if transportErr != nil {
+		return false, transportErr
+	}
+	return transport.Exists(subPath, filename, size)
+}
+
+// verifyShippedFiles checks the shipped copies of files against their hashes, in one operation if the transport supports it.
+// It returns an error for each file (nil if it was verified).
+func verifyShippedFiles(transport Transport, files []BatchFile, hashes []string) (errs []error) {
+	errs = make([]error, len(files))
+	matches := make([]bool, len(files))
+	if batchVerifier, canBatch := transport.(BatchVerifier); canBatch {
+		var verifyErr error
+		if matches, verifyErr = batchVerifier.VerifyBatch(files, hashes); verifyErr != nil {
+			for iFile := range files {
+				errs[iFile] = fmt.Errorf("Unable to verify the shipped copy: %v", verifyErr)
+			}
+			return
+		}
+	} else {
+		for iFile, file := range files {
+			var verifyErr error
+			if matches[iFile], verifyErr = transport.Verify(file.SubPath, file.Filename, hashes[iFile]); verifyErr != nil {
+				errs[iFile] = fmt.Errorf("Unable to verify the shipped copy: %v", verifyErr)
+			}
+		}
+	}
+	for iFile := range files {
+		if errs[iFile] == nil && !matches[iFile] {
+			errs[iFile] = fmt.Errorf("The shipped copy does not match the hash (%s)", hashes[iFile])
+		}
+	}
+	return
+}
+
+// shipmentSettings control how files are shipped
+type shipmentSettings struct {
+	verify     bool
+	maxRetries int
+	retryDelay time.Duration
+	windows    []transferWindow
+}
+
+// shipBatch ships a batch of files, retrying those that fail, and returns the result for each file.
+// If a control message (i.e. a request to stop) is received while waiting to ship, stopped is true, and there are no results.
+func shipBatch(batch []FileInfo, destinationName string, transport Transport, destDirBase string, limiter *DestinationLimiter, settings shipmentSettings, ctrlQueue chan ControlMessage) (results []OperatorReturn, stopped bool) {
+	destination := transport.Destination()
+
+	files := make([]BatchFile, len(batch))
+	hashes := make([]string, len(batch))
+	for iFile, fileHeader := range batch {
+		files[iFile] = BatchFile{
+			LocalPath: filepath.Join(fileHeader.WarmPath, fileHeader.Filename),
+			SubPath:   fileHeader.SubPath,
+			Filename:  fileHeader.Filename,
+		}
+		// if the classifier didn't hash the file, the warm copy is hashed for verification
+		hashes[iFile] = fileHeader.FileHash
+		if settings.verify && hashes[iFile] == "" {
+			var hashErr error
+			if hashes[iFile], hashErr = Hash(files[iFile].LocalPath); hashErr != nil {
+				Log.Warningf("Unable to hash <%s>; the shipped copy will not be verified: %v", files[iFile].LocalPath, hashErr)
+			}
+		}
+	}
+
+	// files that fail are shipped again, until they succeed or there are no retries left
+	shipErrs := make([]error, len(batch))
+	pending := make([]int, len(batch))
+	for iFile := range pending {
+		pending[iFile] = iFile
+	}
+	for attempt := 0; ; attempt++ {
+		// ship the files, once shipping isn't paused, a transfer window is open, and a transfer to the destination is allowed
+		if waitUntilShippingAllowed(settings.windows, ctrlQueue) == false || limiter.Acquire(destination, ctrlQueue) == false {
+			stopped = true
+			return
+		}
+		pendingFiles := make([]BatchFile, len(pending))
+		for iPending, iFile := range pending {
+			pendingFiles[iPending] = files[iFile]
+		}
+		errs := ShipFiles(transport, pendingFiles)
+
+		// the files that were shipped are verified together
+		var toVerify []int
+		var verifyFiles []BatchFile
+		var verifyHashes []string
+		for iPending, iFile := range pending {
+			shipErrs[iFile] = errs[iPending]
+			if shipErrs[iFile] == nil && settings.verify && hashes[iFile] != "" {
+				toVerify = append(toVerify, iFile)
+				verifyFiles = append(verifyFiles, files[iFile])
+				verifyHashes = append(verifyHashes, hashes[iFile])
+			}
+		}
+		if len(toVerify) > 0 {
+			for iVerify, verifyErr := range verifyShippedFiles(transport, verifyFiles, verifyHashes) {
+				shipErrs[toVerify[iVerify]] = verifyErr
+			}
+		}
+		limiter.Release(destination)
+
+		var failed []int
+		for _, iFile := range pending {
+			if shipErrs[iFile] != nil {
+				failed = append(failed, iFile)
+			}
+		}
+		if len(failed) == 0 || attempt >= settings.maxRetries {
+			break
+		}
+		for _, iFile := range failed {
+			Log.Warningf("Shipping <%s> to %s failed (attempt %d of %d); retrying in %v: %v", batch[iFile].Filename, destination, attempt+1, settings.maxRetries+1, settings.retryDelay, shipErrs[iFile])
+		}
+		pending = failed
+		select {
+		case <-time.After(settings.retryDelay):
+		case <-ctrlQueue:
+			stopped = true
+			return
+		}
+	}
+
+	results = make([]OperatorReturn, len(batch))
+	for iFile, fileHeader := range batch {
+		opReturn := OperatorReturn{
+			Operator:    "shipper",
+			FHeader:     fileHeader,
+			Err:         nil,
+			IsFatal:     false,
+			Destination: destinationName,
+		}
+		if shipErrs[iFile] != nil {
+			opReturn.Err = fmt.Errorf("Error shipping <%s> to %s: %v", fileHeader.Filename, destination, shipErrs[iFile])
+			opReturn.IsFatal = true
+			Log.Error(opReturn.Err.Error())
+		} else {
+			// the cold path is only recorded once the file is safely in place
+			destDirPath := filepath.Clean(filepath.Join(destDirBase, fileHeader.SubPath))
+			opReturn.FHeader.ColdPath = destDirPath
+			opReturn.FHeader.FileColdPath = filepath.Join(destDirPath, fileHeader.Filename)
+			if settings.verify && hashes[iFile] != "" {
+				Log.Infof("Shipped and verified <%s>", fileHeader.Filename)
+			}
+		}
+		results[iFile] = opReturn
+	}
+	return
+}
+
+// failBatch returns the files of a batch that won't be shipped because the shipper is stopping.
+// The scheduler may have stopped already, so the results are only sent if there's room in the return queue.
+func failBatch(batch []FileInfo, destinationName string, retStream chan OperatorReturn) {
+	for _, fileHeader := range batch {
+		opReturn := OperatorReturn{
+			Operator:    "shipper",
+			FHeader:     fileHeader,
+			Err:         fmt.Errorf("<%s> was not shipped to %s because the shipper stopped", fileHeader.Filename, destinationName),
+			IsFatal:     true,
+			Destination: destinationName,
+		}
+		select {
+		case retStream <- opReturn:
+		default:
+			Log.Warning(opReturn.Err.Error())
+		}
+	}
+}
+
+// ShipperID is an identifier for a particular shipper goroutine.
+type ShipperID uint
+
+// Shipper receives files from the scheduler and ships them to a cold-storage destination.
+// Several shippers can share the file stream for a destination; the limiter, which is shared by the shippers,
+// caps the number of concurrent transfers to each destination (remote host or local filesystem).
+// Files can be collected into batches, which are shipped together (e.g. in one rsync process).
+func Shipper(context OperatorContext, id ShipperID, destination ShippingDestination, limiter *DestinationLimiter) {
 	// decrement the wg counter at the end
 	defer context.PoolCount.Done()
-	defer Log.Info("Shipper is finished.")
-
-	remoteShip := false
-	var destDirBase, hostname, username string
-	if viper.IsSet("shipper.hostname") {
-		remoteShip = true
-		hostname = viper.GetString("shipper.hostname")
-		username = viper.GetString("shipper.username")
-		destDirBase = viper.GetString("shipper.dest-dir")
-	} else {
-		// for local ship, make the destination directory an absolute path
-		destDirBase, _ = filepath.Abs(viper.GetString("shipper.dest-dir"))
+	defer Log.Infof("Shipper (%d) is finished.", id)
+
+	transport, destDirBase, transportErr := NewShipperTransport(destination.Settings)
+	if transportErr != nil {
+		Log.Criticalf("Unable to set up the shipper transport for destination <%s>: %v", destination.Name, transportErr)
+		context.ReqQueue <- ThreadCannotContinue
+		return
 	}
 
-	Log.Info("Shipper started successfully")
+	// shipped files are verified against their hashes unless verification is turned off
+	settings := shipmentSettings{
+		verify:     true,
+		maxRetries: 2,
+		retryDelay: 30 * time.Second,
+	}
+	if viper.IsSet("shipper.verify") {
+		settings.verify = viper.GetBool("shipper.verify")
+	}
+	// failed transfers (including verification failures) are retried
+	if viper.IsSet("shipper.max-retries") {
+		settings.maxRetries = viper.GetInt("shipper.max-retries")
+	}
+	if viper.IsSet("shipper.retry-delay") {
+		settings.retryDelay = viper.GetDuration("shipper.retry-delay")
+	}
+	Log.Debugf("Verify shipped files: %v; retries: %d (delay %v)", settings.verify, settings.maxRetries, settings.retryDelay)
+
+	// shipping can be limited to time-of-day windows
+	var windowsErr error
+	if settings.windows, windowsErr = ParseTransferWindows(viper.GetStringSlice("shipper.windows")); windowsErr != nil {
+		Log.Criticalf("Unable to parse the shipper's transfer windows: %v", windowsErr)
+		context.ReqQueue <- ThreadCannotContinue
+		return
+	}
+
+	// a batch is shipped when it has batch-size files or batch-bytes bytes,
+	// or when its first file has waited for batch-wait; by default each file is shipped on its own
+	batchSize := 1
+	if viper.IsSet("shipper.batch-size") {
+		batchSize = viper.GetInt("shipper.batch-size")
+	}
+	var batchMaxBytes int64
+	if viper.IsSet("shipper.batch-bytes") {
+		var bytesErr error
+		if batchMaxBytes, bytesErr = ParseSizeInBytes(viper.GetString("shipper.batch-bytes")); bytesErr != nil {
+			Log.Criticalf("Invalid shipper batch-bytes: %v", bytesErr)
+			context.ReqQueue <- ThreadCannotContinue
+			return
+		}
+	}
+	batchWait := 10 * time.Second
+	if viper.IsSet("shipper.batch-wait") {
+		batchWait = viper.GetDuration("shipper.batch-wait")
+	}
+	if batchSize > 1 {
+		Log.Debugf("Shipping batches of up to %d files (%d bytes); waiting up to %v", batchSize, batchMaxBytes, batchWait)
+	}
+
+	var batch []FileInfo
+	var batchBytes int64
+	var batchTimer <-chan time.Time
+	// files that are waiting to be shipped when the shipper stops are returned as failures
+	defer func() {
+		failBatch(batch, destination.Name, context.RetStream)
+	}()
+
+	Log.Infof("Shipper (%d) started successfully for destination <%s>", id, destination.Name)
 
 shipLoop:
 	for {
+		shipNow := false
 		select {
 		// the control messages can stop execution
 		// TODO: should finish pending jobs before dying.
@@ -45,58 +325,39 @@ shipLoop:
 				break shipLoop
 			}
 			if controlMsg == StopExecution {
-				Log.Info("Shipper stopping on interrupt.")
+				Log.Infof("Shipper (%d) stopping on interrupt.", id)
 				break shipLoop
 			}
+		case <-batchTimer:
+			shipNow = true
 		case fileHeader, queueOk := <-context.FileStream:
 			if !queueOk {
 				Log.Error("File stream has closed unexpectedly")
 				context.ReqQueue <- StopExecution
 				break shipLoop
 			}
-			opReturn := OperatorReturn{
-				Operator: "shipper",
-				FHeader:  fileHeader,
-				Err:      nil,
-				IsFatal:  false,
-			}
-
-			//inputFilePath := filepath.Join(fileHeader.WarmPath, fileHeader.Filename)
-			inputFileSubPath := filepath.Clean(filepath.Join(fileHeader.SubPath, fileHeader.Filename))
-
-			destDirPath := filepath.Clean(filepath.Join(destDirBase, fileHeader.SubPath))
-			opReturn.FHeader.ColdPath = destDirPath
-			opReturn.FHeader.FileColdPath = filepath.Join(destDirPath, fileHeader.Filename)
-
-			var rsyncDest string
-			if remoteShip {
-				if len(username) > 0 {
-					rsyncDest = username + "@" + hostname + ":" + destDirBase
-				} else {
-					rsyncDest = hostname + ":" + destDirBase
+			batch = append(batch, fileHeader)
+			if batchMaxBytes > 0 {
+				if info, statErr := os.Stat(filepath.Join(fileHeader.WarmPath, fileHeader.Filename)); statErr == nil {
+					batchBytes += info.Size()
 				}
-			} else {
-				rsyncDest = destDirBase
 			}
-			Log.Debugf("rsync dest: %s", rsyncDest)
-
-			cmd := exec.Command("rsync", "-a", "--relative", inputFileSubPath, rsyncDest)
-			// Set the command's working directory to the input basepath,
-			// so that the inputFileSubPath is definitely referring to the file.
-			// The input basepath is the warm path minus the subpath
-			inputBaseDir := strings.TrimSuffix(filepath.Clean(opReturn.FHeader.WarmPath), filepath.Clean(fileHeader.SubPath))
-			cmd.Dir = filepath.Clean(inputBaseDir)
-			Log.Debugf("rsync command is: %v", cmd)
-
-			// run the process
-			outputError := cmd.Run()
-			if outputError != nil {
-				opReturn.Err = fmt.Errorf("Error on running rsync for <%s>: %v", fileHeader.Filename, outputError)
-				Log.Error(opReturn.Err.Error())
+			shipNow = len(batch) >= batchSize || (batchMaxBytes > 0 && batchBytes >= batchMaxBytes)
+			if !shipNow && batchTimer == nil {
+				batchTimer = time.After(batchWait)
 			}
-
-			context.RetStream <- opReturn
 		}
 
+		if shipNow {
+			results, stopped := shipBatch(batch, destination.Name, transport, destDirBase, limiter, settings, context.CtrlQueue)
+			if stopped {
+				Log.Infof("Shipper (%d) stopping on interrupt.", id)
+				break shipLoop
+			}
+			for _, opReturn := range results {
+				context.RetStream <- opReturn
+			}
+			batch, batchBytes, batchTimer = nil, 0, nil
+		}
 	}
 }
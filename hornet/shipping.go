@@ -0,0 +1,155 @@
+/*
+* shipping.go
+*
+* controls when the shippers may transfer files.
+*
+* Shipping can be paused and resumed on request (e.g. via AMQP), and can be limited to time-of-day
+* transfer windows (e.g. outside of data-taking hours).  While shipping isn't allowed, files wait in
+* the scheduler's queue for the shippers; transfers that are in progress are finished.
+ */
+
+package hornet
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// transferWindow is a period of the day, in local time, during which files may be shipped.
+// Times are in minutes after midnight; if the end is before the start, the window extends past midnight.
+type transferWindow struct {
+	start int
+	end   int
+}
+
+// parseTransferWindow parses a window of the form "HH:MM-HH:MM"
+func parseTransferWindow(window string) (w transferWindow, e error) {
+	var startHour, startMinute, endHour, endMinute int
+	if _, scanErr := fmt.Sscanf(window, "%d:%d-%d:%d", &startHour, &startMinute, &endHour, &endMinute); scanErr != nil {
+		e = fmt.Errorf("Invalid transfer window <%s>; the format is HH:MM-HH:MM", window)
+		return
+	}
+	if !validWindowTime(startHour, startMinute) || !validWindowTime(endHour, endMinute) {
+		e = fmt.Errorf("Invalid time in transfer window <%s>", window)
+		return
+	}
+	w.start = startHour*60 + startMinute
+	w.end = endHour*60 + endMinute
+	return
+}
+
+// validWindowTime checks a time of day in a transfer window; 24:00 is allowed as the end of the day
+func validWindowTime(hour, minute int) bool {
+	if hour == 24 {
+		return minute == 0
+	}
+	return hour >= 0 && hour < 24 && minute >= 0 && minute < 60
+}
+
+// ParseTransferWindows parses a list of windows of the form "HH:MM-HH:MM"
+func ParseTransferWindows(windowStrings []string) (windows []transferWindow, e error) {
+	for _, windowString := range windowStrings {
+		window, parseErr := parseTransferWindow(windowString)
+		if parseErr != nil {
+			e = parseErr
+			return
+		}
+		windows = append(windows, window)
+	}
+	return
+}
+
+func (w transferWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	switch {
+	case w.start == w.end:
+		return true
+	case w.start < w.end:
+		return minute >= w.start && minute < w.end
+	default:
+		return minute >= w.start || minute < w.end
+	}
+}
+
+// timeUntilWindowOpens returns how long it will be until shipping is allowed by the windows; 0 if it's allowed now.
+// If there are no windows, shipping is always allowed.
+func timeUntilWindowOpens(windows []transferWindow, now time.Time) (wait time.Duration) {
+	for iWindow, window := range windows {
+		if window.contains(now) {
+			return 0
+		}
+		opens := time.Date(now.Year(), now.Month(), now.Day(), window.start/60, window.start%60, 0, 0, now.Location())
+		if !opens.After(now) {
+			opens = opens.AddDate(0, 0, 1)
+		}
+		if untilOpens := opens.Sub(now); iWindow == 0 || untilOpens < wait {
+			wait = untilOpens
+		}
+	}
+	return
+}
+
+// State of requests to pause shipping; the changed channel is closed (and replaced) whenever the state changes
+var shippingState = struct {
+	sync.Mutex
+	paused  bool
+	changed chan bool
+}{changed: make(chan bool)}
+
+// SetShippingPaused pauses or resumes shipping
+func SetShippingPaused(paused bool) {
+	shippingState.Lock()
+	defer shippingState.Unlock()
+	if shippingState.paused == paused {
+		return
+	}
+	shippingState.paused = paused
+	close(shippingState.changed)
+	shippingState.changed = make(chan bool)
+	if paused {
+		Log.Notice("Shipping has been paused")
+	} else {
+		Log.Notice("Shipping has been resumed")
+	}
+}
+
+// ShippingIsPaused returns true if shipping has been paused by request
+func ShippingIsPaused() bool {
+	shippingState.Lock()
+	defer shippingState.Unlock()
+	return shippingState.paused
+}
+
+func shippingStatus() (paused bool, changed chan bool) {
+	shippingState.Lock()
+	defer shippingState.Unlock()
+	return shippingState.paused, shippingState.changed
+}
+
+// waitUntilShippingAllowed waits until shipping is not paused and a transfer window is open.
+// It returns false if a control message (i.e. a request to stop) is received while waiting.
+func waitUntilShippingAllowed(windows []transferWindow, ctrlQueue chan ControlMessage) bool {
+	loggedWait := false
+	for {
+		paused, changed := shippingStatus()
+		var windowOpens <-chan time.Time
+		if !paused {
+			wait := timeUntilWindowOpens(windows, time.Now())
+			if wait == 0 {
+				return true
+			}
+			if !loggedWait {
+				Log.Infof("Outside of the transfer windows; shipping will resume in %v", wait)
+				loggedWait = true
+			}
+			windowOpens = time.After(wait)
+		}
+		select {
+		case <-changed:
+		case <-windowOpens:
+		case <-ctrlQueue:
+			return false
+		}
+	}
+}
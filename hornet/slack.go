@@ -43,34 +43,55 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/op/go-logging"
 	"github.com/spf13/viper"
 )
 
-var (
-	slackAddr = "https://slack.com/api"
-)
-
 const (
-	postMessageURI = "chat.postMessage"
+	defaultSlackAddr = "https://slack.com/api"
+	postMessageURI   = "chat.postMessage"
 )
 
+// requests to the Slack API are abandoned (and retried) if they take longer than this
+var slackHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
 type slackPostMessageRes struct {
 	Ok    bool
 	Error string
 }
 
+// slackRateLimitError is returned when Slack asks for requests to be slowed down
+type slackRateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e slackRateLimitError) Error() string {
+	return fmt.Sprintf("rate limited by Slack; retry after %v", e.retryAfter)
+}
+
+// slackAPIError is an error reported by the Slack API (e.g. an unknown channel); the message won't be accepted if it's sent again
+type slackAPIError struct {
+	reason string
+}
+
+func (e slackAPIError) Error() string {
+	return "Slack API error: " + e.reason
+}
+
 // sendSlackMessage sends a text message to a specific channel
 // with a specific username.
-func sendSlackMessage(channel, message, username, token string) error {
+// Rate limiting is reported with slackRateLimitError, and messages that Slack rejects with slackAPIError;
+// other errors (e.g. network problems) may not recur if the message is sent again.
+func sendSlackMessage(apiURL, channel, message, username, token string) error {
 	if channel == "" || message == "" || username == "" || token == "" {
-		return errors.New("channel, message, username, and token are required")
+		return slackAPIError{"channel, message, username, and token are required"}
 	}
-	host, _ := os.Hostname()
-	message = "[" + host + "]" + message
 
 	payload := url.Values{}
 	payload.Set("token", token)
@@ -79,12 +100,21 @@ func sendSlackMessage(channel, message, username, token string) error {
 	payload.Set("username", username)
 	payload.Set("as_user", "true")
 
-	res, err := http.PostForm(fmt.Sprintf("%s/%s", slackAddr, postMessageURI), payload)
+	res, err := slackHTTPClient.PostForm(fmt.Sprintf("%s/%s", apiURL, postMessageURI), payload)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
+	// the Retry-After header gives the number of seconds to wait
+	retryAfter, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+	if res.StatusCode == http.StatusTooManyRequests {
+		return slackRateLimitError{time.Duration(retryAfter) * time.Second}
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Slack API request failed: %s", res.Status)
+	}
+
 	resBody := new(slackPostMessageRes)
 	decoder := json.NewDecoder(res.Body)
 	err = decoder.Decode(resBody)
@@ -93,12 +123,40 @@ func sendSlackMessage(channel, message, username, token string) error {
 	}
 
 	if !resBody.Ok {
-		return errors.New(resBody.Error)
+		if resBody.Error == "ratelimited" {
+			return slackRateLimitError{time.Duration(retryAfter) * time.Second}
+		}
+		return slackAPIError{resBody.Error}
 	}
 
 	return nil
 }
 
+// splitSlackMessage splits a message into pieces of no more than maxLength bytes.
+// Messages are split at the last line break that fits, or, for long lines, between characters.
+func splitSlackMessage(message string, maxLength int) (chunks []string) {
+	for len(message) > maxLength {
+		cut := strings.LastIndex(message[:maxLength+1], "\n")
+		next := cut + 1
+		if cut <= 0 {
+			cut = maxLength
+			for cut > 0 && !utf8.RuneStart(message[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				cut = maxLength
+			}
+			next = cut
+		}
+		chunks = append(chunks, message[:cut])
+		message = message[next:]
+	}
+	if message != "" {
+		chunks = append(chunks, message)
+	}
+	return
+}
+
 // Hornet-specific Slack usage
 
 // configuration
@@ -150,26 +208,56 @@ func (writer SlackAlertWriter) Write(p []byte) (n int, err error) {
 
 // SlackClient represents a slack api client. A Client is
 // used for making requests to the slack api.
+//
+// Submitted messages are buffered for each channel; once a second, the buffers are split into pieces
+// that fit in a Slack message, and the next piece for each channel is sent.  Pieces that can't be sent
+// are retried, with a delay that doubles after each failure, and sending stops while Slack is rate limiting.
 type SlackClient struct {
 	username       string
 	token          string
+	apiURL         string
+	prefix         string
 	running        bool
 	messageBuffers map[string]string
 	messageMutex   sync.Mutex
+
+	// maximum length of a message, including the prefix
+	maxLength int
+	// maximum number of unsent pieces for each channel; beyond that, the oldest are dropped
+	maxPending    int
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+
+	// the following are used only by RunClient
+	pending          map[string][]string
+	retryDelays      map[string]time.Duration
+	retryAt          map[string]time.Time
+	rateLimitedUntil time.Time
 }
 
 // createNewSlackClient returns a Client with the provided api token.
 func createNewSlackClient(username, token string) *SlackClient {
+	host, _ := os.Hostname()
 	var client = SlackClient{
 		username:       username,
 		token:          token,
+		apiURL:         defaultSlackAddr,
+		prefix:         "[" + host + "]",
 		running:        false,
 		messageBuffers: make(map[string]string),
+		maxLength:      4000,
+		maxPending:     100,
+		retryDelay:     time.Second,
+		maxRetryDelay:  time.Minute,
+		pending:        make(map[string][]string),
+		retryDelays:    make(map[string]time.Duration),
+		retryAt:        make(map[string]time.Time),
 	}
 	return &client
 }
 
-// RunClient starts sending submitted messages via the Slack API
+// RunClient starts sending submitted messages via the Slack API.
+// Problems with Slack are logged as info, so that they're not themselves sent to Slack.
 func (c *SlackClient) RunClient(ctrlQueue, reqQueue chan ControlMessage, poolCount *sync.WaitGroup) {
 	if c.running == true {
 		return
@@ -180,45 +268,89 @@ func (c *SlackClient) RunClient(ctrlQueue, reqQueue chan ControlMessage, poolCou
 	defer poolCount.Done()
 	defer Log.Info("Slack client is finished.")
 
-	const (
-		maxErrors = 10
-	)
-	var errorCount int
-	errorCount = 0
-
-	timeout := make(chan bool, 1)
-	timeout <- true
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 slackLoop:
 	for {
 		select {
 		case controlMsg := <-ctrlQueue:
 			if controlMsg == StopExecution {
 				Log.Info("Slack client stopping on interrupt.")
+				// last chance for the final messages
+				c.takeBuffers()
+				c.sendPending()
 				break slackLoop
 			}
-		case <-timeout:
-			c.messageMutex.Lock()
-			for channel, buffer := range c.messageBuffers {
-				if buffer != "" {
-					if msgErr := sendSlackMessage(channel, buffer, c.username, c.token); msgErr != nil {
-						errorCount++
-						if errorCount == maxErrors {
-							Log.Error("Maximum number of Slack errors has been reached")
-							break slackLoop
-						}
-					}
-					c.messageBuffers[channel] = ""
-				}
-			}
-			c.messageMutex.Unlock()
-			go func() {
-				time.Sleep(1 * time.Second)
-				timeout <- true
-			}()
+		case <-ticker.C:
+			c.takeBuffers()
+			c.sendPending()
 		} // select
 	} // for
 } // func
 
+// takeBuffers empties the message buffers, and adds their contents to the pieces waiting to be sent
+func (c *SlackClient) takeBuffers() {
+	c.messageMutex.Lock()
+	buffers := c.messageBuffers
+	c.messageBuffers = make(map[string]string)
+	c.messageMutex.Unlock()
+
+	for channel, buffer := range buffers {
+		if buffer == "" {
+			continue
+		}
+		c.pending[channel] = append(c.pending[channel], splitSlackMessage(buffer, c.maxLength-len(c.prefix))...)
+		if excess := len(c.pending[channel]) - c.maxPending; c.maxPending > 0 && excess > 0 {
+			c.pending[channel] = c.pending[channel][excess:]
+			Log.Infof("Too many Slack messages are waiting to be sent to %s; %d were dropped", channel, excess)
+		}
+	}
+}
+
+// sendPending sends the next piece for each channel that isn't waiting to retry
+func (c *SlackClient) sendPending() {
+	if time.Now().Before(c.rateLimitedUntil) {
+		return
+	}
+	for channel, pieces := range c.pending {
+		if time.Now().Before(c.retryAt[channel]) {
+			continue
+		}
+		sendErr := sendSlackMessage(c.apiURL, channel, c.prefix+pieces[0], c.username, c.token)
+		switch typedErr := sendErr.(type) {
+		case nil:
+			pieces = pieces[1:]
+			delete(c.retryDelays, channel)
+		case slackRateLimitError:
+			retryAfter := typedErr.retryAfter
+			if retryAfter <= 0 {
+				retryAfter = c.retryDelay
+			}
+			c.rateLimitedUntil = time.Now().Add(retryAfter)
+			Log.Infof("Slack is rate limiting; messages will be sent again in %v", retryAfter)
+			return
+		case slackAPIError:
+			pieces = pieces[1:]
+			Log.Infof("Slack did not accept a message to %s, which was dropped: %v", channel, sendErr)
+		default:
+			delay, isRetry := c.retryDelays[channel]
+			if !isRetry {
+				delay = c.retryDelay
+			} else if delay *= 2; delay > c.maxRetryDelay {
+				delay = c.maxRetryDelay
+			}
+			c.retryDelays[channel] = delay
+			c.retryAt[channel] = time.Now().Add(delay)
+			Log.Infof("Unable to send a message to Slack channel %s; retrying in %v: %v", channel, delay, sendErr)
+		}
+		if len(pieces) == 0 {
+			delete(c.pending, channel)
+		} else {
+			c.pending[channel] = pieces
+		}
+	}
+}
+
 // SubmitMessage submits a single message on a particular channel to the Slack client.
 func (c *SlackClient) SubmitMessage(channel, message string) error {
 	c.messageMutex.Lock()
@@ -260,6 +392,33 @@ func InitializeSlack(ctrlQueue, reqQueue chan ControlMessage, threadCountQueue c
 	Log.Debug("slack username: %v", viper.GetString("slack.username"))
 
 	slackClient := createNewSlackClient(viper.GetString("slack.username"), Authenticators.Slack.Token)
+	// the API can be replaced, e.g. by a local stand-in for testing
+	if viper.IsSet("slack.api-url") {
+		slackClient.apiURL = strings.TrimSuffix(viper.GetString("slack.api-url"), "/")
+	}
+	if viper.IsSet("slack.max-message-length") {
+		slackClient.maxLength = viper.GetInt("slack.max-message-length")
+	}
+	if slackClient.maxLength <= len(slackClient.prefix) {
+		e = fmt.Errorf("The maximum Slack message length must be longer than the message prefix (%d characters)", len(slackClient.prefix))
+		Log.Error(e.Error())
+		return
+	}
+	if viper.IsSet("slack.max-pending") {
+		slackClient.maxPending = viper.GetInt("slack.max-pending")
+	}
+	if viper.IsSet("slack.retry-delay") {
+		slackClient.retryDelay = viper.GetDuration("slack.retry-delay")
+	}
+	if viper.IsSet("slack.max-retry-delay") {
+		slackClient.maxRetryDelay = viper.GetDuration("slack.max-retry-delay")
+	}
+	if slackClient.retryDelay <= 0 || slackClient.maxRetryDelay < slackClient.retryDelay {
+		e = errors.New("The Slack retry delay must be > 0, and no longer than the maximum retry delay")
+		Log.Error(e.Error())
+		return
+	}
+	Log.Debugf("Slack API: %s; maximum message length: %d; maximum pending: %d; retry delay: %v (max. %v)", slackClient.apiURL, slackClient.maxLength, slackClient.maxPending, slackClient.retryDelay, slackClient.maxRetryDelay)
 
 	/*
 		if SendSlackNotice("Hello Slack!") == false {
@@ -0,0 +1,203 @@
+package hornet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slackResponse is a response given by the stand-in Slack API
+type slackResponse struct {
+	status     int
+	retryAfter string
+	body       string
+}
+
+// fakeSlack is a stand-in for the Slack API, which gives the responses in turn (repeating the last),
+// and records the text of each message
+type fakeSlack struct {
+	mutex     sync.Mutex
+	responses []slackResponse
+	texts     []string
+}
+
+func (s *fakeSlack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r.URL.Path != "/"+postMessageURI || r.FormValue("token") != "xoxb-token" || r.FormValue("channel") == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	response := s.responses[0]
+	if len(s.responses) > 1 {
+		s.responses = s.responses[1:]
+	}
+	s.texts = append(s.texts, r.FormValue("text"))
+	if response.retryAfter != "" {
+		w.Header().Set("Retry-After", response.retryAfter)
+	}
+	w.WriteHeader(response.status)
+	w.Write([]byte(response.body))
+}
+
+func (s *fakeSlack) sent() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.texts...)
+}
+
+func TestSendSlackMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		response slackResponse
+		check    func(error) bool
+	}{
+		{"ok", slackResponse{http.StatusOK, "", `{"ok": true}`}, func(e error) bool { return e == nil }},
+		{"too many requests", slackResponse{http.StatusTooManyRequests, "7", ""}, func(e error) bool {
+			rateErr, isRateErr := e.(slackRateLimitError)
+			return isRateErr && rateErr.retryAfter == 7*time.Second
+		}},
+		{"ratelimited", slackResponse{http.StatusOK, "3", `{"ok": false, "error": "ratelimited"}`}, func(e error) bool {
+			rateErr, isRateErr := e.(slackRateLimitError)
+			return isRateErr && rateErr.retryAfter == 3*time.Second
+		}},
+		{"rejected", slackResponse{http.StatusOK, "", `{"ok": false, "error": "channel_not_found"}`}, func(e error) bool {
+			apiErr, isAPIErr := e.(slackAPIError)
+			return isAPIErr && apiErr.reason == "channel_not_found"
+		}},
+		{"server error", slackResponse{http.StatusInternalServerError, "", ""}, func(e error) bool {
+			_, isRateErr := e.(slackRateLimitError)
+			_, isAPIErr := e.(slackAPIError)
+			return e != nil && !isRateErr && !isAPIErr
+		}},
+	}
+	for _, test := range tests {
+		server := &fakeSlack{responses: []slackResponse{test.response}}
+		httpServer := httptest.NewServer(server)
+		sendErr := sendSlackMessage(httpServer.URL, "#alerts", "a message", "hornet", "xoxb-token")
+		httpServer.Close()
+		if !test.check(sendErr) {
+			t.Errorf("%s: unexpected result: %#v", test.name, sendErr)
+		}
+		if sent := server.sent(); len(sent) != 1 || sent[0] != "a message" {
+			t.Errorf("%s: the messages sent were %q", test.name, sent)
+		}
+	}
+}
+
+func TestSplitSlackMessage(t *testing.T) {
+	tests := []struct {
+		message   string
+		maxLength int
+		expected  []string
+	}{
+		{"short", 10, []string{"short"}},
+		{"", 10, nil},
+		{"line one\nline two\nline three", 18, []string{"line one\nline two", "line three"}},
+		{"0123456789abcdef", 10, []string{"0123456789", "abcdef"}},
+		{"short\n0123456789abcdef", 10, []string{"short", "0123456789", "abcdef"}},
+		// multi-byte characters aren't split
+		{"ééééé", 5, []string{"éé", "éé", "é"}},
+	}
+	for _, test := range tests {
+		chunks := splitSlackMessage(test.message, test.maxLength)
+		if strings.Join(chunks, "|") != strings.Join(test.expected, "|") || len(chunks) != len(test.expected) {
+			t.Errorf("splitSlackMessage(%q, %d): got %q; expected %q", test.message, test.maxLength, chunks, test.expected)
+		}
+	}
+}
+
+func newTestSlackClient(url string) *SlackClient {
+	client := createNewSlackClient("hornet", "xoxb-token")
+	client.apiURL = url
+	client.prefix = "[test]"
+	client.retryDelay = 20 * time.Millisecond
+	client.maxRetryDelay = 50 * time.Millisecond
+	return client
+}
+
+// waitForRetry waits until the client will retry sending to a channel
+func waitForRetry(client *SlackClient, channel string) {
+	time.Sleep(time.Until(client.retryAt[channel]) + time.Millisecond)
+}
+
+func TestSlackClientRetry(t *testing.T) {
+	failure := slackResponse{http.StatusInternalServerError, "", ""}
+	server := &fakeSlack{responses: []slackResponse{failure, failure, failure, failure, {http.StatusOK, "", `{"ok": true}`}}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	client := newTestSlackClient(httpServer.URL)
+
+	client.SubmitMessage("#alerts", "first")
+	client.SubmitMessage("#alerts", "second")
+	client.takeBuffers()
+
+	// the delay doubles after each failure, up to the maximum
+	for _, expectedDelay := range []time.Duration{20, 40, 50, 50} {
+		client.sendPending()
+		if delay := client.retryDelays["#alerts"]; delay != expectedDelay*time.Millisecond {
+			t.Errorf("Retry delay after %d failure(s): got %v; expected %v", len(server.sent()), delay, expectedDelay*time.Millisecond)
+		}
+		// nothing is sent until the delay has passed
+		nSent := len(server.sent())
+		client.sendPending()
+		if len(server.sent()) != nSent {
+			t.Error("A message was sent again before the retry delay had passed")
+		}
+		waitForRetry(client, "#alerts")
+	}
+
+	client.sendPending()
+	if sent := server.sent(); len(sent) != 5 || sent[4] != "[test]first\nsecond" {
+		t.Errorf("The messages sent were %q", sent)
+	}
+	if len(client.pending) != 0 || len(client.retryDelays) != 0 {
+		t.Errorf("Nothing should be pending after the message was sent: %v, %v", client.pending, client.retryDelays)
+	}
+}
+
+func TestSlackClientRateLimit(t *testing.T) {
+	server := &fakeSlack{responses: []slackResponse{
+		{http.StatusTooManyRequests, "1", ""},
+		{http.StatusOK, "", `{"ok": false, "error": "ratelimited"}`},
+		{http.StatusOK, "", `{"ok": true}`},
+	}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	client := newTestSlackClient(httpServer.URL)
+	// each piece of a long message is sent separately
+	client.maxLength = len(client.prefix) + 5
+	client.SubmitMessage("#notices", "01234\n56789")
+	client.takeBuffers()
+
+	// a 429 response gives the delay in Retry-After
+	start := time.Now()
+	client.sendPending()
+	if wait := client.rateLimitedUntil.Sub(start); wait < 900*time.Millisecond || wait > 1100*time.Millisecond {
+		t.Errorf("Rate limited for %v; expected 1s", wait)
+	}
+	client.sendPending()
+	if len(server.sent()) != 1 {
+		t.Errorf("%d message(s) were sent while rate limited; expected 1", len(server.sent()))
+	}
+
+	// a ratelimited error without Retry-After waits for the retry delay
+	client.rateLimitedUntil = time.Time{}
+	start = time.Now()
+	client.sendPending()
+	if wait := client.rateLimitedUntil.Sub(start); wait < 10*time.Millisecond || wait > 100*time.Millisecond {
+		t.Errorf("Rate limited for %v; expected the retry delay (%v)", wait, client.retryDelay)
+	}
+
+	time.Sleep(time.Until(client.rateLimitedUntil) + time.Millisecond)
+	client.sendPending()
+	time.Sleep(time.Millisecond)
+	client.sendPending()
+	expected := []string{"[test]01234", "[test]01234", "[test]01234", "[test]56789"}
+	if sent := server.sent(); strings.Join(sent, "|") != strings.Join(expected, "|") {
+		t.Errorf("The messages sent were %q; expected %q", sent, expected)
+	}
+}
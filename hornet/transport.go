@@ -0,0 +1,220 @@
+/*
+* transport.go
+*
+* transports are used by the shipper to send files to cold storage, and by the janitor to check for them there.
+*
+* Files are identified at the destination by their sub-path and filename, so that the directory structure
+* of the warm storage is reproduced in cold storage.
+*
+* A transport is created from the settings of a shipper target, e.g.
+*    "transport": "rsync",
+*    "dest-dir": "/remote-data",
+*    "hostname": "my.server"
+* New transports are added by registering a factory function with RegisterTransport;
+* transports that can send several files at once should also implement BatchTransport.
+* Transports should respect the bandwidth limit (the "bandwidth-limit" setting; see getBandwidthLimit).
+ */
+
+package hornet
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Transport sends files to a cold-storage destination
+type Transport interface {
+	// Destination identifies where files are sent (e.g. a remote host); it's used to limit concurrent transfers, and in log messages
+	Destination() string
+	// Ship sends a local file to the destination
+	Ship(localPath, subPath, filename string) error
+	// Verify checks whether the md5 hash of the file at the destination matches the given hash
+	Verify(subPath, filename, hash string) (bool, error)
+	// Exists checks whether the file is present at the destination with the given size
+	Exists(subPath, filename string, size int64) (bool, error)
+	// Delete removes the file from the destination
+	Delete(subPath, filename string) error
+}
+
+// BatchFile identifies a file to be shipped as part of a batch
+type BatchFile struct {
+	LocalPath string
+	SubPath   string
+	Filename  string
+}
+
+// BatchTransport is a transport that can send several files in one operation (e.g. one rsync process),
+// which avoids the overhead of setting up a connection for each file
+type BatchTransport interface {
+	Transport
+	// ShipBatch sends the files to the destination, and returns an error for each file (nil if it was shipped)
+	ShipBatch(files []BatchFile) []error
+}
+
+// BatchVerifier is a transport that can verify several shipped files in one operation
+type BatchVerifier interface {
+	// VerifyBatch checks whether the md5 hashes of the files at the destination match the given hashes
+	VerifyBatch(files []BatchFile, hashes []string) ([]bool, error)
+}
+
+// ShipFiles sends files with the transport, as one batch if the transport supports it, or one at a time otherwise.
+// It returns an error for each file (nil if it was shipped).
+func ShipFiles(transport Transport, files []BatchFile) (errs []error) {
+	if batchTransport, canBatch := transport.(BatchTransport); canBatch {
+		return batchTransport.ShipBatch(files)
+	}
+	errs = make([]error, len(files))
+	for iFile, file := range files {
+		errs[iFile] = transport.Ship(file.LocalPath, file.SubPath, file.Filename)
+	}
+	return
+}
+
+// TransportFactory creates a transport from the settings of a shipper target
+type TransportFactory func(settings map[string]interface{}) (Transport, error)
+
+var transportFactories = make(map[string]TransportFactory)
+var transportFactoriesMutex sync.RWMutex
+
+// RegisterTransport makes a transport available by name for use in the shipper configuration
+func RegisterTransport(name string, factory TransportFactory) {
+	transportFactoriesMutex.Lock()
+	transportFactories[name] = factory
+	transportFactoriesMutex.Unlock()
+}
+
+func init() {
+	RegisterTransport("local", newLocalTransport)
+	RegisterTransport("rsync", newRsyncTransport)
+	RegisterTransport("sftp", newSftpTransport)
+}
+
+// NewTransport creates a transport from the settings of a shipper target.
+// The transport is chosen with the "transport" setting; if it's not given, rsync is used.
+func NewTransport(settings map[string]interface{}) (Transport, error) {
+	name := getSetting(settings, "transport")
+	if name == "" {
+		name = "rsync"
+	}
+	transportFactoriesMutex.RLock()
+	factory, hasFactory := transportFactories[name]
+	transportFactoriesMutex.RUnlock()
+	if !hasFactory {
+		return nil, fmt.Errorf("Unknown transport: <%s> (available: %s)", name, strings.Join(transportNames(), ", "))
+	}
+	return factory(settings)
+}
+
+func transportNames() (names []string) {
+	transportFactoriesMutex.RLock()
+	defer transportFactoriesMutex.RUnlock()
+	for name := range transportFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// getSetting returns a setting as a string, or an empty string if it's not present.
+// Numbers (e.g. a port) are formatted without a decimal point.
+func getSetting(settings map[string]interface{}, key string) string {
+	value, hasValue := settings[key]
+	if !hasValue || value == nil {
+		return ""
+	}
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue
+	case float64:
+		return fmt.Sprintf("%d", int64(typedValue))
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+// getBandwidthLimit returns the bandwidth limit for a transfer, in bytes per second, from the "bandwidth-limit" setting (e.g. "10MB"); 0 means no limit
+func getBandwidthLimit(settings map[string]interface{}) (limit int64, e error) {
+	if limitString := getSetting(settings, "bandwidth-limit"); limitString != "" {
+		if limit, e = ParseSizeInBytes(limitString); e != nil {
+			e = fmt.Errorf("Invalid bandwidth limit: %v", e)
+		}
+	}
+	return
+}
+
+// sshTarget holds the settings for reaching a remote host with ssh-based tools
+type sshTarget struct {
+	hostname     string
+	username     string
+	port         string
+	identityFile string
+}
+
+func newSSHTarget(settings map[string]interface{}) sshTarget {
+	return sshTarget{
+		hostname:     getSetting(settings, "hostname"),
+		username:     getSetting(settings, "username"),
+		port:         getSetting(settings, "port"),
+		identityFile: getSetting(settings, "identity-file"),
+	}
+}
+
+// userHost returns [username@]hostname
+func (t sshTarget) userHost() string {
+	if len(t.username) > 0 {
+		return t.username + "@" + t.hostname
+	}
+	return t.hostname
+}
+
+// options returns the ssh command-line options; portFlag is -p for ssh, and -P for sftp
+func (t sshTarget) options(portFlag string) (options []string) {
+	if len(t.port) > 0 {
+		options = append(options, portFlag, t.port)
+	}
+	if len(t.identityFile) > 0 {
+		options = append(options, "-i", t.identityFile)
+	}
+	// never prompt for a password; key-based login is required
+	options = append(options, "-o", "BatchMode=yes")
+	return
+}
+
+// run executes a command on the remote host with ssh, and returns its standard output
+func (t sshTarget) run(command ...string) (output []byte, e error) {
+	args := append(t.options("-p"), t.userHost())
+	args = append(args, command...)
+	var stderr bytes.Buffer
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = &stderr
+	if output, e = cmd.Output(); e != nil {
+		e = fmt.Errorf("%v: %s", e, strings.TrimSpace(stderr.String()))
+	}
+	return
+}
+
+// shellQuote quotes a path for use in a remote shell command
+func shellQuote(path string) string {
+	return "'" + strings.Replace(path, "'", `'\''`, -1) + "'"
+}
+
+// destinationPath returns the path of a file at the destination
+func destinationPath(destDirBase, subPath, filename string) string {
+	return filepath.Join(destDirBase, subPath, filename)
+}
+
+// parseHashOutput takes the hash from the output of md5sum (e.g. "dc5e29010b13215bbf8cfc6997f15489  my_file")
+func parseHashOutput(output []byte) (hash string, e error) {
+	tokens := strings.Fields(string(output))
+	if len(tokens) == 0 {
+		e = fmt.Errorf("Unable to parse the hash output: <%s>", string(output))
+		return
+	}
+	hash = tokens[0]
+	return
+}
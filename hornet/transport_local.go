@@ -0,0 +1,73 @@
+/*
+* transport_local.go
+*
+* the local transport copies files to a locally-mounted cold-storage directory.
+ */
+
+package hornet
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+type localTransport struct {
+	destDirBase    string
+	bandwidthLimit int64
+}
+
+func newLocalTransport(settings map[string]interface{}) (Transport, error) {
+	destDir := getSetting(settings, "dest-dir")
+	if destDir == "" {
+		return nil, errors.New("The destination directory (dest-dir) is not set")
+	}
+	destDirBase, absErr := filepath.Abs(destDir)
+	if absErr != nil {
+		return nil, absErr
+	}
+	bandwidthLimit, limitErr := getBandwidthLimit(settings)
+	if limitErr != nil {
+		return nil, limitErr
+	}
+	return &localTransport{destDirBase: destDirBase, bandwidthLimit: bandwidthLimit}, nil
+}
+
+func (t *localTransport) Destination() string {
+	// transfers are limited per filesystem
+	if fsID, fsIDErr := FilesystemID(t.destDirBase); fsIDErr == nil {
+		return fsID
+	}
+	return t.destDirBase
+}
+
+func (t *localTransport) Ship(localPath, subPath, filename string) error {
+	destDirPath := filepath.Join(t.destDirBase, subPath)
+	if mkErr := os.MkdirAll(destDirPath, os.ModeDir|0775); mkErr != nil {
+		return mkErr
+	}
+	return Copy(localPath, filepath.Join(destDirPath, filename), CopyOptions{PreserveMode: true, PreserveMtime: true, RateLimit: t.bandwidthLimit})
+}
+
+func (t *localTransport) Verify(subPath, filename, hash string) (bool, error) {
+	destHash, hashErr := Hash(destinationPath(t.destDirBase, subPath, filename))
+	if hashErr != nil {
+		return false, hashErr
+	}
+	return destHash == hash, nil
+}
+
+func (t *localTransport) Exists(subPath, filename string, size int64) (bool, error) {
+	fileInfo, statErr := os.Stat(destinationPath(t.destDirBase, subPath, filename))
+	if os.IsNotExist(statErr) {
+		return false, nil
+	}
+	if statErr != nil {
+		return false, statErr
+	}
+	return fileInfo.Mode().IsRegular() && fileInfo.Size() == size, nil
+}
+
+func (t *localTransport) Delete(subPath, filename string) error {
+	return os.Remove(destinationPath(t.destDirBase, subPath, filename))
+}
@@ -0,0 +1,256 @@
+/*
+* transport_rsync.go
+*
+* the rsync transport sends files with rsync, either to a local directory or to a remote host via ssh.
+ */
+
+package hornet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type rsyncTransport struct {
+	destDirBase    string
+	remote         bool
+	ssh            sshTarget
+	bandwidthLimit int64
+	// files are checked and deleted in the same way as for a local copy if the destination is local
+	local *localTransport
+}
+
+func newRsyncTransport(settings map[string]interface{}) (Transport, error) {
+	t := &rsyncTransport{
+		ssh: newSSHTarget(settings),
+	}
+	t.remote = len(t.ssh.hostname) > 0
+	var limitErr error
+	if t.bandwidthLimit, limitErr = getBandwidthLimit(settings); limitErr != nil {
+		return nil, limitErr
+	}
+	if t.remote {
+		t.destDirBase = getSetting(settings, "dest-dir")
+		if t.destDirBase == "" {
+			return nil, errors.New("The destination directory (dest-dir) is not set")
+		}
+		return t, nil
+	}
+	local, localErr := newLocalTransport(settings)
+	if localErr != nil {
+		return nil, localErr
+	}
+	t.local = local.(*localTransport)
+	t.destDirBase = t.local.destDirBase
+	return t, nil
+}
+
+func (t *rsyncTransport) Destination() string {
+	if t.remote {
+		return t.ssh.hostname
+	}
+	return t.local.Destination()
+}
+
+// Ship sends a single file; see ShipBatch
+func (t *rsyncTransport) Ship(localPath, subPath, filename string) error {
+	return t.ShipBatch([]BatchFile{{LocalPath: localPath, SubPath: subPath, Filename: filename}})[0]
+}
+
+// ShipBatch runs rsync with the --files-from option, so that all of the files that share an input basepath are sent
+// in one rsync process (and over one ssh connection), and the sub-paths are reproduced at the destination.
+// If rsync reports a partial transfer, the files named in its error messages are marked as failed.
+func (t *rsyncTransport) ShipBatch(files []BatchFile) (errs []error) {
+	errs = make([]error, len(files))
+
+	// the file list is relative to the input basepath, which is the file's directory minus the subpath
+	basePaths := []string{}
+	filesByBasePath := make(map[string][]int)
+	for iFile, file := range files {
+		basePath := filepath.Dir(file.LocalPath)
+		if cleanSubPath := filepath.Clean(file.SubPath); cleanSubPath != "." {
+			basePath = filepath.Clean(strings.TrimSuffix(basePath, cleanSubPath))
+		}
+		if _, hasBasePath := filesByBasePath[basePath]; !hasBasePath {
+			basePaths = append(basePaths, basePath)
+		}
+		filesByBasePath[basePath] = append(filesByBasePath[basePath], iFile)
+	}
+
+	for _, basePath := range basePaths {
+		indices := filesByBasePath[basePath]
+		relPaths := make([]string, len(indices))
+		for iIndex, iFile := range indices {
+			relPaths[iIndex] = filepath.Clean(filepath.Join(files[iFile].SubPath, files[iFile].Filename))
+		}
+		output, runErr := t.rsync(basePath, relPaths)
+		if runErr == nil {
+			continue
+		}
+		partial := false
+		if exitErr, isExitErr := runErr.(*exec.ExitError); isExitErr {
+			// 23: partial transfer due to error; 24: partial transfer due to vanished source files
+			if status, hasStatus := exitErr.Sys().(syscall.WaitStatus); hasStatus {
+				partial = status.ExitStatus() == 23 || status.ExitStatus() == 24
+			}
+		}
+		for iIndex, iFile := range indices {
+			if !partial {
+				errs[iFile] = fmt.Errorf("%v: %s", runErr, strings.TrimSpace(output))
+			} else if fileErrLine := findRsyncFileError(output, relPaths[iIndex]); fileErrLine != "" {
+				errs[iFile] = fmt.Errorf("%v: %s", runErr, fileErrLine)
+			}
+		}
+	}
+	return
+}
+
+// rsync sends the files, given by their paths relative to the base path, and returns rsync's output
+func (t *rsyncTransport) rsync(basePath string, relPaths []string) (output string, e error) {
+	var rsyncDest string
+	if t.remote {
+		rsyncDest = t.ssh.userHost() + ":" + t.destDirBase
+	} else {
+		rsyncDest = t.destDirBase
+	}
+	Log.Debugf("rsync dest: %s", rsyncDest)
+
+	// the file list is null-separated, so that any filename can be used
+	args := []string{"-a", "--relative", "--files-from=-", "--from0"}
+	if t.bandwidthLimit > 0 {
+		// rsync's limit is in units of 1024 bytes per second
+		args = append(args, "--bwlimit="+strconv.FormatInt((t.bandwidthLimit+1023)/1024, 10))
+	}
+	if t.remote {
+		args = append(args, "-e", rsyncRemoteShell(append([]string{"ssh"}, t.ssh.options("-p")...)))
+	}
+	args = append(args, ".", rsyncDest)
+	cmd := exec.Command("rsync", args...)
+	// Set the command's working directory to the input basepath,
+	// so that the relative paths are definitely referring to the files.
+	cmd.Dir = basePath
+	cmd.Stdin = strings.NewReader(strings.Join(relPaths, "\x00") + "\x00")
+	Log.Debugf("rsync command is: %v (%d files)", cmd, len(relPaths))
+
+	var outputBuffer bytes.Buffer
+	cmd.Stdout = &outputBuffer
+	cmd.Stderr = &outputBuffer
+	e = cmd.Run()
+	output = outputBuffer.String()
+	return
+}
+
+// rsyncRemoteShell gives the remote-shell command for rsync's -e option.
+// rsync splits the command into arguments itself, without a shell; it respects quotes, within which a quotation mark
+// is given by doubling it, so each argument is quoted in case it contains spaces (e.g. the path of the identity file).
+func rsyncRemoteShell(command []string) string {
+	quoted := make([]string, len(command))
+	for iArg, arg := range command {
+		quoted[iArg] = "'" + strings.Replace(arg, "'", "''", -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// findRsyncFileError returns the line of rsync's output that reports an error for the file, if there is one.
+// rsync quotes the path of the file (e.g. rsync: link_stat "/data/./run1/file.egg" failed: ...),
+// so the relative path has to be at the end of the quoted path.
+func findRsyncFileError(output, relPath string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, "/"+relPath+`"`) || strings.Contains(line, `"`+relPath+`"`) {
+			return strings.TrimSpace(line)
+		}
+	}
+	return ""
+}
+
+func (t *rsyncTransport) Verify(subPath, filename, hash string) (bool, error) {
+	if !t.remote {
+		return t.local.Verify(subPath, filename, hash)
+	}
+	output, sshErr := t.ssh.run("md5sum", "-b", shellQuote(destinationPath(t.destDirBase, subPath, filename)))
+	if sshErr != nil {
+		return false, fmt.Errorf("Unable to hash the file on %s: %v", t.ssh.hostname, sshErr)
+	}
+	destHash, parseErr := parseHashOutput(output)
+	if parseErr != nil {
+		return false, parseErr
+	}
+	return destHash == hash, nil
+}
+
+// VerifyBatch hashes all of the files on the remote host with one ssh command
+func (t *rsyncTransport) VerifyBatch(files []BatchFile, hashes []string) (matches []bool, e error) {
+	matches = make([]bool, len(files))
+	if !t.remote {
+		for iFile, file := range files {
+			if matches[iFile], e = t.local.Verify(file.SubPath, file.Filename, hashes[iFile]); e != nil {
+				return
+			}
+		}
+		return
+	}
+	command := []string{"md5sum", "-b"}
+	for _, file := range files {
+		command = append(command, shellQuote(destinationPath(t.destDirBase, file.SubPath, file.Filename)))
+	}
+	// md5sum reports an error for a missing file, but still hashes the others
+	output, sshErr := t.ssh.run(command...)
+	destHashes := parseHashListOutput(output)
+	if sshErr != nil && len(destHashes) == 0 {
+		e = fmt.Errorf("Unable to hash the files on %s: %v", t.ssh.hostname, sshErr)
+		return
+	}
+	for iFile, file := range files {
+		matches[iFile] = destHashes[destinationPath(t.destDirBase, file.SubPath, file.Filename)] == hashes[iFile]
+	}
+	return
+}
+
+// parseHashListOutput takes the hashes of several files from the output of md5sum -b, in which each line has the form "[hash] *[path]";
+// it returns the hashes by path
+func parseHashListOutput(output []byte) map[string]string {
+	hashes := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if tokens := strings.SplitN(line, " *", 2); len(tokens) == 2 {
+			hashes[tokens[1]] = tokens[0]
+		}
+	}
+	return hashes
+}
+
+func (t *rsyncTransport) Exists(subPath, filename string, size int64) (bool, error) {
+	if !t.remote {
+		return t.local.Exists(subPath, filename, size)
+	}
+	// a missing file is reported in the output, so that it can be distinguished from an ssh error
+	path := shellQuote(destinationPath(t.destDirBase, subPath, filename))
+	output, sshErr := t.ssh.run(fmt.Sprintf("if [ -f %s ]; then stat -c %%s %s; else echo missing; fi", path, path))
+	if sshErr != nil {
+		return false, fmt.Errorf("Unable to check for the file on %s: %v", t.ssh.hostname, sshErr)
+	}
+	sizeString := strings.TrimSpace(string(output))
+	if sizeString == "missing" {
+		return false, nil
+	}
+	remoteSize, parseErr := strconv.ParseInt(sizeString, 10, 64)
+	if parseErr != nil {
+		return false, fmt.Errorf("Unable to parse the size of the file on %s: %v", t.ssh.hostname, parseErr)
+	}
+	return remoteSize == size, nil
+}
+
+func (t *rsyncTransport) Delete(subPath, filename string) error {
+	if !t.remote {
+		return t.local.Delete(subPath, filename)
+	}
+	if _, sshErr := t.ssh.run("rm", "-f", shellQuote(destinationPath(t.destDirBase, subPath, filename))); sshErr != nil {
+		return fmt.Errorf("Unable to delete the file on %s: %v", t.ssh.hostname, sshErr)
+	}
+	return nil
+}
@@ -0,0 +1,629 @@
+/*
+* transport_s3.go
+*
+* the s3 transport uploads files to S3-compatible object storage (e.g. AWS S3, MinIO, Ceph).
+*
+* The object key is the key prefix, followed by the file's sub-path and filename, so that the
+* layout of the warm storage is reproduced in the bucket.  The bucket and the key prefix are
+* templates, filled in with the file's SubPath and Filename.
+*
+* Files larger than the part size are uploaded in parts (multipart upload).  Each request
+* includes the MD5 checksum of its contents, which the server checks, and the ETag of the
+* finished object is checked against the local checksums.  Verification relies only on the
+* ETag, which the server calculates: for an object uploaded in one part it's the MD5 hash of
+* the contents, and for a multipart object it's the MD5 hash of the part hashes, followed by
+* "-" and the number of parts.  The part size is stored in the object's metadata, so that the
+* ETag of a multipart object can be calculated again from the local file when it's verified.
+*
+* Requests are signed with AWS Signature Version 4.  The credentials are taken from the S3
+* authenticator, or from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+ */
+
+package hornet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// minimum size of each part of a multipart upload, other than the last, set by the S3 protocol
+const s3MinPartSize = 5 * 1024 * 1024
+
+const s3DefaultPartSize = 64 * 1024 * 1024
+
+// hash of an empty payload, for requests without a body
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// metadata header in which the part size of a multipart object is stored, so that its ETag can be checked
+const s3PartSizeHeader = "x-amz-meta-part-size"
+
+type s3Transport struct {
+	endpoint       *url.URL
+	region         string
+	bucketTemplate *template.Template
+	prefixTemplate *template.Template
+	storageClass   string
+	partSize       int64
+	virtualHosted  bool
+	bandwidthLimit int64
+	accessKey      string
+	secretKey      string
+	client         *http.Client
+}
+
+// s3ObjectName is the data used to fill in the bucket and key-prefix templates
+type s3ObjectName struct {
+	SubPath  string
+	Filename string
+}
+
+// s3Error is the body of an error response
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3RequestError is returned for an unsuccessful response
+type s3RequestError struct {
+	StatusCode int
+	Status     string
+	Code       string
+	Message    string
+}
+
+func (e *s3RequestError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed (%s)", e.Status)
+	}
+	return fmt.Sprintf("S3 request failed (%s): %s: %s", e.Status, e.Code, e.Message)
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	ETag string `xml:"ETag"`
+}
+
+func init() {
+	RegisterTransport("s3", newS3Transport)
+}
+
+func newS3Transport(settings map[string]interface{}) (Transport, error) {
+	endpointString := getSetting(settings, "endpoint")
+	if endpointString == "" {
+		endpointString = "https://s3.amazonaws.com"
+	}
+	endpoint, urlErr := url.Parse(endpointString)
+	if urlErr != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 endpoint: <%s>", endpointString)
+	}
+
+	t := &s3Transport{
+		endpoint:      endpoint,
+		region:        getSetting(settings, "region"),
+		storageClass:  getSetting(settings, "storage-class"),
+		partSize:      s3DefaultPartSize,
+		virtualHosted: getSetting(settings, "virtual-hosted") == "true",
+		client:        &http.Client{},
+	}
+	if t.region == "" {
+		t.region = "us-east-1"
+	}
+
+	bucket := getSetting(settings, "bucket")
+	if bucket == "" {
+		return nil, errors.New("The S3 bucket is not set")
+	}
+	var tmplErr error
+	if t.bucketTemplate, tmplErr = template.New("bucket").Parse(bucket); tmplErr != nil {
+		return nil, fmt.Errorf("Template error in the S3 bucket <%s>: %v", bucket, tmplErr)
+	}
+	prefix := getSetting(settings, "key-prefix")
+	if t.prefixTemplate, tmplErr = template.New("prefix").Parse(prefix); tmplErr != nil {
+		return nil, fmt.Errorf("Template error in the S3 key prefix <%s>: %v", prefix, tmplErr)
+	}
+
+	if partSize := getSetting(settings, "part-size"); partSize != "" {
+		// sizes can be given with units, e.g. "64MB"
+		var sizeErr error
+		if t.partSize, sizeErr = ParseSizeInBytes(partSize); sizeErr != nil {
+			return nil, sizeErr
+		}
+		if t.partSize < s3MinPartSize {
+			return nil, fmt.Errorf("The S3 part size must be at least %d bytes", s3MinPartSize)
+		}
+	}
+
+	var limitErr error
+	if t.bandwidthLimit, limitErr = getBandwidthLimit(settings); limitErr != nil {
+		return nil, limitErr
+	}
+
+	if Authenticators.S3.Available {
+		t.accessKey = Authenticators.S3.AccessKey
+		t.secretKey = Authenticators.S3.SecretKey
+	} else {
+		t.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		t.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if t.accessKey == "" || t.secretKey == "" {
+		return nil, errors.New("S3 credentials are not available")
+	}
+
+	return t, nil
+}
+
+func (t *s3Transport) Destination() string {
+	return t.endpoint.Host
+}
+
+// object returns the bucket and key of the object for a file
+func (t *s3Transport) object(subPath, filename string) (bucket, key string, e error) {
+	name := s3ObjectName{
+		SubPath:  strings.Replace(subPath, `\`, "/", -1),
+		Filename: filename,
+	}
+	var bucketBuf, prefixBuf bytes.Buffer
+	if e = t.bucketTemplate.Execute(&bucketBuf, name); e != nil {
+		return
+	}
+	if e = t.prefixTemplate.Execute(&prefixBuf, name); e != nil {
+		return
+	}
+	bucket = bucketBuf.String()
+	key = strings.TrimPrefix(path.Join(prefixBuf.String(), name.SubPath, filename), "/")
+	return
+}
+
+// s3URIEncode encodes a string as required by the signature: everything but unreserved characters is escaped
+func s3URIEncode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		switch {
+		case (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~':
+			buf.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds the AWS Signature Version 4 authorization header to a request.
+// All of the headers already set on the request are signed.
+func (t *s3Transport) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	// canonical headers: lower-case names, sorted, including the host
+	headers := map[string]string{"host": req.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var headerNames []string
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	// canonical query string: encoded names and values, sorted by name
+	query := req.URL.Query()
+	var queryNames []string
+	for name := range query {
+		queryNames = append(queryNames, name)
+	}
+	sort.Strings(queryNames)
+	var queryParts []string
+	for _, name := range queryNames {
+		for _, value := range query[name] {
+			queryParts = append(queryParts, s3URIEncode(name, true)+"="+s3URIEncode(value, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		strings.Join(queryParts, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + t.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+t.secretKey), date), t.region), "s3"), "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", t.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Payload is the body of a request, with the checksums needed to send it
+type s3Payload struct {
+	body      io.Reader
+	length    int64
+	sha256Hex string
+	md5Base64 string
+}
+
+// newS3Payload reads a section of a file to calculate its checksums; the section is then read again when it's sent
+func newS3Payload(file *os.File, offset, length int64) (payload s3Payload, md5Sum []byte, e error) {
+	sha256Hash, md5Hash := sha256.New(), md5.New()
+	if _, e = io.Copy(io.MultiWriter(sha256Hash, md5Hash), io.NewSectionReader(file, offset, length)); e != nil {
+		return
+	}
+	md5Sum = md5Hash.Sum(nil)
+	payload = s3Payload{
+		body:      io.NewSectionReader(file, offset, length),
+		length:    length,
+		sha256Hex: hex.EncodeToString(sha256Hash.Sum(nil)),
+		md5Base64: base64.StdEncoding.EncodeToString(md5Sum),
+	}
+	return
+}
+
+func newS3BytesPayload(data []byte) s3Payload {
+	sha256Sum, md5Sum := sha256.Sum256(data), md5.Sum(data)
+	return s3Payload{
+		body:      bytes.NewReader(data),
+		length:    int64(len(data)),
+		sha256Hex: hex.EncodeToString(sha256Sum[:]),
+		md5Base64: base64.StdEncoding.EncodeToString(md5Sum[:]),
+	}
+}
+
+// request sends a signed request for an object, and returns the response if its status is 2xx.
+// The caller must close the response body.
+func (t *s3Transport) request(method, bucket, key string, query url.Values, headers map[string]string, payload *s3Payload) (resp *http.Response, e error) {
+	reqURL := *t.endpoint
+	if t.virtualHosted {
+		reqURL.Host = bucket + "." + t.endpoint.Host
+		reqURL.Path = "/" + key
+	} else {
+		reqURL.Path = "/" + bucket + "/" + key
+	}
+	reqURL.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	// the path is sent exactly as it's signed
+	reqURL.RawPath = s3URIEncode(reqURL.Path, false)
+
+	var body io.Reader
+	payloadHash := s3EmptyPayloadHash
+	if payload != nil {
+		// an empty body that isn't http.NoBody would be sent with chunked encoding, which S3 doesn't accept
+		body = http.NoBody
+		if payload.length > 0 {
+			body = NewRateLimitedReader(payload.body, t.bandwidthLimit)
+		}
+		payloadHash = payload.sha256Hex
+	}
+	req, reqErr := http.NewRequest(method, reqURL.String(), body)
+	if reqErr != nil {
+		e = reqErr
+		return
+	}
+	req.Host = reqURL.Host
+	if payload != nil {
+		req.ContentLength = payload.length
+		req.Header.Set("Content-MD5", payload.md5Base64)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	t.sign(req, payloadHash, time.Now())
+
+	if resp, e = t.client.Do(req); e != nil {
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e = s3ResponseError(resp)
+		resp.Body.Close()
+		resp = nil
+	}
+	return
+}
+
+// s3ResponseError makes an error from an unsuccessful response, including the S3 error code if there is one
+func s3ResponseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	var errBody s3Error
+	xml.Unmarshal(body, &errBody)
+	return &s3RequestError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Code:       errBody.Code,
+		Message:    errBody.Message,
+	}
+}
+
+// readXMLResponse decodes the body of a successful response.
+// Some requests (e.g. completing a multipart upload) can report an error in the body of a successful response.
+func readXMLResponse(resp *http.Response, result interface{}) error {
+	defer resp.Body.Close()
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return readErr
+	}
+	var errBody s3Error
+	if xmlErr := xml.Unmarshal(body, &errBody); xmlErr == nil && errBody.Code != "" {
+		return fmt.Errorf("S3 request failed: %s: %s", errBody.Code, errBody.Message)
+	}
+	return xml.Unmarshal(body, result)
+}
+
+func (t *s3Transport) Ship(localPath, subPath, filename string) error {
+	bucket, key, objErr := t.object(subPath, filename)
+	if objErr != nil {
+		return objErr
+	}
+	file, openErr := os.Open(localPath)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+	fileInfo, statErr := file.Stat()
+	if statErr != nil {
+		return statErr
+	}
+
+	headers := make(map[string]string)
+	if t.storageClass != "" {
+		headers["x-amz-storage-class"] = t.storageClass
+	}
+
+	if fileInfo.Size() <= t.partSize {
+		payload, md5Sum, payloadErr := newS3Payload(file, 0, fileInfo.Size())
+		if payloadErr != nil {
+			return payloadErr
+		}
+		resp, putErr := t.request("PUT", bucket, key, nil, headers, &payload)
+		if putErr != nil {
+			return putErr
+		}
+		resp.Body.Close()
+		return checkETag(resp.Header.Get("ETag"), hex.EncodeToString(md5Sum))
+	}
+	return t.multipartUpload(bucket, key, file, fileInfo.Size(), headers)
+}
+
+// checkETag compares an object's ETag with the expected value; the ETag is quoted
+func checkETag(etag, expected string) error {
+	if etag = strings.Trim(etag, `"`); etag != expected {
+		return fmt.Errorf("The uploaded object's ETag <%s> does not match the local checksum <%s>", etag, expected)
+	}
+	return nil
+}
+
+// multipartETag calculates the ETag that a multipart object uploaded from a local file should have, given the part size,
+// and the MD5 hash of the whole file
+func multipartETag(localPath string, partSize int64) (etag, fileHash string, e error) {
+	file, openErr := os.Open(localPath)
+	if openErr != nil {
+		e = openErr
+		return
+	}
+	defer file.Close()
+	fileMD5 := md5.New()
+	var partHashes []byte
+	nParts := 0
+	for {
+		partMD5 := md5.New()
+		nCopied, copyErr := io.CopyN(io.MultiWriter(partMD5, fileMD5), file, partSize)
+		if nCopied > 0 {
+			partHashes = append(partHashes, partMD5.Sum(nil)...)
+			nParts++
+		}
+		if copyErr == io.EOF {
+			break
+		}
+		if copyErr != nil {
+			e = copyErr
+			return
+		}
+	}
+	etagHash := md5.Sum(partHashes)
+	etag = fmt.Sprintf("%s-%d", hex.EncodeToString(etagHash[:]), nParts)
+	fileHash = hex.EncodeToString(fileMD5.Sum(nil))
+	return
+}
+
+// multipartUpload uploads a file in parts; if any part fails, the upload is aborted
+func (t *s3Transport) multipartUpload(bucket, key string, file *os.File, size int64, headers map[string]string) (e error) {
+	headers[s3PartSizeHeader] = strconv.FormatInt(t.partSize, 10)
+	resp, initErr := t.request("POST", bucket, key, url.Values{"uploads": {""}}, headers, nil)
+	if initErr != nil {
+		return initErr
+	}
+	var initResult s3InitiateMultipartUploadResult
+	if xmlErr := readXMLResponse(resp, &initResult); xmlErr != nil {
+		return xmlErr
+	}
+	uploadID := initResult.UploadID
+	defer func() {
+		if e == nil {
+			return
+		}
+		if abortResp, abortErr := t.request("DELETE", bucket, key, url.Values{"uploadId": {uploadID}}, nil, nil); abortErr != nil {
+			Log.Warningf("Unable to abort the multipart upload of <%s>: %v", key, abortErr)
+		} else {
+			abortResp.Body.Close()
+		}
+	}()
+
+	var complete s3CompleteMultipartUpload
+	// the ETag of a multipart object is the MD5 hash of the concatenated part hashes, followed by the number of parts
+	var partHashes []byte
+	for offset, partNumber := int64(0), 1; offset < size; offset, partNumber = offset+t.partSize, partNumber+1 {
+		length := t.partSize
+		if size-offset < length {
+			length = size - offset
+		}
+		payload, md5Sum, payloadErr := newS3Payload(file, offset, length)
+		if payloadErr != nil {
+			return payloadErr
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+		partResp, partErr := t.request("PUT", bucket, key, query, nil, &payload)
+		if partErr != nil {
+			return fmt.Errorf("Upload of part %d failed: %v", partNumber, partErr)
+		}
+		partResp.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: partNumber, ETag: partResp.Header.Get("ETag")})
+		partHashes = append(partHashes, md5Sum...)
+		Log.Debugf("Uploaded part %d of <%s> (%d bytes)", partNumber, key, length)
+	}
+
+	completeBody, xmlErr := xml.Marshal(complete)
+	if xmlErr != nil {
+		return xmlErr
+	}
+	payload := newS3BytesPayload(completeBody)
+	completeResp, completeErr := t.request("POST", bucket, key, url.Values{"uploadId": {uploadID}}, nil, &payload)
+	if completeErr != nil {
+		return completeErr
+	}
+	var completeResult s3CompleteMultipartUploadResult
+	if xmlErr := readXMLResponse(completeResp, &completeResult); xmlErr != nil {
+		return xmlErr
+	}
+	expectedHash := md5.Sum(partHashes)
+	expectedETag := fmt.Sprintf("%s-%d", hex.EncodeToString(expectedHash[:]), len(complete.Parts))
+	return checkETag(completeResult.ETag, expectedETag)
+}
+
+// head returns the response to a HEAD request for an object, or nil if the object doesn't exist
+func (t *s3Transport) head(bucket, key string) (resp *http.Response, e error) {
+	resp, e = t.request("HEAD", bucket, key, nil, nil, nil)
+	if reqErr, isReqErr := e.(*s3RequestError); isReqErr && reqErr.StatusCode == http.StatusNotFound {
+		e = nil
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return
+}
+
+// Verify compares the object's ETag with the hash.
+// The ETag of a multipart object isn't the hash of the whole file, so it can only be checked against the local file (see VerifyBatch).
+func (t *s3Transport) Verify(subPath, filename, hash string) (bool, error) {
+	return t.verifyObject(BatchFile{SubPath: subPath, Filename: filename}, hash)
+}
+
+// VerifyBatch verifies the objects one at a time; the ETag of a multipart object is calculated again from the local file,
+// using the part size in the object's metadata, and the hash is compared with the local file
+func (t *s3Transport) VerifyBatch(files []BatchFile, hashes []string) (matches []bool, e error) {
+	matches = make([]bool, len(files))
+	for iFile, file := range files {
+		if matches[iFile], e = t.verifyObject(file, hashes[iFile]); e != nil {
+			return
+		}
+	}
+	return
+}
+
+// verifyObject compares an object's ETag with the hash, or, for a multipart object, with the local file
+func (t *s3Transport) verifyObject(file BatchFile, hash string) (bool, error) {
+	bucket, key, objErr := t.object(file.SubPath, file.Filename)
+	if objErr != nil {
+		return false, objErr
+	}
+	resp, headErr := t.head(bucket, key)
+	if headErr != nil || resp == nil {
+		return false, headErr
+	}
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if !strings.Contains(etag, "-") {
+		return etag == hash, nil
+	}
+	partSize, parseErr := strconv.ParseInt(resp.Header.Get(s3PartSizeHeader), 10, 64)
+	if parseErr != nil || partSize <= 0 {
+		return false, fmt.Errorf("The part size of the multipart object <%s> is not in its metadata (%s)", key, s3PartSizeHeader)
+	}
+	if file.LocalPath == "" {
+		return false, fmt.Errorf("The multipart object <%s> can only be verified against the local file", key)
+	}
+	expectedETag, fileHash, hashErr := multipartETag(file.LocalPath, partSize)
+	if hashErr != nil {
+		return false, hashErr
+	}
+	return etag == expectedETag && fileHash == hash, nil
+}
+
+func (t *s3Transport) Exists(subPath, filename string, size int64) (bool, error) {
+	bucket, key, objErr := t.object(subPath, filename)
+	if objErr != nil {
+		return false, objErr
+	}
+	resp, headErr := t.head(bucket, key)
+	if headErr != nil || resp == nil {
+		return false, headErr
+	}
+	remoteSize, parseErr := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if parseErr != nil {
+		return false, fmt.Errorf("Unable to get the size of the object: %v", parseErr)
+	}
+	return remoteSize == size, nil
+}
+
+func (t *s3Transport) Delete(subPath, filename string) error {
+	bucket, key, objErr := t.object(subPath, filename)
+	if objErr != nil {
+		return objErr
+	}
+	resp, delErr := t.request("DELETE", bucket, key, nil, nil, nil)
+	if delErr != nil {
+		return delErr
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+* transport_sftp.go
+*
+* the sftp transport sends files to a remote host with the sftp program in batch mode.
+* Files are sent with the sftp protocol; the remote hash for verification is computed with md5sum over ssh,
+* as for the rsync transport, so that the file doesn't have to be fetched back.
+ */
+
+package hornet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type sftpTransport struct {
+	destDirBase    string
+	ssh            sshTarget
+	bandwidthLimit int64
+}
+
+func newSftpTransport(settings map[string]interface{}) (Transport, error) {
+	t := &sftpTransport{
+		destDirBase: getSetting(settings, "dest-dir"),
+		ssh:         newSSHTarget(settings),
+	}
+	if t.ssh.hostname == "" {
+		return nil, errors.New("The sftp transport requires a hostname")
+	}
+	if t.destDirBase == "" {
+		return nil, errors.New("The destination directory (dest-dir) is not set")
+	}
+	var limitErr error
+	if t.bandwidthLimit, limitErr = getBandwidthLimit(settings); limitErr != nil {
+		return nil, limitErr
+	}
+	return t, nil
+}
+
+func (t *sftpTransport) Destination() string {
+	return t.ssh.hostname
+}
+
+// sftpQuote quotes a path for use in an sftp batch command
+func sftpQuote(path string) string {
+	return `"` + strings.Replace(strings.Replace(path, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// remotePath returns the path at the destination; remote paths always use forward slashes
+func (t *sftpTransport) remotePath(subPath, filename string) string {
+	return path.Join(t.destDirBase, strings.Replace(subPath, `\`, "/", -1), filename)
+}
+
+// batch runs a set of sftp commands, and returns the output.
+// Commands that start with - are allowed to fail; the batch stops at the first other command that fails.
+func (t *sftpTransport) batch(commands ...string) (output []byte, e error) {
+	args := t.ssh.options("-P")
+	if t.bandwidthLimit > 0 {
+		// sftp's limit is in kbit/s
+		args = append(args, "-l", strconv.FormatInt((t.bandwidthLimit*8+999)/1000, 10))
+	}
+	args = append(args, "-b", "-", t.ssh.userHost())
+	cmd := exec.Command("sftp", args...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if output, e = cmd.Output(); e != nil {
+		e = fmt.Errorf("sftp to %s failed: %v: %s", t.ssh.hostname, e, strings.TrimSpace(stderr.String()))
+	}
+	return
+}
+
+// Ship uploads the file under a temporary name, and then renames it, so that a partial upload is never mistaken for the file
+func (t *sftpTransport) Ship(localPath, subPath, filename string) error {
+	destPath := t.remotePath(subPath, filename)
+	tempPath := destPath + ".hmtemp"
+	var commands []string
+	// make each level of the destination directory; existing directories give errors, which are ignored
+	dirPath := ""
+	for _, dirName := range strings.Split(path.Dir(destPath), "/") {
+		if dirName == "" {
+			dirPath = "/"
+			continue
+		}
+		dirPath = path.Join(dirPath, dirName)
+		commands = append(commands, "-mkdir "+sftpQuote(dirPath))
+	}
+	commands = append(commands,
+		"put -p "+sftpQuote(localPath)+" "+sftpQuote(tempPath),
+		"-rm "+sftpQuote(destPath),
+		"rename "+sftpQuote(tempPath)+" "+sftpQuote(destPath))
+	_, batchErr := t.batch(commands...)
+	return batchErr
+}
+
+func (t *sftpTransport) Verify(subPath, filename, hash string) (bool, error) {
+	output, sshErr := t.ssh.run("md5sum", "-b", shellQuote(t.remotePath(subPath, filename)))
+	if sshErr != nil {
+		return false, fmt.Errorf("Unable to hash the file on %s: %v", t.ssh.hostname, sshErr)
+	}
+	destHash, parseErr := parseHashOutput(output)
+	if parseErr != nil {
+		return false, parseErr
+	}
+	return destHash == hash, nil
+}
+
+// Exists lists the file; a missing file gives an error from ls, which is ignored, so that it can be distinguished from a connection error
+func (t *sftpTransport) Exists(subPath, filename string, size int64) (bool, error) {
+	destPath := t.remotePath(subPath, filename)
+	output, batchErr := t.batch("-ls -ln " + sftpQuote(destPath))
+	if batchErr != nil {
+		return false, batchErr
+	}
+	// the output includes the echoed commands (starting with "sftp>"), and then a line like
+	// -rw-r--r--    1 1000     1000         1234 Jan  1 00:00 /remote-data/sub/file
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 9 || fields[0] == "sftp>" || strings.HasPrefix(fields[0], "-") == false {
+			continue
+		}
+		if remoteSize, parseErr := strconv.ParseInt(fields[4], 10, 64); parseErr == nil {
+			return remoteSize == size, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *sftpTransport) Delete(subPath, filename string) error {
+	_, batchErr := t.batch("rm " + sftpQuote(t.remotePath(subPath, filename)))
+	return batchErr
+}
@@ -0,0 +1,164 @@
+package hornet
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestFile creates a file with the given contents, and returns its md5 hash
+func writeTestFile(t *testing.T, path, contents string) string {
+	t.Helper()
+	if mkErr := os.MkdirAll(filepath.Dir(path), 0775); mkErr != nil {
+		t.Fatal(mkErr)
+	}
+	if writeErr := os.WriteFile(path, []byte(contents), 0664); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	hash := md5.Sum([]byte(contents))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestLocalTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		subPath  string
+		filename string
+		contents string
+	}{
+		{"flat", "", "file.egg", "some data"},
+		{"sub-path", "run1/part2", "file.egg", "some more data"},
+		{"spaces", "run 1", "my file.egg", "data with spaces"},
+		{"empty", "run1", "empty.egg", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srcPath := filepath.Join(t.TempDir(), test.filename)
+			hash := writeTestFile(t, srcPath, test.contents)
+			size := int64(len(test.contents))
+
+			transport, newErr := NewTransport(map[string]interface{}{"transport": "local", "dest-dir": t.TempDir()})
+			if newErr != nil {
+				t.Fatal(newErr)
+			}
+
+			if exists, existsErr := transport.Exists(test.subPath, test.filename, size); exists || existsErr != nil {
+				t.Errorf("Exists before shipping: got %v, %v; expected false, nil", exists, existsErr)
+			}
+			if shipErr := transport.Ship(srcPath, test.subPath, test.filename); shipErr != nil {
+				t.Fatalf("Ship: %v", shipErr)
+			}
+			if exists, existsErr := transport.Exists(test.subPath, test.filename, size); !exists || existsErr != nil {
+				t.Errorf("Exists: got %v, %v; expected true, nil", exists, existsErr)
+			}
+			if exists, existsErr := transport.Exists(test.subPath, test.filename, size+1); exists || existsErr != nil {
+				t.Errorf("Exists with the wrong size: got %v, %v; expected false, nil", exists, existsErr)
+			}
+			if matches, verifyErr := transport.Verify(test.subPath, test.filename, hash); !matches || verifyErr != nil {
+				t.Errorf("Verify: got %v, %v; expected true, nil", matches, verifyErr)
+			}
+			if matches, verifyErr := transport.Verify(test.subPath, test.filename, "00000000000000000000000000000000"); matches || verifyErr != nil {
+				t.Errorf("Verify with the wrong hash: got %v, %v; expected false, nil", matches, verifyErr)
+			}
+			if deleteErr := transport.Delete(test.subPath, test.filename); deleteErr != nil {
+				t.Errorf("Delete: %v", deleteErr)
+			}
+			if exists, existsErr := transport.Exists(test.subPath, test.filename, size); exists || existsErr != nil {
+				t.Errorf("Exists after deleting: got %v, %v; expected false, nil", exists, existsErr)
+			}
+			if _, verifyErr := transport.Verify(test.subPath, test.filename, hash); verifyErr == nil {
+				t.Error("Verify after deleting: expected an error")
+			}
+		})
+	}
+}
+
+func TestFindRsyncFileError(t *testing.T) {
+	output := `rsync: link_stat "/data/./run1/missing.egg" failed: No such file or directory (2)
+rsync: send_files failed to open "/data/./run2/unreadable.egg": Permission denied (13)
+rsync: link_stat "top.egg" failed: No such file or directory (2)
+rsync error: some files/attrs were not transferred (see previous errors) (code 23) at main.c(1207) [sender=3.1.2]
+`
+	tests := []struct {
+		relPath  string
+		expected string
+	}{
+		{"run1/missing.egg", `rsync: link_stat "/data/./run1/missing.egg" failed: No such file or directory (2)`},
+		{"run2/unreadable.egg", `rsync: send_files failed to open "/data/./run2/unreadable.egg": Permission denied (13)`},
+		{"top.egg", `rsync: link_stat "top.egg" failed: No such file or directory (2)`},
+		{"run1/shipped.egg", ""},
+		// part of a filename doesn't match
+		{"issing.egg", ""},
+	}
+	for _, test := range tests {
+		if line := findRsyncFileError(output, test.relPath); line != test.expected {
+			t.Errorf("findRsyncFileError(%q): got %q; expected %q", test.relPath, line, test.expected)
+		}
+	}
+}
+
+func TestParseHashListOutput(t *testing.T) {
+	output := []byte(`dc5e29010b13215bbf8cfc6997f15489 */remote-data/run1/file1.egg
+0cc175b9c0f1b6a831c399e269772661 */remote-data/run 2/file *2.egg
+`)
+	expected := map[string]string{
+		"/remote-data/run1/file1.egg":    "dc5e29010b13215bbf8cfc6997f15489",
+		"/remote-data/run 2/file *2.egg": "0cc175b9c0f1b6a831c399e269772661",
+	}
+	hashes := parseHashListOutput(output)
+	if len(hashes) != len(expected) {
+		t.Errorf("Got %d hashes; expected %d: %v", len(hashes), len(expected), hashes)
+	}
+	for path, hash := range expected {
+		if hashes[path] != hash {
+			t.Errorf("Hash of <%s>: got %q; expected %q", path, hashes[path], hash)
+		}
+	}
+}
+
+func TestRsyncRemoteShell(t *testing.T) {
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"ssh", "-o", "BatchMode=yes"}, `'ssh' '-o' 'BatchMode=yes'`},
+		{[]string{"ssh", "-i", "/home/me/my keys/id_rsa"}, `'ssh' '-i' '/home/me/my keys/id_rsa'`},
+		{[]string{"ssh", "-i", "/home/me/o'brien/id_rsa"}, `'ssh' '-i' '/home/me/o''brien/id_rsa'`},
+	}
+	for _, test := range tests {
+		if shell := rsyncRemoteShell(test.command); shell != test.expected {
+			t.Errorf("rsyncRemoteShell(%q): got %s; expected %s", test.command, shell, test.expected)
+		}
+	}
+}
+
+func TestRsyncShipBatch(t *testing.T) {
+	if _, pathErr := exec.LookPath("rsync"); pathErr != nil {
+		t.Skip("rsync is not available")
+	}
+	srcBase := t.TempDir()
+	writeTestFile(t, filepath.Join(srcBase, "run1", "file1.egg"), "data 1")
+	writeTestFile(t, filepath.Join(srcBase, "run1", "file 2.egg"), "data 2")
+	files := []BatchFile{
+		{LocalPath: filepath.Join(srcBase, "run1", "file1.egg"), SubPath: "run1", Filename: "file1.egg"},
+		{LocalPath: filepath.Join(srcBase, "run1", "missing.egg"), SubPath: "run1", Filename: "missing.egg"},
+		{LocalPath: filepath.Join(srcBase, "run1", "file 2.egg"), SubPath: "run1", Filename: "file 2.egg"},
+	}
+
+	transport, newErr := NewTransport(map[string]interface{}{"transport": "rsync", "dest-dir": t.TempDir()})
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	errs := ShipFiles(transport, files)
+	for iFile, file := range files {
+		if shipped := errs[iFile] == nil; shipped != (file.Filename != "missing.egg") {
+			t.Errorf("<%s>: unexpected result: %v", file.Filename, errs[iFile])
+		}
+	}
+	if exists, _ := transport.Exists("run1", "file 2.egg", 6); !exists {
+		t.Error("<file 2.egg> was not shipped")
+	}
+}
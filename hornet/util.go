@@ -3,10 +3,15 @@ package hornet
 
 import (
 	//"errors"
-	//"fmt"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/spf13/viper"
 )
 
 // PathIsDirectory returns true if the string argument is a path to a
@@ -97,7 +102,132 @@ func ConvertToString(ifcVal interface{}) string {
 		return val
 	case []uint8:
 		return string(val)
+	// decoded JSON and msgpack numbers (e.g. run IDs) are formatted in decimal
+	case int, int64, uint64:
+		return fmt.Sprint(val)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
 	default:
 		return "UNKNOWN MESSAGE TYPE"
 	}
 }
+
+// ConvertToInt converts interface{} values with the types that typically underly configuration and JSON-encoded numbers
+func ConvertToInt(ifcVal interface{}) int {
+	switch val := ifcVal.(type) {
+	case int:
+		return val
+	case int64:
+		return int(val)
+	case uint64:
+		return int(val)
+	case float64:
+		return int(val)
+	default:
+		return 0
+	}
+}
+
+// ParseSizeInBytes converts a size such as "64MB" to a number of bytes.
+// As for sizes in the configuration, the units (B, KB, MB, GB or TB; the B can be left out of the others) are powers of 1024,
+// and are not case-sensitive.
+func ParseSizeInBytes(sizeString string) (bytes int64, e error) {
+	size := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(sizeString)), "B")
+	multiplier := int64(1)
+	for iUnit, unit := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(size, unit) {
+			multiplier = int64(1) << (10 * uint(iUnit+1))
+			size = strings.TrimSuffix(size, unit)
+			break
+		}
+	}
+	value, parseErr := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	if parseErr != nil || value < 0 {
+		e = fmt.Errorf("Invalid size: <%s>", sizeString)
+		return
+	}
+	bytes = value * multiplier
+	return
+}
+
+// GetConfigSizeInBytes reads a size (a string such as "64MB", or a number of bytes) from the configuration.
+// It gives 0 if the option isn't set, and an error if it can't be parsed.
+func GetConfigSizeInBytes(key string) (bytes int64, e error) {
+	if !viper.IsSet(key) {
+		return
+	}
+	bytes, e = ParseSizeInBytes(viper.GetString(key))
+	if e != nil {
+		e = fmt.Errorf("Invalid %s: %v", key, e)
+	}
+	return
+}
+
+// ConvertToStringSlice converts interface{} values holding a list (e.g. a decoded JSON or msgpack array) to a slice of strings.
+// A single string or number is converted to a slice with one element.  Numbers (e.g. run IDs) are formatted in decimal,
+// and list elements of other types are skipped.
+func ConvertToStringSlice(ifcVal interface{}) (strs []string) {
+	switch val := ifcVal.(type) {
+	case []interface{}:
+		for _, elem := range val {
+			switch elem.(type) {
+			case string, []uint8, int, int64, uint64, float64:
+				strs = append(strs, ConvertToString(elem))
+			default:
+				Log.Warningf("Ignoring list element of unexpected type: %v", elem)
+			}
+		}
+	case []string:
+		strs = val
+	case string, []uint8, int, int64, uint64, float64:
+		strs = []string{ConvertToString(val)}
+	}
+	return
+}
+
+// GetPayloadValue returns the element of a message payload with the given key.
+// Received payloads are normalized to map[string]interface{} (see message.go), but map[interface{}]interface{} is also accepted.
+func GetPayloadValue(payload interface{}, key string) (value interface{}, present bool) {
+	switch typedPayload := payload.(type) {
+	case map[string]interface{}:
+		value, present = typedPayload[key]
+	case map[interface{}]interface{}:
+		value, present = typedPayload[key]
+	}
+	return
+}
+
+// rateLimitedReader limits the rate at which data can be read, e.g. to limit the bandwidth used by a transfer
+type rateLimitedReader struct {
+	reader         io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	nRead          int64
+}
+
+// NewRateLimitedReader wraps a reader so that no more than the given number of bytes are read per second.
+// If the limit is not positive, the reader is returned unchanged.
+func NewRateLimitedReader(reader io.Reader, bytesPerSecond int64) io.Reader {
+	if bytesPerSecond <= 0 {
+		return reader
+	}
+	return &rateLimitedReader{reader: reader, bytesPerSecond: bytesPerSecond}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (n int, e error) {
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	// read at most a tenth of a second's worth at a time, so that the rate is smooth
+	if maxRead := r.bytesPerSecond/10 + 1; int64(len(p)) > maxRead {
+		p = p[:maxRead]
+	}
+	n, e = r.reader.Read(p)
+	r.nRead += int64(n)
+	// wait until the total read is within the limit
+	allowedTime := time.Duration(float64(r.nRead) / float64(r.bytesPerSecond) * float64(time.Second))
+	if elapsed := time.Since(r.start); allowedTime > elapsed {
+		time.Sleep(allowedTime - elapsed)
+	}
+	return
+}
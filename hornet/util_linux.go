@@ -4,8 +4,10 @@ package hornet
 import (
 	//"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
+	"syscall"
 )
 
 // Hash performs an md5 hash of the specified file and returns the hash string
@@ -20,3 +22,97 @@ func Hash(filename string) (hash string, e error) {
 	}
 	return
 }
+
+// SameFilesystem returns true if the two paths are on the same filesystem (device), so that files can be renamed from one to the other
+func SameFilesystem(path1, path2 string) (same bool, e error) {
+	info1, stat1Err := os.Stat(path1)
+	if stat1Err != nil {
+		e = stat1Err
+		return
+	}
+	info2, stat2Err := os.Stat(path2)
+	if stat2Err != nil {
+		e = stat2Err
+		return
+	}
+	sys1, ok1 := info1.Sys().(*syscall.Stat_t)
+	sys2, ok2 := info2.Sys().(*syscall.Stat_t)
+	if !ok1 || !ok2 {
+		e = fmt.Errorf("Unable to get the device information for <%s> and <%s>", path1, path2)
+		return
+	}
+	same = sys1.Dev == sys2.Dev
+	return
+}
+
+// FilesystemID returns an identifier for the filesystem (device) containing the path
+func FilesystemID(path string) (id string, e error) {
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		e = statErr
+		return
+	}
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		e = fmt.Errorf("Unable to get the device information for <%s>", path)
+		return
+	}
+	id = fmt.Sprintf("dev:%d", sys.Dev)
+	return
+}
+
+// FreeSpace returns the number of bytes available to unprivileged users on the filesystem containing the path
+func FreeSpace(path string) (bytes uint64, e error) {
+	var stat syscall.Statfs_t
+	if e = syscall.Statfs(path, &stat); e != nil {
+		return
+	}
+	bytes = stat.Bavail * uint64(stat.Bsize)
+	return
+}
+
+// SyncDirectory flushes a directory's entries (e.g. a newly-renamed file) to disk
+func SyncDirectory(dir string) error {
+	dirFile, openErr := os.Open(dir)
+	if openErr != nil {
+		return openErr
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
+
+// CopyOwnership sets the owner and group of a file to those of the source file
+func CopyOwnership(sourceInfo os.FileInfo, destination string) error {
+	sys, ok := sourceInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("Unable to get the ownership of <%s>", sourceInfo.Name())
+	}
+	return os.Lchown(destination, int(sys.Uid), int(sys.Gid))
+}
+
+// CopyXattrs copies the extended attributes of a file to another file
+func CopyXattrs(source, destination string) error {
+	listSize, listErr := syscall.Listxattr(source, nil)
+	if listErr != nil || listSize == 0 {
+		return listErr
+	}
+	list := make([]byte, listSize)
+	if listSize, listErr = syscall.Listxattr(source, list); listErr != nil {
+		return listErr
+	}
+	// the list is a set of null-terminated names
+	for _, name := range strings.Split(strings.TrimRight(string(list[:listSize]), "\x00"), "\x00") {
+		valueSize, getErr := syscall.Getxattr(source, name, nil)
+		if getErr != nil {
+			return getErr
+		}
+		value := make([]byte, valueSize)
+		if valueSize, getErr = syscall.Getxattr(source, name, value); getErr != nil {
+			return getErr
+		}
+		if setErr := syscall.Setxattr(destination, name, value[:valueSize], 0); setErr != nil {
+			return fmt.Errorf("Unable to set extended attribute <%s>: %v", name, setErr)
+		}
+	}
+	return nil
+}
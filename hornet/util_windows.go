@@ -2,10 +2,14 @@
 package hornet
 
 import (
-	//"errors"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"unsafe"
 )
 
 // Hash performs an md5 hash of the specified file and returns the hash string
@@ -24,3 +28,52 @@ func Hash(filename string) (hash string, e error) {
 	}
 	return
 }
+
+// SameFilesystem returns true if the two paths are on the same filesystem (device), so that files can be renamed from one to the other
+// On Windows this is not checked, and it always returns false
+func SameFilesystem(path1, path2 string) (same bool, e error) {
+	return
+}
+
+// FilesystemID returns an identifier for the filesystem (volume) containing the path
+func FilesystemID(path string) (id string, e error) {
+	absPath, absErr := filepath.Abs(path)
+	if absErr != nil {
+		e = absErr
+		return
+	}
+	id = "volume:" + filepath.VolumeName(absPath)
+	return
+}
+
+// FreeSpace returns the number of bytes available to the current user on the volume containing the path
+func FreeSpace(path string) (bytes uint64, e error) {
+	pathPtr, ptrErr := syscall.UTF16PtrFromString(path)
+	if ptrErr != nil {
+		e = ptrErr
+		return
+	}
+	getDiskFreeSpaceEx := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+	if ret, _, callErr := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&bytes)), 0, 0); ret == 0 {
+		e = callErr
+	}
+	return
+}
+
+// SyncDirectory flushes a directory's entries to disk
+// Directories cannot be synced on Windows, so this does nothing
+func SyncDirectory(dir string) error {
+	return nil
+}
+
+// CopyOwnership sets the owner and group of a file to those of the source file
+// This is not supported on Windows, so it does nothing
+func CopyOwnership(sourceInfo os.FileInfo, destination string) error {
+	return nil
+}
+
+// CopyXattrs copies the extended attributes of a file to another file
+// This is not supported on Windows
+func CopyXattrs(source, destination string) error {
+	return errors.New("Copying extended attributes is not supported on this system")
+}
@@ -1,16 +1,79 @@
 package hornet
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/spf13/viper"
 	"gopkg.in/fsnotify.v1"
 )
 
+// WatcherCommandType specifies the action requested of the watcher by a WatcherCommand
+type WatcherCommandType uint
+
+const (
+	// WatcherAddDir adds a directory (and its subdirectories) to the set of watched directories
+	WatcherAddDir WatcherCommandType = iota
+	// WatcherRemoveDir removes a directory (and its subdirectories) from the set of watched directories
+	WatcherRemoveDir
+	// WatcherListDirs returns the current set of watch directories
+	WatcherListDirs
+)
+
+// WatcherCommand is a request to modify or inspect the set of directories being watched while hornet is running.
+// The directories are all added or removed, or, if any of them can't be, none are.
+// The result is returned on ReplyChan, if it's not nil.
+type WatcherCommand struct {
+	Command   WatcherCommandType
+	Dirs      []string
+	ReplyChan chan WatcherCommandReturn
+}
+
+// WatcherCommandReturn holds the result of a WatcherCommand: the watch directories after the command was executed,
+// and an error, if one occurred.
+type WatcherCommandReturn struct {
+	Dirs []string
+	Err  error
+}
+
+// Globally-accessible queue for submitting commands to the watcher
+var WatcherCommandQueue = make(chan WatcherCommand, 10)
+
+// Value to confirm that the watcher routine has started
+var WatcherIsActive atomic.Bool
+
+// Maximum time to wait for the watcher to respond to a command
+var watcherCommandTimeout = 10 * time.Second
+
+// ModifyWatchDirs submits a command to the watcher and waits for the result.
+// It returns the set of watch directories after the command was executed.
+func ModifyWatchDirs(command WatcherCommandType, cmdDirs []string) (dirs []string, e error) {
+	if !WatcherIsActive.Load() {
+		e = errors.New("The watcher is not active")
+		return
+	}
+	replyChan := make(chan WatcherCommandReturn, 1)
+	select {
+	case WatcherCommandQueue <- WatcherCommand{Command: command, Dirs: cmdDirs, ReplyChan: replyChan}:
+	case <-time.After(watcherCommandTimeout):
+		e = errors.New("Timed out while submitting the command to the watcher")
+		return
+	}
+	select {
+	case ret := <-replyChan:
+		dirs, e = ret.Dirs, ret.Err
+	case <-time.After(watcherCommandTimeout):
+		e = errors.New("Timed out while waiting for the watcher to respond")
+	}
+	return
+}
+
 func shouldPayAttention(evt fsnotify.Event) bool {
 	// Returns true if the event was triggered by file creation or rename (i.e. move)
 	newCreated := evt.Op == fsnotify.Create
@@ -23,10 +86,23 @@ func isEintr(e error) bool {
 	return e != nil && strings.Contains(e.Error(), "interrupted system call")
 }
 
-func fileMoratorium(file string, fileQueue chan string, waitTime time.Duration) {
-	time.Sleep(waitTime)
-	fileQueue <- file
-	return
+// moratoriumFile is a file that has been found by the watcher, and will be submitted to the scheduler once its moratorium ends
+type moratoriumFile struct {
+	path     string
+	submitAt time.Time
+}
+
+// Interval between attempts to submit files whose moratorium has ended
+var watcherSubmitInterval = 100 * time.Millisecond
+
+// isWithinWatchDirs returns true if the path is one of, or is within one of, the given directories
+func isWithinWatchDirs(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
 }
 
 func Watcher(context OperatorContext) {
@@ -54,6 +130,21 @@ func Watcher(context OperatorContext) {
 	}
 	Log.Infof("Ignoring directories named: %v", ignoreDirs)
 
+	// files waiting to be submitted, in the order they were found
+	pendingFiles := []moratoriumFile{}
+	wasThrottled := false
+
+	// all directories (including subdirectories) that have been added to the fsnotify watcher
+	watchedPaths := make(map[string]bool)
+	// the top-level watch directories, in the order they were added
+	watchDirs := []string{}
+	// the base paths added for watch directories added on request; only these are removed with their watch directories,
+	// since the others are needed by the classifier
+	addedBasePaths := make(map[string]bool)
+	// while a watch directory is being added, the subdirectories newly added to the fsnotify watcher, so that they can be removed if the walk fails
+	var addedPaths []string
+	recordAddedPaths := false
+
 	processRecursiveDir := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			Log.Criticalf("Unable to recursively process directory %s", path)
@@ -64,7 +155,7 @@ func Watcher(context OperatorContext) {
 			// File case
 			Log.Debugf("Submitting file [%v]", path)
 			//context.SchStream <- path
-			go fileMoratorium(path, context.SchStream, moratoriumTime)
+			pendingFiles = append(pendingFiles, moratoriumFile{path: path, submitAt: time.Now().Add(moratoriumTime)})
 		} else if PathIsDirectory(path) {
 			for _, ignoreDir := range ignoreDirs {
 				if info.Name() == ignoreDir {
@@ -73,61 +164,194 @@ func Watcher(context OperatorContext) {
 				}
 			}
 			// Directory case
+			// the caller decides whether the error is fatal: it isn't when adding a directory on request
 			if err := watcher.Add(path); err != nil {
-				Log.Criticalf("Couldn't add subdir %s watch [%v]", path, err)
-				context.ReqQueue <- ThreadCannotContinue
+				Log.Errorf("Couldn't add subdir %s watch [%v]", path, err)
 				procErr := fmt.Errorf("Unable to add directory %s to watch [%v]", path, err)
 				return procErr
 			}
+			if recordAddedPaths && !watchedPaths[path] {
+				addedPaths = append(addedPaths, path)
+			}
+			watchedPaths[path] = true
 			Log.Noticef("Added subdirectory to watch [%v]", path)
 		}
 		return nil
 	}
 
-	// Add watch directories to watcher
-	var nOrigDirs uint = 0
-	if viper.IsSet("watcher.dir") {
-		// n=1 case
-		watchDir := viper.GetString("watcher.dir")
+	// addWatchDir adds a top-level watch directory and all of its subdirectories to the watcher;
+	// any files already present are submitted for processing
+	addWatchDir := func(watchDir string) error {
 		if !PathIsDirectory(watchDir) {
-			Log.Criticalf("Watch directory does not exist or is not a directory:\n\t%s", watchDir)
-			context.ReqQueue <- ThreadCannotContinue
-			return
+			return fmt.Errorf("Watch directory does not exist or is not a directory:\n\t%s", watchDir)
 		}
-                if recProcErr := filepath.Walk(watchDir, processRecursiveDir); recProcErr != nil {
-			Log.Criticalf("Error processing directory or file [%s]\n\t:%v", watchDir, recProcErr)
-			context.ReqQueue <- ThreadCannotContinue
-			return
+		watchDir, _ = filepath.Abs(watchDir)
+		for _, existingDir := range watchDirs {
+			if existingDir == watchDir {
+				return fmt.Errorf("Directory is already being watched: <%s>", watchDir)
+			}
+		}
+		// if the walk fails, the subdirectories and files that it found are forgotten
+		addedPaths = nil
+		nPending := len(pendingFiles)
+		recordAddedPaths = true
+		recProcErr := filepath.Walk(watchDir, processRecursiveDir)
+		recordAddedPaths = false
+		if recProcErr != nil {
+			for _, path := range addedPaths {
+				watcher.Remove(path)
+				delete(watchedPaths, path)
+			}
+			pendingFiles = pendingFiles[:nPending]
+			return fmt.Errorf("Error processing directory or file [%s]\n\t:%v", watchDir, recProcErr)
 		}
 		watcher.Add(watchDir)
+		watchedPaths[watchDir] = true
+		watchDirs = append(watchDirs, watchDir)
 		Log.Noticef("Now watching <%s>", watchDir)
-		nOrigDirs++
+		return nil
 	}
-	if viper.IsSet("watcher.dirs") {
-		// n>1 case
-		watchDirs := viper.GetStringSlice("watcher.dirs")
-		for _, watchDir := range watchDirs {
-			if !PathIsDirectory(watchDir) {
-				Log.Criticalf("Watch directory does not exist or is not a directory:\n\t%s", watchDir)
-				context.ReqQueue <- ThreadCannotContinue
-				return
+
+	// removeWatchDir removes a top-level watch directory and all of its subdirectories from the watcher
+	removeWatchDir := func(watchDir string) error {
+		watchDir, _ = filepath.Abs(watchDir)
+		iDir := -1
+		for i, existingDir := range watchDirs {
+			if existingDir == watchDir {
+				iDir = i
+				break
 			}
-			if recProcErr := filepath.Walk(watchDir, processRecursiveDir); recProcErr != nil {
-				Log.Criticalf("Error processing directory or file [%s]\n\t:%v", watchDir, recProcErr)
-				context.ReqQueue <- ThreadCannotContinue
+		}
+		if iDir < 0 {
+			return fmt.Errorf("Directory is not being watched: <%s>", watchDir)
+		}
+		watchDirs = append(watchDirs[:iDir], watchDirs[iDir+1:]...)
+		for path := range watchedPaths {
+			if path != watchDir && !strings.HasPrefix(path, watchDir+string(filepath.Separator)) {
+				continue
+			}
+			// paths may belong to another watch directory nested within this one
+			if isWithinWatchDirs(path, watchDirs) {
+				continue
+			}
+			if rmErr := watcher.Remove(path); rmErr != nil {
+				// the directory may already have been deleted, in which case fsnotify has stopped watching it
+				Log.Debugf("Unable to remove watch on <%s>: %v", path, rmErr)
+			}
+			delete(watchedPaths, path)
+		}
+		// files found in the directory that haven't been submitted yet are forgotten
+		keptFiles := pendingFiles[:0]
+		for _, file := range pendingFiles {
+			if !isWithinWatchDirs(file.path, []string{watchDir}) || isWithinWatchDirs(file.path, watchDirs) {
+				keptFiles = append(keptFiles, file)
+			}
+		}
+		if nDropped := len(pendingFiles) - len(keptFiles); nDropped > 0 {
+			Log.Infof("Dropped %d file(s) from <%s> that were waiting to be submitted", nDropped, watchDir)
+		}
+		pendingFiles = keptFiles
+		Log.Noticef("No longer watching <%s>", watchDir)
+		return nil
+	}
+
+	// checkCommandDirs checks the directories given in a command before any of them is added or removed,
+	// and returns their absolute paths
+	checkCommandDirs := func(dirs []string, adding bool) (absDirs []string, e error) {
+		listed := make(map[string]bool)
+		for _, dir := range dirs {
+			absDir, _ := filepath.Abs(dir)
+			isWatched := false
+			for _, existingDir := range watchDirs {
+				isWatched = isWatched || existingDir == absDir
+			}
+			switch {
+			case listed[absDir]:
+				e = fmt.Errorf("Directory is listed more than once: <%s>", absDir)
+			case adding && !PathIsDirectory(absDir):
+				e = fmt.Errorf("Watch directory does not exist or is not a directory: <%s>", absDir)
+			case adding && isWatched:
+				e = fmt.Errorf("Directory is already being watched: <%s>", absDir)
+			case !adding && !isWatched:
+				e = fmt.Errorf("Directory is not being watched: <%s>", absDir)
+			}
+			if e != nil {
 				return
 			}
-			watcher.Add(watchDir)
-			Log.Noticef("Now watching <%s>", watchDir)
-			nOrigDirs++
+			listed[absDir] = true
+			absDirs = append(absDirs, absDir)
+		}
+		return
+	}
+
+	// addWatchDirs adds watch directories on request; if one can't be added, those already added are removed again
+	addWatchDirs := func(dirs []string) error {
+		absDirs, checkErr := checkCommandDirs(dirs, true)
+		if checkErr != nil {
+			return checkErr
+		}
+		for iDir, dir := range absDirs {
+			if addErr := addWatchDir(dir); addErr != nil {
+				for _, addedDir := range absDirs[:iDir] {
+					removeWatchDir(addedDir)
+				}
+				return addErr
+			}
 		}
+		for _, dir := range absDirs {
+			if AddBasePath(dir) {
+				addedBasePaths[dir] = true
+			}
+		}
+		return nil
+	}
+
+	// removeWatchDirs removes watch directories on request
+	removeWatchDirs := func(dirs []string) error {
+		absDirs, checkErr := checkCommandDirs(dirs, false)
+		if checkErr != nil {
+			return checkErr
+		}
+		for _, dir := range absDirs {
+			removeWatchDir(dir)
+			if addedBasePaths[dir] {
+				RemoveBasePath(dir)
+				delete(addedBasePaths, dir)
+			}
+		}
+		return nil
+	}
+
+	// Add watch directories to watcher
+	var origDirs []string
+	if viper.IsSet("watcher.dir") {
+		// n=1 case
+		origDirs = append(origDirs, viper.GetString("watcher.dir"))
+	}
+	if viper.IsSet("watcher.dirs") {
+		// n>1 case
+		origDirs = append(origDirs, viper.GetStringSlice("watcher.dirs")...)
 	}
-	if nOrigDirs == 0 {
+	if len(origDirs) == 0 {
 		// n=0 case
 		Log.Critical("No watch directories were specified")
 		context.ReqQueue <- ThreadCannotContinue
 		return
 	}
+	for _, watchDir := range origDirs {
+		if addErr := addWatchDir(watchDir); addErr != nil {
+			Log.Critical(addErr.Error())
+			context.ReqQueue <- ThreadCannotContinue
+			return
+		}
+	}
+
+	WatcherIsActive.Store(true)
+	defer func() { WatcherIsActive.Store(false) }()
+
+	// files are submitted after their moratorium, unless the pipeline is saturated or the scheduling queue is full
+	submitTicker := time.NewTicker(watcherSubmitInterval)
+	defer submitTicker.Stop()
 
 	Log.Info("Started successfully. Waiting for events...")
 
@@ -146,6 +370,57 @@ runLoop:
 				break runLoop
 			}
 
+		case now := <-submitTicker.C:
+			nSubmitted := 0
+		submitLoop:
+			for _, file := range pendingFiles {
+				if file.submitAt.After(now) {
+					break
+				}
+				if PipelineIsSaturated() {
+					if !wasThrottled {
+						Log.Infof("Pipeline is saturated; holding %d file(s)", len(pendingFiles)-nSubmitted)
+						wasThrottled = true
+					}
+					break
+				}
+				select {
+				case context.SchStream <- file.path:
+					nSubmitted++
+				default:
+					// the scheduling queue is full
+					break submitLoop
+				}
+			}
+			if nSubmitted > 0 {
+				pendingFiles = pendingFiles[nSubmitted:]
+				if wasThrottled {
+					Log.Infof("Resuming file submission; %d file(s) held", len(pendingFiles))
+					wasThrottled = false
+				}
+			}
+			setWatcherPending(len(pendingFiles))
+
+		case command := <-WatcherCommandQueue:
+			var cmdErr error
+			switch command.Command {
+			case WatcherAddDir:
+				cmdErr = addWatchDirs(command.Dirs)
+			case WatcherRemoveDir:
+				cmdErr = removeWatchDirs(command.Dirs)
+			case WatcherListDirs:
+			default:
+				cmdErr = fmt.Errorf("Unknown watcher command: %v", command.Command)
+			}
+			if cmdErr != nil {
+				Log.Error(cmdErr.Error())
+			}
+			if command.ReplyChan != nil {
+				dirs := append([]string{}, watchDirs...)
+				sort.Strings(dirs)
+				command.ReplyChan <- WatcherCommandReturn{Dirs: dirs, Err: cmdErr}
+			}
+
 		case newEvent, queueOk := <-watcher.Events:
 			if !queueOk {
 				Log.Error("Watcher event queue has closed unexpectedly")
@@ -160,27 +435,18 @@ runLoop:
 			// New subdirectory OR file is created
 			fileName := newEvent.Name
 
+			// Rename events are also received for the original name of a file that is moved away
+			// (e.g. by the mover renaming it into warm storage), in which case it no longer exists here
+			if _, statErr := os.Lstat(fileName); os.IsNotExist(statErr) {
+				Log.Debugf("Ignoring event for a path that no longer exists [%v]", fileName)
+				continue
+			}
+
 			if recProcErr := filepath.Walk(fileName, processRecursiveDir); recProcErr != nil {
 				Log.Criticalf("Error processing directory or file [%s]\n\t:%v", fileName, recProcErr)
 				context.ReqQueue <- ThreadCannotContinue
 				break runLoop
 			}
-			/*
-				if PathIsRegularFile( fileName ) && shouldPayAttention( newEvent ) {
-					// File case
-					Log.Debug( "Submitting file [%v]", fileName )
-					//context.SchStream <- fileName
-					go fileMoratorium(fileName, context.SchStream, moratoriumTime)
-				} else if PathIsDirectory( fileName ) && shouldPayAttention( newEvent ) {
-					// Directory case
-					if err := watcher.Add( fileName ); err != nil {
-						Log.Critical( "Couldn't add subdir dir watch [%v]", err )
-						context.ReqQueue <- ThreadCannotContinue
-						break runLoop
-					}
-					Log.Notice( "Added subdirectory to watch [%v]", fileName )
-				}
-			*/
 		case watchErr, queueOk := <-watcher.Errors:
 			if !queueOk {
 				Log.Error("Watcher error queue has closed unexpectedly")
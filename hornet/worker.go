@@ -87,6 +87,7 @@ workLoop:
 					Log.Infof(withState("Executing command: %s %v"), job.CommandName, job.CommandArgs)
 					// create the command
 					cmd := exec.Command(job.CommandName, job.CommandArgs...)
+					PublishEvent(EventJobStarted, opReturn.FHeader, map[string]interface{}{"command": command})
 
 					// run the process
 					var outputBytes []byte
@@ -110,6 +111,16 @@ workLoop:
 								Log.Error(withState(opReturn.Err.Error()))
 							}
 						}
+						// the exit code is -1 if the process didn't start or was killed by a signal
+						exitCode, elapsed := -1, time.Duration(0)
+						if cmd.ProcessState != nil {
+							exitCode, elapsed = cmd.ProcessState.ExitCode(), time.Since(startTime)
+						}
+						PublishEvent(EventJobFinished, opReturn.FHeader, map[string]interface{}{
+							"command":   command,
+							"exit_code": exitCode,
+							"elapsed":   elapsed.Round(time.Millisecond).String(),
+						})
 						// if we're here, the job succeeded
 						Log.Infof(withState("Execution finished.  Elapsed time: %v"), time.Since(startTime))
 						Log.Debugf(withState("Job output:\n%s"), string(outputBytes))